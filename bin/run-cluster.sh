@@ -24,26 +24,16 @@ cleanup() {
 }
 trap cleanup EXIT
 
-genhash() {
-    printf "%s" "$1" | sha256sum | cut -f1 -d' '
-}
-
-bootnum="1"
 bootip="$networkprefix.2"
-bootid=$(genhash "$bootnum")
 
 # Start N nodes and pair them.
 for num in $(seq 1 "$numnodes")
 do
     nodeip="$networkprefix.$((num+1))"
 
-    # Generate node ID with node number.
-    nodeid=$(genhash "$num")
-
-    echo "Starting node: #$num, $nodeid@$nodeip:$port"
+    echo "Starting node: #$num, $nodeip:$port"
     docker run --net "$networkname" --ip "$nodeip" -t -d \
-        dhtnode "$num" "$nodeid" "$nodeip:$port" \
-                "$bootid" "$bootip:$port" >/dev/null &
+        dhtnode "$num" "$nodeip:$port" "$bootip:$port" >/dev/null &
 done
 
 printf "Waiting for all nodes to finish starting up... "
@@ -1,10 +1,10 @@
 #!/bin/sh
 menum=$1
-meid=$2
-meaddr=$3
+meaddr=$2
+otheraddr=$3
 
-otherid=$4
-otheraddr=$5
-
-echo "I am: #$menum, $meid@$meaddr"
-dhtnode -me "$meid@$meaddr" -other "$otherid@$otheraddr" -debug
+# The key, and the node ID derived from it, is generated on the first start.
+# The bootstrap node is contacted by its address, its node ID is learned by
+# pinging it.
+echo "I am: #$menum, $meaddr"
+dhtnode -key /tmp/dhtnode.key -me "$meaddr" -other "$otheraddr" -debug
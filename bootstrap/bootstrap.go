@@ -0,0 +1,163 @@
+// Package bootstrap collects the contacts that a node joins the network
+// through. The contacts are read from flags, seed files and DNS TXT records.
+//
+// A contact may be known by its address alone, its node ID is then zero and
+// is learned by pinging the address when the node joins.
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// Parse parses a contact as id@address, or as an address alone if the node ID
+// is unknown.
+func Parse(s string) (c route.Contact, err error) {
+	address := strings.TrimSpace(s)
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		c.NodeID, err = node.IDFromString(address[:i])
+		if err != nil {
+			err = fmt.Errorf("cannot parse node ID of %s: %w", s, err)
+			return
+		}
+		address = address[i+1:]
+	}
+
+	// An empty address would resolve to the local node.
+	_, _, err = net.SplitHostPort(address)
+	if err != nil {
+		err = fmt.Errorf("invalid address of %s: %w", s, err)
+		return
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		err = fmt.Errorf("cannot resolve address of %s: %w", s, err)
+		return
+	}
+	c.Address = *addr
+	return
+}
+
+// Format formats a contact as it's parsed by Parse.
+func Format(c route.Contact) string {
+	if !HasID(c) {
+		return c.Address.String()
+	}
+	return c.NodeID.String() + "@" + c.Address.String()
+}
+
+// HasID returns true if the node ID of the contact is known.
+func HasID(c route.Contact) bool {
+	return c.NodeID != node.ID{}
+}
+
+// Read reads a seed list with one contact per line. Blank lines are skipped,
+// and everything after a # is a comment.
+func Read(r io.Reader) (contacts []route.Contact, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		c, err := Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, scanner.Err()
+}
+
+// LoadFile reads the seed list in the file, see Read.
+func LoadFile(path string) ([]route.Contact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	contacts, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read seed file %s: %w", path, err)
+	}
+	return contacts, nil
+}
+
+// Resolver looks up the TXT records of a name, it's implemented by
+// net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// LookupTXT returns the contacts in the TXT records of the name. A record
+// holds one or more contacts separated by whitespace.
+func LookupTXT(ctx context.Context, r Resolver, name string) (contacts []route.Contact, err error) {
+	records, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up seeds at %s: %w", name, err)
+	}
+
+	for _, record := range records {
+		for _, field := range strings.Fields(record) {
+			c, err := Parse(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid seed at %s: %w", name, err)
+			}
+			contacts = append(contacts, c)
+		}
+	}
+	return contacts, nil
+}
+
+// Unique returns the contacts without duplicate addresses, in the order they
+// were first seen. A contact with a known node ID is kept over one without.
+func Unique(contacts []route.Contact) (unique []route.Contact) {
+	seen := make(map[string]int)
+	for _, c := range contacts {
+		i, ok := seen[c.Address.String()]
+		if !ok {
+			seen[c.Address.String()] = len(unique)
+			unique = append(unique, c)
+		} else if !HasID(unique[i]) {
+			unique[i] = c
+		}
+	}
+	return
+}
+
+// List collects the contacts of a repeated flag, it implements flag.Value.
+type List []route.Contact
+
+// String returns the contacts of the list separated by commas.
+func (l *List) String() string {
+	var s []string
+	for _, c := range *l {
+		s = append(s, Format(c))
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses the contact and adds it to the list.
+func (l *List) Set(s string) error {
+	c, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, c)
+	return nil
+}
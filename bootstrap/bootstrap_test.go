@@ -0,0 +1,150 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+const testID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// stubResolver serves TXT records from a map.
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return records, nil
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse(testID + "@127.0.0.1:8118")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.NodeID.String() != testID || c.Address.String() != "127.0.0.1:8118" {
+		t.Errorf("unexpected contact, got: %v@%v", c.NodeID, c.Address.String())
+	}
+	if Format(c) != testID+"@127.0.0.1:8118" {
+		t.Errorf("unexpected format, got: %s", Format(c))
+	}
+
+	c, err = Parse(" 127.0.0.1:8118 ")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if HasID(c) {
+		t.Errorf("expected unknown node ID, got: %v", c.NodeID)
+	}
+	if Format(c) != "127.0.0.1:8118" {
+		t.Errorf("unexpected format, got: %s", Format(c))
+	}
+
+	for _, s := range []string{"nope@127.0.0.1:8118", testID + "@", "127.0.0.1:port", ""} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("expected error for: %q", s)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "seeds")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# Seeds of the test network.\n\n" +
+		testID + "@127.0.0.1:8118\n" +
+		"  127.0.0.2:8118 # Address only.\n")
+	f.Close()
+
+	contacts, err := LoadFile(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contacts) != 2 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(contacts), 2)
+	}
+	if !HasID(contacts[0]) || HasID(contacts[1]) || contacts[1].Address.String() != "127.0.0.2:8118" {
+		t.Errorf("unexpected contacts, got: %v", contacts)
+	}
+
+	_, err = Read(strings.NewReader("127.0.0.1:8118\nnope@127.0.0.1:8118\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error on line 2, got: %v", err)
+	}
+
+	_, err = LoadFile(f.Name() + ".missing")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not exist error, got: %v", err)
+	}
+}
+
+func TestLookupTXT(t *testing.T) {
+	r := stubResolver{
+		"seeds.example.com": []string{
+			testID + "@127.0.0.1:8118 127.0.0.2:8118",
+			"127.0.0.3:8118",
+		},
+		"broken.example.com": []string{"127.0.0.1:port"},
+	}
+
+	contacts, err := LookupTXT(context.Background(), r, "seeds.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(contacts) != 3 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(contacts), 3)
+	}
+	if contacts[0].NodeID.String() != testID || contacts[2].Address.String() != "127.0.0.3:8118" {
+		t.Errorf("unexpected contacts, got: %v", contacts)
+	}
+
+	if _, err := LookupTXT(context.Background(), r, "broken.example.com"); err == nil {
+		t.Error("expected error on invalid record")
+	}
+	if _, err := LookupTXT(context.Background(), r, "missing.example.com"); err == nil {
+		t.Error("expected error on missing name")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	var l List
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&l, "other", "")
+	err := fs.Parse([]string{
+		"-other", "127.0.0.1:8118",
+		"-other", "127.0.0.2:8118",
+		"-other", testID + "@127.0.0.1:8118",
+		"-other", "127.0.0.2:8118",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(l) != 4 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(l), 4)
+	}
+
+	unique := Unique(l)
+	if len(unique) != 2 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(unique), 2)
+	}
+	id, _ := node.IDFromString(testID)
+	if !unique[0].NodeID.Equal(id) || unique[1].Address.String() != "127.0.0.2:8118" {
+		t.Errorf("unexpected contacts, got: %v", unique)
+	}
+
+	if fs.Parse([]string{"-other", "nope@127.0.0.1:8118"}) == nil {
+		t.Error("expected error on invalid contact")
+	}
+}
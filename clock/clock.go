@@ -0,0 +1,210 @@
+// Package clock provides an abstraction of the system time, so that expiry,
+// republishing and refreshing can be tested without waiting for them to occur.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time and creates tickers and timers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) *Ticker
+	NewTimer(d time.Duration) *Timer
+}
+
+// Ticker delivers the time on C every period, like a time.Ticker, until it's
+// stopped. A ticker with a nil stop function ticks whenever its channel is
+// sent to, which is useful in tests.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the ticker, no more ticks are sent after Stop returns. The
+// channel isn't closed.
+func (t *Ticker) Stop() {
+	if t.stop != nil {
+		t.stop()
+	}
+}
+
+// Timer delivers the time on C once, like a time.Timer, unless it's stopped.
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+// Stop prevents the timer from firing, it returns false if the timer already
+// fired or was stopped.
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+type realClock struct{}
+
+// New returns a clock backed by the system time.
+func New() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop}
+}
+
+// Fake is a clock that only moves when told to. It's safe for concurrent use.
+type Fake struct {
+	now     time.Time
+	tickers []*fakeTicker
+	timers  []*fakeTimer
+	sync.Mutex
+}
+
+type fakeTicker struct {
+	c    chan time.Time
+	d    time.Duration
+	next time.Time
+}
+
+type fakeTimer struct {
+	c  chan time.Time
+	at time.Time
+}
+
+// NewFake creates a fake clock set to the provided time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the current time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+	return f.now
+}
+
+// NewTicker creates a ticker that ticks when the fake clock is advanced past
+// its period. The ticker doesn't have to be read from, and it's forgotten by
+// the fake clock once it's stopped.
+func (f *Fake) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	t := &fakeTicker{
+		c:    make(chan time.Time, 1),
+		d:    d,
+		next: f.now.Add(d),
+	}
+	f.tickers = append(f.tickers, t)
+
+	return &Ticker{C: t.c, stop: func() { f.stopTicker(t) }}
+}
+
+// stopTicker forgets the ticker.
+func (f *Fake) stopTicker(t *fakeTicker) {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, other := range f.tickers {
+		if other == t {
+			copy(f.tickers[i:], f.tickers[i+1:])
+			f.tickers[len(f.tickers)-1] = nil
+			f.tickers = f.tickers[:len(f.tickers)-1]
+			return
+		}
+	}
+}
+
+// NewTimer creates a timer that fires once the fake clock has been advanced by
+// at least the duration. The timer is forgotten by the fake clock once it has
+// fired or been stopped.
+func (f *Fake) NewTimer(d time.Duration) *Timer {
+	f.Lock()
+	defer f.Unlock()
+
+	t := &fakeTimer{
+		c:  make(chan time.Time, 1),
+		at: f.now.Add(d),
+	}
+	timer := &Timer{C: t.c, stop: func() bool { return f.stopTimer(t) }}
+	if d <= 0 {
+		t.c <- f.now
+		return timer
+	}
+	f.timers = append(f.timers, t)
+
+	return timer
+}
+
+// stopTimer forgets the timer, it returns false if the timer already fired or
+// was stopped.
+func (f *Fake) stopTimer(t *fakeTimer) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	for i, other := range f.timers {
+		if other == t {
+			copy(f.timers[i:], f.timers[i+1:])
+			f.timers[len(f.timers)-1] = nil
+			f.timers = f.timers[:len(f.timers)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the fake clock forward, fires the timers that are due and
+// ticks every ticker whose period has passed. Several periods passed in a
+// single call result in one tick, so advance in steps shorter than the
+// intervals that must be observed.
+//
+// Advance never blocks. If the previous tick of a ticker hasn't been received
+// yet, it's replaced by the new one, so a receiver that is behind observes the
+// latest time but not every step. Wait for the effect of a tick before
+// advancing again if every step must be observed.
+func (f *Fake) Advance(d time.Duration) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.now = f.now.Add(d)
+	for _, t := range f.tickers {
+		if f.now.Before(t.next) {
+			continue
+		}
+		for !f.now.Before(t.next) {
+			t.next = t.next.Add(t.d)
+		}
+
+		select {
+		case <-t.c: // The receiver is behind, or gone.
+		default:
+		}
+		t.c <- f.now
+	}
+
+	pending := f.timers[:0]
+	for _, t := range f.timers {
+		if f.now.Before(t.at) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	for i := len(pending); i < len(f.timers); i++ {
+		f.timers[i] = nil // The fired timers aren't kept alive.
+	}
+	f.timers = pending
+}
@@ -0,0 +1,191 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	c := New()
+
+	before := time.Now()
+	now := c.Now()
+	if now.Before(before) {
+		t.Errorf("unexpected time, got: %v, exp after: %v", now, before)
+	}
+
+	ticker := c.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	select {
+	case <-ticker.C:
+	case <-time.After(time.Second):
+		t.Error("ticker didn't tick within 1 second")
+	}
+
+	timer := c.NewTimer(time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-time.After(time.Second):
+		t.Error("timer didn't fire within 1 second")
+	}
+}
+
+func TestFake_advance(t *testing.T) {
+	start := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	c := NewFake(start)
+
+	if !c.Now().Equal(start) {
+		t.Errorf("unexpected time, got: %v, exp: %v", c.Now(), start)
+	}
+
+	c.Advance(24 * time.Hour)
+
+	exp := start.Add(24 * time.Hour)
+	if !c.Now().Equal(exp) {
+		t.Errorf("unexpected time, got: %v, exp: %v", c.Now(), exp)
+	}
+}
+
+func TestFake_ticker(t *testing.T) {
+	start := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Minute)
+
+	c.Advance(30 * time.Second)
+	select {
+	case now := <-ticker.C:
+		t.Errorf("unexpected tick at: %v", now)
+	default:
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case now := <-ticker.C:
+		exp := start.Add(time.Minute)
+		if !now.Equal(exp) {
+			t.Errorf("unexpected tick, got: %v, exp: %v", now, exp)
+		}
+	default:
+		t.Error("expected tick")
+	}
+
+	// Several periods passed at once results in a single tick.
+	c.Advance(10 * time.Minute)
+	<-ticker.C
+	select {
+	case now := <-ticker.C:
+		t.Errorf("unexpected tick at: %v", now)
+	default:
+	}
+}
+
+func TestFake_abandonedTicker(t *testing.T) {
+	start := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Minute)
+
+	// Advancing doesn't wait for a ticker that isn't read from.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			c.Advance(time.Minute)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("advance blocked on unread ticker")
+	}
+
+	// The pending tick is replaced by the latest one.
+	now := <-ticker.C
+	exp := start.Add(3 * time.Minute)
+	if !now.Equal(exp) {
+		t.Errorf("unexpected tick, got: %v, exp: %v", now, exp)
+	}
+}
+
+func TestFake_stoppedTicker(t *testing.T) {
+	c := NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	ticker := c.NewTicker(time.Minute)
+	other := c.NewTicker(time.Minute)
+	ticker.Stop()
+
+	if len(c.tickers) != 1 {
+		t.Errorf("unexpected number of tickers, got: %d, exp: %d", len(c.tickers), 1)
+	}
+
+	c.Advance(time.Minute)
+	select {
+	case now := <-ticker.C:
+		t.Errorf("unexpected tick at: %v", now)
+	default:
+	}
+	select {
+	case <-other.C:
+	default:
+		t.Error("expected tick")
+	}
+}
+
+func TestFake_timer(t *testing.T) {
+	start := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	c := NewFake(start)
+	timer := c.NewTimer(time.Minute)
+
+	c.Advance(30 * time.Second)
+	select {
+	case now := <-timer.C:
+		t.Errorf("unexpected timer at: %v", now)
+	default:
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case now := <-timer.C:
+		exp := start.Add(time.Minute)
+		if !now.Equal(exp) {
+			t.Errorf("unexpected timer, got: %v, exp: %v", now, exp)
+		}
+	default:
+		t.Error("expected timer to fire")
+	}
+
+	// The timer fires once.
+	c.Advance(time.Minute)
+	select {
+	case now := <-timer.C:
+		t.Errorf("unexpected timer at: %v", now)
+	default:
+	}
+	if len(c.timers) != 0 {
+		t.Errorf("unexpected number of timers, got: %d, exp: %d", len(c.timers), 0)
+	}
+	if timer.Stop() {
+		t.Error("expected fired timer not to be stopped")
+	}
+}
+
+func TestFake_stoppedTimer(t *testing.T) {
+	c := NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	timer := c.NewTimer(time.Minute)
+
+	if !timer.Stop() {
+		t.Error("expected pending timer to be stopped")
+	}
+	if len(c.timers) != 0 {
+		t.Errorf("unexpected number of timers, got: %d, exp: %d", len(c.timers), 0)
+	}
+
+	c.Advance(time.Minute)
+	select {
+	case now := <-timer.C:
+		t.Errorf("unexpected timer at: %v", now)
+	default:
+	}
+}
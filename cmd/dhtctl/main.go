@@ -3,27 +3,34 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/rpc"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/optmzr/d7024e-dht/ctl"
+	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/store"
 )
 
-func put(c *rpc.Client, value string) {
+func put(c *rpc.Client, value string, ttl time.Duration) {
 	put := ctl.Put{
-		Value: value,
+		Value: []byte(value),
+		TTL:   ttl,
 	}
-	var key store.Key
+	var receipt dht.Receipt
 
 	// The RPC call
-	err := c.Call("API.Put", put, &key)
+	err := c.Call("API.Put", put, &receipt)
 	if err != nil {
 		log.Fatal("Put error:", err)
 	}
 
-	log.Printf("Hash: %v\n", key)
+	log.Printf("Hash: %v\n", receipt.Key)
+	fmt.Print(receipt.String())
 }
 
 func get(c *rpc.Client, key store.Key) {
@@ -41,6 +48,43 @@ func get(c *rpc.Client, key store.Key) {
 	log.Printf("Value: %s (from: %s)", value.Value, value.SenderID.String()[:6])
 }
 
+func putObject(c *rpc.Client, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalln("Upload error:", err)
+	}
+
+	put := ctl.PutObject{Data: data}
+	var receipt dht.Receipt
+
+	err = c.Call("API.PutObject", put, &receipt)
+	if err != nil {
+		log.Fatalln("Upload error:", err)
+	}
+
+	log.Printf("Hash: %v\n", receipt.Key)
+	fmt.Print(receipt.String())
+}
+
+func getObject(c *rpc.Client, key store.Key, path string) {
+	get := ctl.GetObject{Key: key}
+	var reply ctl.GetObjectReply
+
+	err := c.Call("API.GetObject", get, &reply)
+	if err != nil {
+		log.Fatalln("Download error:", err)
+	}
+
+	if path == "" {
+		_, err = os.Stdout.Write(reply.Data)
+	} else {
+		err = ioutil.WriteFile(path, reply.Data, 0644)
+	}
+	if err != nil {
+		log.Fatalln("Download error:", err)
+	}
+}
+
 func ping(c *rpc.Client, id node.ID) {
 	ping := ctl.Ping{NodeID: id}
 	var challenge []byte
@@ -54,20 +98,42 @@ func ping(c *rpc.Client, id node.ID) {
 	fmt.Printf("Ping response: %x\n", challenge)
 }
 
+func pingAddress(c *rpc.Client, address string) {
+	ping := ctl.PingAddress{Address: address}
+	var reply ctl.PingReply
+
+	err := c.Call("API.PingAddress", ping, &reply)
+	if err != nil {
+		log.Fatalln("Ping error:", err)
+	}
+
+	fmt.Printf("Ping response from %v: %x\n", reply.NodeID, reply.Challenge)
+}
+
 func forget(c *rpc.Client, key store.Key) {
 	forget := ctl.Forget{
 		Key: key,
 	}
-	var ok bool
+	var receipt dht.Receipt
 
-	err := c.Call("API.Forget", forget, &ok)
+	err := c.Call("API.Forget", forget, &receipt)
 	if err != nil {
 		log.Fatalln("Forget error:", err)
 	}
 
-	if ok {
-		fmt.Println("Value forgotten")
+	fmt.Print(receipt.String())
+}
+
+func stats(c *rpc.Client) {
+	var stats dht.Stats
+
+	// The RPC call
+	err := c.Call("API.Stats", ctl.Stats{}, &stats)
+	if err != nil {
+		log.Fatalln("Stats error:", err)
 	}
+
+	fmt.Printf("Misbehaving responses: %d\n", stats.Misbehaving)
 }
 
 func exit(c *rpc.Client) {
@@ -88,9 +154,14 @@ func main() {
 	// Flags
 	var addressFlag = flag.String("address", "localhost:1234", "the address of the node")
 	var putFlag = flag.String("put", "", "put value to store")
+	var ttlFlag = flag.Duration("ttl", 0, "time to live of the put value, e.g. 10m, forever if not supplied")
 	var getFlag = flag.String("get", "", "key of the value to get")
-	var pingFlag = flag.String("ping", "", "ID of the node to ping")
+	var pingFlag = flag.String("ping", "", "ID or address of the node to ping")
 	var forgetFlag = flag.String("forget", "", "key of the value to forget")
+	var uploadFlag = flag.String("upload", "", "file to store as an object")
+	var downloadFlag = flag.String("download", "", "key of the object to download")
+	var outFlag = flag.String("out", "", "file to write the downloaded object to, stdout if not supplied")
+	var statsFlag = flag.Bool("stats", false, "Show node statistics")
 	var exitFlag = flag.Bool("exit", false, "Terminate the node")
 
 	// Parse input
@@ -104,7 +175,7 @@ func main() {
 
 	// Execute tasks
 	if "" != *putFlag {
-		put(client, *putFlag)
+		put(client, *putFlag, *ttlFlag)
 	}
 
 	if "" != *getFlag {
@@ -115,12 +186,28 @@ func main() {
 		get(client, key)
 	}
 
-	if "" != *pingFlag {
-		id, err := node.IDFromString(*pingFlag)
+	if "" != *uploadFlag {
+		putObject(client, *uploadFlag)
+	}
+
+	if "" != *downloadFlag {
+		key, err := store.KeyFromString(*downloadFlag)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		ping(client, id)
+		getObject(client, key, *outFlag)
+	}
+
+	if "" != *pingFlag {
+		if strings.Contains(*pingFlag, ":") {
+			pingAddress(client, *pingFlag)
+		} else {
+			id, err := node.IDFromString(*pingFlag)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			ping(client, id)
+		}
 	}
 
 	if "" != *forgetFlag {
@@ -132,6 +219,10 @@ func main() {
 		forget(client, key)
 	}
 
+	if *statsFlag {
+		stats(client)
+	}
+
 	if *exitFlag {
 		exit(client)
 	}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/dht"
 	cdht "github.com/optmzr/d7024e-dht/dht"
@@ -16,6 +23,26 @@ import (
 
 const defaultHTTPAddress = ":8080"
 
+// objectPrefix is the path prefix of the objects, i.e. values that are split
+// into chunks.
+const objectPrefix = "/object"
+
+// recordPrefix is the path prefix of the mutable records, i.e. values signed by
+// their publisher.
+const recordPrefix = "/record"
+
+// providerPrefix is the path prefix of the provider records, i.e. the nodes
+// that hold the content of a key.
+const providerPrefix = "/provider"
+
+// Headers of the records, the keys and signature are hex encoded.
+const (
+	recordPublisherHeader = "Record-Publisher"
+	recordSaltHeader      = "Record-Salt"
+	recordSeqHeader       = "Record-Seq"
+	recordSignatureHeader = "Record-Signature"
+)
+
 type httpHandler struct {
 	http.Handler
 	dht *dht.DHT
@@ -38,7 +65,358 @@ func getKeyFromPath(path string) (store.Key, error) {
 	return key, err
 }
 
+// formOverhead is the room given to the encoding and other fields of a form,
+// in addition to the maximum value size.
+const formOverhead = 4096
+
+// readValue reads the value to store from the request. Forms are read from the
+// "value" field, while any other content type is stored as is from the body.
+// Values larger than max bytes are rejected with dht.ErrValueTooLarge.
+func readValue(r *http.Request, max int) (value []byte, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	form := mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data"
+
+	limit := max
+	if form {
+		limit += formOverhead
+	}
+
+	// Read one byte more than allowed to tell if the body is too large.
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit+1)))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, dht.ErrValueTooLarge
+	}
+
+	if !form {
+		return body, nil
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	err = r.ParseMultipartForm(int64(limit))
+	if err != nil && err != http.ErrNotMultipart {
+		return nil, err
+	}
+
+	values, ok := r.PostForm["value"]
+	if !ok {
+		return nil, errors.New("no value in form")
+	}
+
+	value = []byte(values[0])
+	if len(value) > max {
+		return nil, dht.ErrValueTooLarge
+	}
+	return value, nil
+}
+
+// valueErrorCode returns the status code for an error caused by the value.
+func valueErrorCode(err error) int {
+	if errors.Is(err, dht.ErrValueTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// readTTL returns the TTL of the "ttl" query parameter of the request, e.g.
+// "10m", or zero if it's not supplied.
+func readTTL(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("ttl")
+	if s == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative TTL: %v", ttl)
+	}
+	return ttl, nil
+}
+
+// readObject returns a reader of the object to store from the request. The
+// "file" field is read from multipart forms, while any other content type is
+// read as is from the body.
+func readObject(r *http.Request) (io.Reader, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return r.Body, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New("no file in form")
+		} else if err != nil {
+			return nil, err
+		}
+
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// readRecord reads the record of the value from the headers of the request. The
+// record must be signed by the publisher beforehand, as the node doesn't have
+// the private key of the publisher.
+func readRecord(r *http.Request, key store.Key, value []byte) (record store.Item, err error) {
+	publisher, err := hex.DecodeString(r.Header.Get(recordPublisherHeader))
+	if err != nil {
+		return record, fmt.Errorf("cannot decode publisher as hex: %w", err)
+	}
+	salt, err := hex.DecodeString(r.Header.Get(recordSaltHeader))
+	if err != nil {
+		return record, fmt.Errorf("cannot decode salt as hex: %w", err)
+	}
+	seq, err := strconv.ParseUint(r.Header.Get(recordSeqHeader), 10, 64)
+	if err != nil {
+		return record, fmt.Errorf("cannot parse sequence number: %w", err)
+	}
+	signature, err := hex.DecodeString(r.Header.Get(recordSignatureHeader))
+	if err != nil {
+		return record, fmt.Errorf("cannot decode signature as hex: %w", err)
+	}
+
+	record = store.Item{
+		Key:       key,
+		Value:     value,
+		Publisher: ed25519.PublicKey(publisher),
+		Record: &store.Record{
+			Salt:      salt,
+			Seq:       seq,
+			Signature: signature,
+		},
+	}
+	return record, record.Verify()
+}
+
+// writeRecordHeaders writes the record of the item as headers, and its
+// sequence number as the entity tag.
+func writeRecordHeaders(w http.ResponseWriter, record store.Item) {
+	w.Header().Set("ETag", etag(record.Record.Seq))
+	w.Header().Set(recordPublisherHeader, hex.EncodeToString(record.Publisher))
+	w.Header().Set(recordSaltHeader, hex.EncodeToString(record.Record.Salt))
+	w.Header().Set(recordSeqHeader, strconv.FormatUint(record.Record.Seq, 10))
+	w.Header().Set(recordSignatureHeader, hex.EncodeToString(record.Record.Signature))
+}
+
+// etag returns the entity tag of the sequence number of a record.
+func etag(seq uint64) string {
+	return strconv.Quote(strconv.FormatUint(seq, 10))
+}
+
+// parseETag returns the sequence number of an entity tag, as written by etag.
+func parseETag(tag string) (uint64, error) {
+	s, err := strconv.Unquote(strings.TrimSpace(tag))
+	if err != nil {
+		return 0, fmt.Errorf("invalid entity tag: %s", tag)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func (h *httpHandler) serveRecord(w http.ResponseWriter, r *http.Request) {
+	key, err := getKeyFromPath(strings.TrimPrefix(r.URL.Path, recordPrefix))
+	if err != nil {
+		writeError(w, err, "Cannot decode key as hex",
+			http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet: // Get newest record from DHT.
+		record, sender, err := h.dht.GetRecord(r.Context(), key)
+		if err != nil {
+			writeError(w, err, "Failed to get record by key in DHT",
+				http.StatusNotFound)
+			return
+		}
+
+		writeRecordHeaders(w, record)
+		w.Header().Set("Origin", sender.String())
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write(record.Value)
+		checkWriteError(err)
+
+	case http.MethodPut: // Save record in DHT, swapped if If-Match is set.
+		value, err := readValue(r, h.dht.MaxValueSize())
+		if err != nil {
+			writeError(w, err, "Failed to read value in request",
+				valueErrorCode(err))
+			return
+		}
+
+		record, err := readRecord(r, key, value)
+		if err != nil {
+			writeError(w, err, "Invalid record in request",
+				http.StatusBadRequest)
+			return
+		}
+
+		var receipt cdht.Receipt
+		if match := r.Header.Get("If-Match"); match != "" {
+			expected, e := parseETag(match)
+			if e != nil {
+				writeError(w, e, "Cannot parse If-Match header",
+					http.StatusBadRequest)
+				return
+			}
+			receipt, err = h.dht.CompareAndSwap(r.Context(), record, expected)
+		} else {
+			receipt, err = h.dht.PutRecord(r.Context(), record)
+		}
+
+		if errors.Is(err, store.ErrConflict) {
+			w.Header().Set("ETag", etag(receipt.Seq))
+			writeError(w, err, "Record was changed by another writer",
+				http.StatusPreconditionFailed)
+			return
+		} else if errors.Is(err, dht.ErrValueTooLarge) {
+			writeError(w, err, "Value too large",
+				http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			writeError(w, err, "Failed to put record in DHT",
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("ETag", etag(record.Record.Seq))
+		w.Header().Set("Location", fmt.Sprintf("%s/%v", recordPrefix, receipt.Key))
+		w.WriteHeader(http.StatusAccepted)
+		_, err = io.WriteString(w, receipt.String())
+		checkWriteError(err)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *httpHandler) serveProvider(w http.ResponseWriter, r *http.Request) {
+	key, err := getKeyFromPath(strings.TrimPrefix(r.URL.Path, providerPrefix))
+	if err != nil {
+		writeError(w, err, "Cannot decode key as hex",
+			http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet: // Find providers in DHT.
+		var n int
+		if s := r.URL.Query().Get("n"); s != "" {
+			n, err = strconv.Atoi(s)
+			if err != nil || n < 0 {
+				writeError(w, err, "Invalid number of providers",
+					http.StatusBadRequest)
+				return
+			}
+		}
+
+		providers, err := h.dht.FindProviders(r.Context(), key, n)
+		if err != nil {
+			writeError(w, err, "Failed to find providers by key in DHT",
+				http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		for _, provider := range providers {
+			_, err = fmt.Fprintf(w, "%v %s\n", provider.NodeID, provider.Address.String())
+			checkWriteError(err)
+		}
+
+	case http.MethodPost: // Announce this node as a provider in DHT.
+		receipt, err := h.dht.Provide(r.Context(), key)
+		if err != nil {
+			writeError(w, err, "Failed to provide key in DHT",
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		_, err = io.WriteString(w, receipt.String())
+		checkWriteError(err)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *httpHandler) serveObject(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, objectPrefix)
+
+	switch r.Method {
+	case http.MethodGet: // Get object from DHT.
+		key, err := getKeyFromPath(path)
+		if err != nil {
+			writeError(w, err, "Cannot decode key as hex",
+				http.StatusBadRequest)
+			return
+		}
+
+		// The chunks are fetched while the body is written, and the fetching is
+		// aborted if the client disconnects.
+		object, err := h.dht.GetObject(r.Context(), key)
+		if err != nil {
+			writeError(w, err, "Failed to get object by key in DHT",
+				http.StatusNotFound)
+			return
+		}
+		defer object.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		_, err = io.Copy(w, object)
+		checkWriteError(err)
+
+	case http.MethodPost: // Save object in DHT.
+		object, err := readObject(r)
+		if err != nil {
+			writeError(w, err, "Failed to read object in request",
+				http.StatusBadRequest)
+			return
+		}
+
+		receipt, err := h.dht.PutObject(r.Context(), object)
+		if err != nil {
+			writeError(w, err, "Failed to put object in DHT",
+				http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("%s/%v", objectPrefix, receipt.Key))
+		w.WriteHeader(http.StatusAccepted)
+		_, err = io.WriteString(w, receipt.String())
+		checkWriteError(err)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == objectPrefix || strings.HasPrefix(r.URL.Path, objectPrefix+"/") {
+		h.serveObject(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, recordPrefix+"/") {
+		h.serveRecord(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, providerPrefix+"/") {
+		h.serveProvider(w, r)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet: // Get value from DHT.
 		key, err := getKeyFromPath(r.URL.Path)
@@ -48,7 +426,8 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		value, sender, err := h.dht.Get(key)
+		// The lookup is aborted if the client disconnects.
+		value, sender, err := h.dht.Get(r.Context(), key)
 		if err != nil {
 			writeError(w, err, "Failed to get value by key in DHT",
 				http.StatusNotFound)
@@ -57,28 +436,38 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		w.Header().Set("Origin", sender.String())
 		w.WriteHeader(http.StatusOK)
-		_, err = io.WriteString(w, value)
+		_, err = w.Write(value)
 		checkWriteError(err)
 
 	case http.MethodPost: // Save value in DHT.
-		value := r.PostFormValue("value")
-		if value == "" {
-			writeError(w, errors.New("no value in form"),
-				"Failed to read value in request",
+		ttl, err := readTTL(r)
+		if err != nil {
+			writeError(w, err, "Invalid TTL",
 				http.StatusBadRequest)
 			return
 		}
 
-		key, err := h.dht.Put(value)
+		value, err := readValue(r, h.dht.MaxValueSize())
 		if err != nil {
+			writeError(w, err, "Failed to read value in request",
+				valueErrorCode(err))
+			return
+		}
+
+		receipt, err := h.dht.Put(r.Context(), value, ttl)
+		if errors.Is(err, dht.ErrValueTooLarge) {
+			writeError(w, err, "Value too large",
+				http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
 			writeError(w, err, "Failed to put value in DHT",
 				http.StatusInternalServerError)
 			return
 		}
 
-		w.Header().Set("Location", fmt.Sprintf("/%v", key))
+		w.Header().Set("Location", fmt.Sprintf("/%v", receipt.Key))
 		w.WriteHeader(http.StatusAccepted)
-		_, err = io.WriteString(w, value)
+		_, err = io.WriteString(w, receipt.String())
 		checkWriteError(err)
 
 	case http.MethodDelete: // Forget value in DHT.
@@ -89,8 +478,16 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		h.dht.Forget(key)
+		receipt, err := h.dht.Forget(r.Context(), key)
+		if err != nil {
+			writeError(w, err, "Failed to delete value in DHT",
+				http.StatusInternalServerError)
+			return
+		}
+
 		w.WriteHeader(http.StatusOK)
+		_, err = io.WriteString(w, receipt.String())
+		checkWriteError(err)
 
 	default:
 		w.WriteHeader(http.StatusNotFound)
@@ -1,22 +1,31 @@
 package main
 
 import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
+	"github.com/optmzr/d7024e-dht/store"
 )
 
 func TestHTTPHandler(t *testing.T) {
 	local, _ := net.ResolveUDPAddr("udp", "localhost:1239")
+	key, _ := node.NewKey()
 	me := route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  key.ID(),
 		Address: *local,
 	}
 
@@ -27,8 +36,8 @@ func TestHTTPHandler(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, key, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
@@ -61,6 +70,11 @@ func TestHTTPHandler(t *testing.T) {
 		t.Errorf("unexpected response: %v", err)
 	}
 
+	_, err = http.Post(ts.URL, "application/octet-stream", bytes.NewReader([]byte{0, 1, 2, 255}))
+	if err != nil {
+		t.Errorf("unexpected response: %v", err)
+	}
+
 	_, err = http.Get(ts.URL + "/invalid")
 	if err != nil {
 		t.Errorf("unexpected response: %v", err)
@@ -76,8 +90,9 @@ func TestHTTPHandler(t *testing.T) {
 
 func TestNewHTTPHandler(t *testing.T) {
 	local, _ := net.ResolveUDPAddr("udp", "localhost:1235")
+	key, _ := node.NewKey()
 	me := route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  key.ID(),
 		Address: *local,
 	}
 
@@ -88,8 +103,8 @@ func TestNewHTTPHandler(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, key, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
@@ -100,8 +115,204 @@ func TestNewHTTPHandler(t *testing.T) {
 
 	go httpServe(dht)
 
-	_, err := http.Get("http://localhost" + defaultHTTPAddress)
+	// Wait for the server to start listening.
+	var err error
+	for i := 0; i < 50; i++ {
+		_, err = http.Get("http://localhost" + defaultHTTPAddress)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
 	if err != nil {
 		t.Errorf("unexpected response: %v", err)
 	}
 }
+
+func TestReadValue(t *testing.T) {
+	binary := []byte{0, 1, 2, 255}
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	_ = mw.WriteField("value", "ABC, du är mina tankar")
+	_ = mw.Close()
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        []byte
+		exp         []byte
+		valid       bool
+	}{
+		{"raw", "application/octet-stream", binary, binary, true},
+		{"raw without content type", "", binary, binary, true},
+		{"empty raw", "image/png", []byte{}, []byte{}, true},
+		{"form", "application/x-www-form-urlencoded", []byte("value=ABC"), []byte("ABC"), true},
+		{"empty form value", "application/x-www-form-urlencoded", []byte("value="), []byte{}, true},
+		{"form without value", "application/x-www-form-urlencoded", []byte("other=ABC"), nil, false},
+		{"multipart", mw.FormDataContentType(), multipartBody.Bytes(), []byte("ABC, du är mina tankar"), true},
+		{"max raw", "application/octet-stream", bytes.Repeat([]byte{1}, 100), bytes.Repeat([]byte{1}, 100), true},
+		{"too large raw", "application/octet-stream", bytes.Repeat([]byte{1}, 101), nil, false},
+		{"too large form", "application/x-www-form-urlencoded", []byte("value=" + strings.Repeat("a", 101)), nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+
+			value, err := readValue(r, 100)
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if !bytes.Equal(value, tc.exp) {
+				t.Errorf("unexpected value, got: %x, exp: %x", value, tc.exp)
+			}
+		})
+	}
+}
+
+func TestValueErrorCode(t *testing.T) {
+	_, err := readValue(httptest.NewRequest(http.MethodPost, "/", strings.NewReader("ABC")), 2)
+	if code := valueErrorCode(err); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code, got: %d, exp: %d", code, http.StatusRequestEntityTooLarge)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("other=ABC"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err = readValue(r, 2)
+	if code := valueErrorCode(err); code != http.StatusBadRequest {
+		t.Errorf("unexpected status code, got: %d, exp: %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestReadObject(t *testing.T) {
+	object := []byte{0, 1, 2, 255}
+
+	r := httptest.NewRequest(http.MethodPost, objectPrefix, bytes.NewReader(object))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	or, err := readObject(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := ioutil.ReadAll(or); !bytes.Equal(got, object) {
+		t.Errorf("unexpected object, got: %x, exp: %x", got, object)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("name", "object.bin")
+	fw, _ := mw.CreateFormFile("file", "object.bin")
+	_, _ = fw.Write(object)
+	_ = mw.Close()
+
+	r = httptest.NewRequest(http.MethodPost, objectPrefix, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	or, err = readObject(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := ioutil.ReadAll(or); !bytes.Equal(got, object) {
+		t.Errorf("unexpected object, got: %x, exp: %x", got, object)
+	}
+
+	body.Reset()
+	mw = multipart.NewWriter(&body)
+	_ = mw.WriteField("name", "object.bin")
+	_ = mw.Close()
+
+	r = httptest.NewRequest(http.MethodPost, objectPrefix, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	_, err = readObject(r)
+	if err == nil {
+		t.Error("expected error for form without file")
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	exp := store.NewRecord(privateKey, []byte("config"), 7, []byte("ABC, du är mina tankar"))
+
+	rec := httptest.NewRecorder()
+	writeRecordHeaders(rec, exp)
+
+	r := httptest.NewRequest(http.MethodPut, recordPrefix+"/"+exp.Key.String(), nil)
+	r.Header = rec.Header()
+
+	record, err := readRecord(r, exp.Key, exp.Value)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if record.Record.Seq != 7 || !bytes.Equal(record.Record.Signature, exp.Record.Signature) {
+		t.Errorf("unexpected record, got: %+v, exp: %+v", record.Record, exp.Record)
+	}
+
+	seq, err := parseETag(rec.Header().Get("ETag"))
+	if err != nil || seq != 7 {
+		t.Errorf("unexpected entity tag sequence number, got: %d (%v), exp: %d", seq, err, 7)
+	}
+
+	_, err = readRecord(r, exp.Key, []byte("forged"))
+	if err == nil {
+		t.Error("expected error for forged record")
+	}
+
+	r.Header.Set(recordSeqHeader, "seven")
+	_, err = readRecord(r, exp.Key, exp.Value)
+	if err == nil {
+		t.Error("expected error for invalid sequence number")
+	}
+
+	for _, tag := range []string{"7", `W/"7"`, `"seven"`} {
+		if _, err := parseETag(tag); err == nil {
+			t.Errorf("expected error for entity tag: %s", tag)
+		}
+	}
+}
+
+func TestServeProvider_badRequest(t *testing.T) {
+	// The requests are rejected before the DHT is used.
+	handler := newHTTPHandler(nil)
+
+	key := store.KeyFromValue([]byte("ABC, du är mina tankar"))
+	for _, target := range []string{
+		providerPrefix + "/invalid",
+		providerPrefix + "/" + key.String() + "?n=-1",
+		providerPrefix + "/" + key.String() + "?n=many",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %s, got: %d, exp: %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestReadTTL(t *testing.T) {
+	for target, exp := range map[string]time.Duration{
+		"/":             0,
+		"/?ttl=10m":     10 * time.Minute,
+		"/?ttl=1h30m0s": 90 * time.Minute,
+	} {
+		ttl, err := readTTL(httptest.NewRequest(http.MethodPost, target, nil))
+		if err != nil || ttl != exp {
+			t.Errorf("unexpected TTL for %s, got: %v (%v), exp: %v", target, ttl, err, exp)
+		}
+	}
+
+	// The requests are rejected before the DHT is used.
+	handler := newHTTPHandler(nil)
+	for _, target := range []string{"/?ttl=-1m", "/?ttl=forever"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %s, got: %d, exp: %d", target, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,37 +1,64 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	stdlog "log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/diode"
 	"github.com/rs/zerolog/log"
 
+	"github.com/optmzr/d7024e-dht/bootstrap"
+	"github.com/optmzr/d7024e-dht/clock"
+	"github.com/optmzr/d7024e-dht/ctl"
 	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
+	"github.com/optmzr/d7024e-dht/store"
 )
 
 const defaultDHTAddress = ":8118"
 
-func flagSplit(flag string) (string, string) {
-	if flag == "" {
-		return "", ""
-	}
+// routesFile is the name of the routing table snapshot in the data directory.
+const routesFile = "routes.json"
+
+// leaveTimeout is the time given to hand off the stored values to other nodes
+// before shutting down.
+const leaveTimeout = 30 * time.Second
 
-	components := strings.Split(flag, "@")
-	nodeID := components[0]
-	address := components[1]
+// dnsSeedTimeout is the time given to look up the DNS seeds.
+const dnsSeedTimeout = 10 * time.Second
 
-	return nodeID, address
+// loadKey loads the keypair of the node, a new keypair is generated and saved
+// if the file doesn't exist.
+func loadKey(path string) (node.Key, error) {
+	key, err := node.LoadKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = node.NewKey()
+		if err != nil {
+			return key, err
+		}
+
+		err = key.Save(path)
+		if err != nil {
+			return key, err
+		}
+
+		log.Info().Msgf("Generated new key at: %s", path)
+	}
+	return key, err
 }
 
 func setupLogger(debug bool, logFilepath string) zerolog.Logger {
@@ -70,72 +97,146 @@ func setupLogger(debug bool, logFilepath string) zerolog.Logger {
 	return logger
 }
 
+// otherVar defines the -other flag on the flag set, the flag may be repeated to
+// bootstrap from several contacts.
+func otherVar(fs *flag.FlagSet) *bootstrap.List {
+	var others bootstrap.List
+	fs.Var(&others, "other", "Contact to bootstrap from, as id@address or address, may be repeated")
+	return &others
+}
+
 func main() {
-	meFlag := flag.String("me", "", "Defaults to an auto generated ID, IP defaults to localhost")
-	otherFlag := flag.String("other", "", "Waits for incoming connections if not supplied")
+	meFlag := flag.String("me", defaultDHTAddress, "Address to listen on")
+	otherFlag := otherVar(flag.CommandLine)
+	seedsFlag := flag.String("seeds", "", "File with contacts to bootstrap from, one per line")
+	dnsSeedFlag := flag.String("dns-seed", "", "Domain name with TXT records of contacts to bootstrap from")
+	keyFlag := flag.String("key", "dhtnode.key", "File with the key of the node, generated if it doesn't exist")
+	idFlag := flag.Bool("id", false, "Print the node ID of the key and exit")
+	encryptionFlag := flag.String("encryption", "disabled", "Encryption of packets between nodes: disabled, enabled or required")
+	pskFlag := flag.String("psk", "", "File with a pre-shared key, only nodes with the same key can join the network")
+	dataDirFlag := flag.String("data-dir", "", "Directory to persist the stored values in, kept in memory if not supplied")
+
+	defaults := dht.DefaultConfig()
+	alphaFlag := flag.Int("alpha", defaults.Alpha, "Degree of parallelism in lookups")
+	kFlag := flag.Int("k", defaults.K, "Bucket size, and the number of nodes a value is stored at")
+	expireFlag := flag.Duration("expire", defaults.TExpire, "Time after which a value expires")
+	replicateFlag := flag.Duration("replicate", defaults.TReplicate, "Interval between replication of stored values")
+	republishFlag := flag.Duration("republish", defaults.TRepublish, "Interval between republishing of values added by this node")
+	provideFlag := flag.Duration("provide", defaults.TProvide, "Time after which a provider record expires")
+	refreshFlag := flag.Duration("refresh", defaults.TRefresh, "Time after which an untouched bucket is refreshed")
+	refreshIntervalFlag := flag.Duration("refresh-interval", defaults.RefreshInterval, "Interval between checks for buckets to refresh")
+	maxValueSizeFlag := flag.Int("max-value-size", defaults.MaxValueSize, "Size in bytes of the largest value that is stored")
+	maxFailuresFlag := flag.Int("max-failures", defaults.MaxFailures, "Number of failed requests in a row after which a contact is evicted")
+	timeoutFlag := flag.Duration("timeout", defaults.Network.Timeout, "Timeout of requests to other nodes")
+	snapshotIntervalFlag := flag.Duration("snapshot-interval", defaults.SnapshotInterval, "Interval between saves of the routing table to the data directory")
+
 	debugFlag := flag.Bool("debug", false, "Print debug logs")
 	logFilepathFlag := flag.String("log", "/tmp/dhtnode.log", "File to output logs to")
 	flag.Parse()
 
+	if *idFlag {
+		key, err := node.LoadKey(*keyFlag)
+		if err != nil {
+			stdlog.Fatalln(err)
+		}
+		fmt.Println(key.ID())
+		return
+	}
+
 	logger := setupLogger(*debugFlag, *logFilepathFlag)
 
-	address, err := net.ResolveUDPAddr("udp", defaultDHTAddress)
+	if strings.Contains(*meFlag, "@") {
+		log.Fatal().Msgf("The node ID is derived from the key, use -me with an address only: %s", *meFlag)
+	}
+
+	address, err := net.ResolveUDPAddr("udp", *meFlag)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Unable to resolve UDP address: %s", defaultDHTAddress)
+		log.Fatal().Err(err).Msgf("Unable to resolve UDP address: %s", *meFlag)
 	}
 
-	var others []route.Contact
+	key, err := loadKey(*keyFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("Unable to load key from: %s", *keyFlag)
+	}
 
-	otherID, otherAddress := flagSplit(*otherFlag)
-	if (otherID == "") || (otherAddress == "") {
-		others = []route.Contact{
-			route.Contact{
-				NodeID:  node.NewID(),
-				Address: *address,
-			},
-		}
-	} else {
-		nodeID, err := node.IDFromString(otherID)
+	encryption, err := network.ParseEncryption(*encryptionFlag)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid encryption mode")
+	}
+
+	var psk []byte
+	if *pskFlag != "" {
+		psk, err = network.LoadPreSharedKey(*pskFlag)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Unable to parse node ID from: %s", otherID)
+			log.Fatal().Err(err).Msgf("Unable to load pre-shared key from: %s", *pskFlag)
 		}
+	}
+
+	clk := clock.New()
+
+	cfg := dht.Config{
+		Alpha:            *alphaFlag,
+		K:                *kFlag,
+		TExpire:          *expireFlag,
+		TReplicate:       *replicateFlag,
+		TRepublish:       *republishFlag,
+		TProvide:         *provideFlag,
+		TRefresh:         *refreshFlag,
+		RefreshInterval:  *refreshIntervalFlag,
+		MaxValueSize:     *maxValueSizeFlag,
+		MaxFailures:      *maxFailuresFlag,
+		SnapshotInterval: *snapshotIntervalFlag,
+		Network: network.Config{
+			Encryption:   encryption,
+			Timeout:      *timeoutFlag,
+			PreSharedKey: psk,
+			Clock:        clk,
+		},
+		Clock:     clk,
+		Publisher: key.Publisher(),
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
 
-		nodeAddress, err := net.ResolveUDPAddr("udp", otherAddress)
+	if *dataDirFlag != "" {
+		cfg.Backend, err = store.OpenDiskBackend(*dataDirFlag)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Unable to resolve UDP address: %s", otherAddress)
+			log.Fatal().Err(err).Msgf("Unable to open data directory: %s", *dataDirFlag)
 		}
 
-		others = []route.Contact{
-			route.Contact{
-				NodeID:  nodeID,
-				Address: *nodeAddress,
-			},
-		}
+		// The node warm-starts from the contacts of its previous run.
+		cfg.RoutesFile = filepath.Join(*dataDirFlag, routesFile)
 	}
 
-	var me route.Contact
+	others := []route.Contact(*otherFlag)
 
-	meID, meAddress := flagSplit(*meFlag)
-	if (meID == "") || (meAddress == "") {
-		me = route.Contact{
-			NodeID:  node.NewID(),
-			Address: *address,
-		}
-	} else {
-		nodeID, err := node.IDFromString(meID)
+	if *seedsFlag != "" {
+		seeds, err := bootstrap.LoadFile(*seedsFlag)
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Unable to parse node ID from: %s", meID)
+			log.Fatal().Err(err).Msgf("Unable to load seeds from: %s", *seedsFlag)
 		}
+		others = append(others, seeds...)
+	}
 
-		nodeAddress, err := net.ResolveUDPAddr("udp", meAddress)
+	if *dnsSeedFlag != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), dnsSeedTimeout)
+		seeds, err := bootstrap.LookupTXT(ctx, net.DefaultResolver, *dnsSeedFlag)
+		cancel()
 		if err != nil {
-			log.Fatal().Err(err).Msgf("Unable to resolve UDP address: %s", meAddress)
+			log.Error().Err(err).Msgf("Unable to look up seeds at: %s", *dnsSeedFlag)
 		}
+		others = append(others, seeds...)
+	}
 
-		me = route.Contact{
-			NodeID:  nodeID,
-			Address: *nodeAddress,
-		}
+	// Without any contacts the node waits for other nodes to join through it.
+	others = bootstrap.Unique(others)
+
+	me := route.Contact{
+		NodeID:  key.ID(),
+		Address: *address,
 	}
 
 	// Add the short node ID to the logger.
@@ -144,21 +245,49 @@ func main() {
 	// Print the whole ID:
 	log.Info().Msgf("My ID is: %v", me.NodeID)
 
-	nw, err := network.NewUDPNetwork(me)
+	nw, err := network.NewUDPNetwork(me, key, cfg.Network)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize network")
 	}
 
-	dht, err := dht.New(me, others, nw)
+	dht, err := dht.New(me, others, nw, cfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize DHT")
 	}
 
-	go rpcServe(dht)
+	api := ctl.NewAPI(dht)
+
+	go rpcServe(api)
 	go httpServe(dht)
 
-	err = nw.Listen()
-	if err != nil {
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- nw.Listen()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case sig := <-signals:
+		log.Info().Msgf("Received %v, shutting down", sig)
+	case <-api.ExitCh():
+		log.Info().Msg("Exit requested, shutting down")
+	case err := <-listenErr:
 		log.Fatal().Err(err).Msg("Failed to listen")
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaveTimeout)
+	err = dht.Leave(ctx)
+	cancel()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to leave the DHT network")
+	}
+
+	dht.Close()
+
+	err = nw.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to close network")
+	}
 }
@@ -1,23 +1,54 @@
 package main
 
-import "testing"
+import (
+	"flag"
+	"io/ioutil"
+	"testing"
+
+	"github.com/optmzr/d7024e-dht/bootstrap"
+)
+
+const testID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 
 func init() {
 	setupLogger(true, "/tmp/somewhere")
 	setupLogger(false, "/tmp/somewhere")
 }
 
-func TestFlagSplit(t *testing.T) {
-	a, b := flagSplit("hej@då")
-	if a != "hej" {
-		t.Errorf("unexpected part 1: %s", a)
+func TestOtherVar(t *testing.T) {
+	fs := flag.NewFlagSet("dhtnode", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	others := otherVar(fs)
+
+	err := fs.Parse([]string{
+		"-other", testID + "@127.0.0.1:8118",
+		"-other", "127.0.0.2:8118",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(*others) != 2 {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(*others), 2)
 	}
-	if b != "då" {
-		t.Errorf("unexpected part 2: %s", a)
+	if (*others)[0].NodeID.String() != testID || (*others)[0].Address.String() != "127.0.0.1:8118" {
+		t.Errorf("unexpected contact, got: %s", bootstrap.Format((*others)[0]))
 	}
+	if bootstrap.HasID((*others)[1]) || (*others)[1].Address.String() != "127.0.0.2:8118" {
+		t.Errorf("unexpected contact, got: %s", bootstrap.Format((*others)[1]))
+	}
+
+	exp := testID + "@127.0.0.1:8118,127.0.0.2:8118"
+	if others.String() != exp {
+		t.Errorf("unexpected flag value, got: %s, exp: %s", others.String(), exp)
+	}
+
+	fs = flag.NewFlagSet("dhtnode", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	otherVar(fs)
 
-	a, b = flagSplit("")
-	if a != "" || b != "" {
-		t.Error("expected empty strings, got:", a, b)
+	err = fs.Parse([]string{"-other", "127.0.0.1:port"})
+	if err == nil {
+		t.Error("expected error for invalid contact")
 	}
 }
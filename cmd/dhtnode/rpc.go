@@ -5,15 +5,12 @@ import (
 	"net/rpc"
 
 	"github.com/optmzr/d7024e-dht/ctl"
-	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/rs/zerolog/log"
 )
 
 const defaultRPCAddress = ":1234"
 
-func rpcServe(dht *dht.DHT) {
-	api := ctl.NewAPI(dht)
-
+func rpcServe(api *ctl.API) {
 	err := rpc.Register(api)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to register RPC API")
@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/optmzr/d7024e-dht/ctl"
 	"github.com/optmzr/d7024e-dht/dht"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
@@ -13,8 +14,9 @@ import (
 
 func TestRPCServe(t *testing.T) {
 	local, _ := net.ResolveUDPAddr("udp", "localhost:1337")
+	key, _ := node.NewKey()
 	me := route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  key.ID(),
 		Address: *local,
 	}
 
@@ -25,8 +27,8 @@ func TestRPCServe(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, key, network.Config{})
+	dht, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
@@ -35,6 +37,6 @@ func TestRPCServe(t *testing.T) {
 		}
 	}()
 
-	go rpcServe(dht)
+	go rpcServe(ctl.NewAPI(dht))
 	time.Sleep(1 * time.Second) // TODO: Remove this.
 }
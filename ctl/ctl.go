@@ -1,7 +1,10 @@
 package ctl
 
 import (
-	"os"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
 	"time"
 
 	"github.com/rs/zerolog/log"
@@ -12,71 +15,142 @@ import (
 )
 
 type API struct {
-	dht *dht.DHT
+	dht  *dht.DHT
+	exit chan struct{}
 }
 
 type Ping struct {
 	NodeID node.ID
 }
 
+// PingAddress pings the node at an address, whose node ID isn't known.
+type PingAddress struct {
+	Address string
+}
+
+// PingReply holds the node ID of the node that answered a ping, and the
+// challenge it answered.
+type PingReply struct {
+	NodeID    node.ID
+	Challenge []byte
+}
+
+// Put stores a value, that expires after the TTL unless it's zero.
 type Put struct {
-	Value string
+	Value []byte
+	TTL   time.Duration
 }
 
 type Get struct {
 	Key store.Key
 }
 
+// PutObject stores a file as an object, split into chunks.
+type PutObject struct {
+	Data []byte
+}
+
+// GetObject fetches the object with the key of its manifest.
+type GetObject struct {
+	Key store.Key
+}
+
 type Forget struct {
 	Key store.Key
 }
 
 type Exit struct{}
 
+type Stats struct{}
+
 type GetReply struct {
-	Value    string
+	Value    []byte
 	SenderID node.ID
 }
 
+type GetObjectReply struct {
+	Data []byte
+}
+
 func NewAPI(dht *dht.DHT) *API {
-	return &API{dht: dht}
+	return &API{dht: dht, exit: make(chan struct{}, 1)}
+}
+
+// ExitCh returns a channel that is published to when an exit is requested, the
+// owner of the node is responsible for shutting it down.
+func (a *API) ExitCh() chan struct{} {
+	return a.exit
 }
 
 func (a *API) Ping(ping Ping, reply *[]byte) (err error) {
 	log.Info().Msgf("Ping: %s", ping.NodeID)
-	*reply, err = a.dht.Ping(ping.NodeID)
+	*reply, err = a.dht.Ping(context.Background(), ping.NodeID)
 	return
 }
 
-func (a *API) Put(put Put, reply *store.Key) (err error) {
-	log.Info().Msgf("Put: %s", put.Value)
-	*reply, err = a.dht.Put(put.Value)
+func (a *API) PingAddress(ping PingAddress, reply *PingReply) error {
+	log.Info().Msgf("Ping: %s", ping.Address)
+	addr, err := net.ResolveUDPAddr("udp", ping.Address)
+	if err != nil {
+		return err
+	}
+
+	reply.NodeID, reply.Challenge, err = a.dht.PingAddress(context.Background(), *addr)
+	return err
+}
+
+func (a *API) Put(put Put, reply *dht.Receipt) (err error) {
+	log.Info().Msgf("Put: %d bytes", len(put.Value))
+	*reply, err = a.dht.Put(context.Background(), put.Value, put.TTL)
 	return
 }
 
 func (a *API) Get(get Get, reply *GetReply) (err error) {
 	log.Info().Msgf("Get: %s", get.Key)
-	reply.Value, reply.SenderID, err = a.dht.Get(get.Key)
+	reply.Value, reply.SenderID, err = a.dht.Get(context.Background(), get.Key)
+	return
+}
+
+func (a *API) PutObject(put PutObject, reply *dht.Receipt) (err error) {
+	log.Info().Msgf("Put object: %d bytes", len(put.Data))
+	*reply, err = a.dht.PutObject(context.Background(), bytes.NewReader(put.Data))
 	return
 }
 
-func (a *API) Forget(forget Forget, ok *bool) error {
+func (a *API) GetObject(get GetObject, reply *GetObjectReply) error {
+	log.Info().Msgf("Get object: %s", get.Key)
+	r, err := a.dht.GetObject(context.Background(), get.Key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	reply.Data, err = ioutil.ReadAll(r)
+	return err
+}
+
+func (a *API) Forget(forget Forget, reply *dht.Receipt) (err error) {
 	log.Info().Msgf("Forget: %s", forget.Key)
-	a.dht.Forget(forget.Key)
+	*reply, err = a.dht.Forget(context.Background(), forget.Key)
+	return
+}
 
-	*ok = true
+func (a *API) Stats(stats Stats, reply *dht.Stats) error {
+	log.Info().Msg("Stats")
+	*reply = a.dht.Stats()
 	return nil
 }
 
 func (a *API) Exit(exit Exit, ok *bool) error {
-	log.Info().Msg("Terminating node in 5 seconds...")
+	log.Info().Msg("Terminating node...")
 
 	*ok = true
 
-	go func() {
-		time.Sleep(5 * time.Second)
-		os.Exit(0)
-	}()
+	// Only one exit request is needed.
+	select {
+	case a.exit <- struct{}{}:
+	default:
+	}
 
 	return nil
 }
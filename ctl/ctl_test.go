@@ -1,6 +1,7 @@
 package ctl
 
 import (
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -9,13 +10,13 @@ import (
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
-	"github.com/optmzr/d7024e-dht/store"
 )
 
 func TestRPCServe(t *testing.T) {
 	local, _ := net.ResolveUDPAddr("udp", "localhost:1238")
+	key, _ := node.NewKey()
 	me := route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  key.ID(),
 		Address: *local,
 	}
 
@@ -26,8 +27,8 @@ func TestRPCServe(t *testing.T) {
 		},
 	}
 
-	nw, _ := network.NewUDPNetwork(me)
-	dht, _ := dht.New(me, others, nw)
+	nw, _ := network.NewUDPNetwork(me, key, network.Config{})
+	d, _ := dht.New(me, others, nw, dht.Config{})
 
 	go func() {
 		err := nw.Listen()
@@ -38,7 +39,7 @@ func TestRPCServe(t *testing.T) {
 
 	time.Sleep(1 * time.Second) // TODO: Remove this.
 
-	api := NewAPI(dht)
+	api := NewAPI(d)
 
 	var pingReply []byte
 	err := api.Ping(Ping{NodeID: others[0].NodeID}, &pingReply)
@@ -46,20 +47,42 @@ func TestRPCServe(t *testing.T) {
 		t.Error(err)
 	}
 
-	var putReply store.Key
-	err = api.Put(Put{Value: "something"}, &putReply)
+	var pingAddressReply PingReply
+	err = api.PingAddress(PingAddress{Address: "localhost:1238"}, &pingAddressReply)
+	if err != nil {
+		t.Error(err)
+	}
+	if !pingAddressReply.NodeID.Equal(me.NodeID) {
+		t.Errorf("unexpected node ID, got: %v, exp: %v", pingAddressReply.NodeID, me.NodeID)
+	}
+
+	var putReply dht.Receipt
+	err = api.Put(Put{Value: []byte("something")}, &putReply)
 	if err != nil {
 		t.Error(err)
 	}
 
+	tooLarge := make([]byte, dht.DefaultMaxValueSize+1)
+	var tooLargeReply dht.Receipt
+	err = api.Put(Put{Value: tooLarge}, &tooLargeReply)
+	if !errors.Is(err, dht.ErrValueTooLarge) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, dht.ErrValueTooLarge)
+	}
+
 	var getReply GetReply
-	err = api.Get(Get{Key: putReply}, &getReply)
+	err = api.Get(Get{Key: putReply.Key}, &getReply)
 	if err != nil {
 		t.Error(err)
 	}
 
-	var forgetReply bool
-	err = api.Forget(Forget{Key: putReply}, &forgetReply)
+	var forgetReply dht.Receipt
+	err = api.Forget(Forget{Key: putReply.Key}, &forgetReply)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var statsReply dht.Stats
+	err = api.Stats(Stats{}, &statsReply)
 	if err != nil {
 		t.Error(err)
 	}
@@ -69,4 +92,16 @@ func TestRPCServe(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+
+	select {
+	case <-api.ExitCh():
+	default:
+		t.Error("expected exit request")
+	}
+
+	d.Close()
+	err = nw.Close()
+	if err != nil {
+		t.Error(err)
+	}
 }
@@ -1,7 +1,12 @@
 package dht
 
 import (
+	"context"
+	"fmt"
 	"net"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
 
 	"github.com/optmzr/d7024e-dht/route"
 
@@ -10,9 +15,12 @@ import (
 	"github.com/optmzr/d7024e-dht/store"
 )
 
+// Call is a lookup performed by the walk. Result returns an error if the callee
+// responded with a result that cannot be trusted, the callee is then dropped
+// from the walk.
 type Call interface {
-	Do(nw network.Network, address net.UDPAddr) (ch chan network.FindResult, err error)
-	Result(result network.FindResult, callee route.Contact) (stop bool)
+	Do(ctx context.Context, nw network.Network, address net.UDPAddr) (ch chan network.FindResult, err error)
+	Result(result network.FindResult, callee route.Contact) (stop bool, err error)
 	Target() (target node.ID)
 }
 
@@ -26,12 +34,12 @@ type FindNodesCall struct {
 	target node.ID
 }
 
-func (q *FindNodesCall) Do(nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
-	return nw.FindNodes(q.target, address)
+func (q *FindNodesCall) Do(ctx context.Context, nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
+	return nw.FindNodes(ctx, q.target, address)
 }
 
-func (q *FindNodesCall) Result(_ network.FindResult, _ route.Contact) (_ bool) { return }
-func (q *FindNodesCall) Target() node.ID                                       { return q.target }
+func (q *FindNodesCall) Result(_ network.FindResult, _ route.Contact) (_ bool, _ error) { return }
+func (q *FindNodesCall) Target() node.ID                                                { return q.target }
 
 func NewFindValueCall(hash store.Key) *FindValueCall {
 	return &FindValueCall{
@@ -39,29 +47,149 @@ func NewFindValueCall(hash store.Key) *FindValueCall {
 	}
 }
 
+// NewFindRecordCall creates a call that looks up the record with the key. The
+// walk is not stopped by the first record, the newest valid record found by any
+// of the called nodes is kept.
+func NewFindRecordCall(key store.Key) *FindValueCall {
+	return &FindValueCall{
+		hash:    key,
+		mutable: true,
+	}
+}
+
 type FindValueCall struct {
-	hash   store.Key
-	value  string
-	sender node.ID
+	hash      store.Key
+	mutable   bool // Looks up a record, see NewFindRecordCall.
+	value     []byte
+	found     bool
+	publisher ed25519.PublicKey
+	published time.Time
+	signature []byte
+	record    *store.Record
+	ttl       time.Duration
+	sender    node.ID
 }
 
-func (q *FindValueCall) Do(nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
-	return nw.FindValue(q.hash, address)
+func (q *FindValueCall) Do(ctx context.Context, nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
+	return nw.FindValue(ctx, q.hash, address)
 }
 
-func (q *FindValueCall) Result(result network.FindResult, callee route.Contact) (stop bool) {
-	// TODO: Value validation could be added here, where the value received is
-	// checked towards the expected hash.
+func (q *FindValueCall) Result(result network.FindResult, callee route.Contact) (stop bool, err error) {
+	value, found := result.Value()
+	if !found {
+		return // No value, continue the walk.
+	}
 
-	q.value = result.Value()
-	q.sender = callee.NodeID
-	if q.value != "" {
-		stop = true
-	} else {
-		stop = false
+	item := store.Item{
+		Key:       q.hash,
+		Value:     value,
+		Publisher: result.Publisher(),
+		Published: result.Published(),
+		Signature: result.Signature(),
+		Record:    result.Record(),
+		TTL:       result.TTL(),
+	}
+
+	if q.mutable != (item.Record != nil) {
+		return false, fmt.Errorf("unexpected kind of value for key: %v", q.hash)
 	}
 
-	return
+	// The value must hash to the requested key (or be signed by the publisher
+	// of the record), otherwise it has been tampered with.
+	err = item.Verify()
+	if err != nil {
+		return false, err
+	}
+
+	if q.mutable {
+		// Keep the newest record, and continue the walk as other nodes may
+		// have a newer one.
+		if !q.found || item.Record.Seq > q.record.Seq {
+			q.set(item, callee)
+		}
+		return false, nil
+	}
+
+	q.set(item, callee)
+	return true, nil
+}
+
+func (q *FindValueCall) set(item store.Item, callee route.Contact) {
+	q.value = item.Value
+	q.found = true
+	q.publisher = item.Publisher
+	q.published = item.Published
+	q.signature = item.Signature
+	q.record = item.Record
+	q.ttl = item.TTL
+	q.sender = callee.NodeID
+}
+
+// Item returns the item that was found, if any.
+func (q *FindValueCall) Item() (item store.Item, found bool) {
+	return store.Item{
+		Key:       q.hash,
+		Value:     q.value,
+		Publisher: q.publisher,
+		Published: q.published,
+		Signature: q.signature,
+		Record:    q.record,
+		TTL:       q.ttl,
+	}, q.found
 }
 
 func (q *FindValueCall) Target() node.ID { return node.ID(q.hash) }
+
+// NewFindProvidersCall creates a call that gathers the providers of the key
+// from the called nodes. The walk is stopped when n providers are found, or
+// continues until the closest nodes have been called if n is 0.
+func NewFindProvidersCall(key store.Key, n int) *FindProvidersCall {
+	return &FindProvidersCall{
+		key:  key,
+		n:    n,
+		seen: make(map[node.ID]bool),
+	}
+}
+
+type FindProvidersCall struct {
+	key       store.Key
+	n         int
+	providers []route.Contact
+	seen      map[node.ID]bool
+}
+
+func (q *FindProvidersCall) Do(ctx context.Context, nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
+	return nw.GetProviders(ctx, q.key, address)
+}
+
+func (q *FindProvidersCall) Result(result network.FindResult, _ route.Contact) (stop bool, err error) {
+	q.add(result.Providers()...)
+	return q.full(), nil
+}
+
+// add adds the providers that haven't been seen before.
+func (q *FindProvidersCall) add(providers ...route.Contact) {
+	for _, provider := range providers {
+		if q.full() {
+			return
+		}
+		if q.seen[provider.NodeID] {
+			continue
+		}
+
+		q.seen[provider.NodeID] = true
+		q.providers = append(q.providers, provider)
+	}
+}
+
+// full returns true if n providers have been found.
+func (q *FindProvidersCall) full() bool {
+	return q.n > 0 && len(q.providers) >= q.n
+}
+
+// Providers returns the providers that were found.
+func (q *FindProvidersCall) Providers() []route.Contact {
+	return q.providers
+}
+
+func (q *FindProvidersCall) Target() node.ID { return node.ID(q.key) }
@@ -0,0 +1,187 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/optmzr/d7024e-dht/clock"
+	"github.com/optmzr/d7024e-dht/network"
+	"github.com/optmzr/d7024e-dht/route"
+	"github.com/optmzr/d7024e-dht/store"
+)
+
+// DefaultMaxValueSize is the default size in bytes of the largest value that
+// is stored.
+const DefaultMaxValueSize = 1000
+
+// ErrValueTooLarge is returned when a value is larger than the maximum value
+// size of the node.
+var ErrValueTooLarge = errors.New("value too large")
+
+// Config holds the parameters of a node. Zero fields are replaced by the
+// defaults from the Kademlia paper, see DefaultConfig.
+type Config struct {
+	Alpha           int           // Degree of parallelism.
+	K               int           // Bucket size, and the number of nodes a value is stored at.
+	TExpire         time.Duration // Time after which a key/value pair expires (TTL).
+	TReplicate      time.Duration // Interval between replication events.
+	TRepublish      time.Duration // Time after which the original publisher must republish a key/value pair.
+	TProvide        time.Duration // Time after which a provider record expires.
+	TRefresh        time.Duration // Time after which the routing table requests a refresh of an untouched bucket.
+	RefreshInterval time.Duration // Interval between checks for buckets to refresh.
+	MaxValueSize    int           // Size in bytes of the largest value that is stored.
+	MaxFailures     int           // Number of failed requests in a row after which a contact is evicted.
+
+	// RoutesFile is the file that the routing table is saved to, on Close and
+	// every SnapshotInterval, and warm-started from by New. Nothing is saved
+	// if it's empty.
+	RoutesFile       string
+	SnapshotInterval time.Duration
+
+	// Network configures the transport of the node. The network is created by
+	// its owner from the configuration, New takes the configuration of the
+	// network if it's zero, and returns an error if it doesn't match.
+	Network network.Config
+
+	// Clock drives all timers of the node. It must be the clock of the network,
+	// which is used if it's nil.
+	Clock clock.Clock
+
+	// Backend stores the items of the node, they're kept in a new memory
+	// backend if it's nil. The backend is closed along with the node, but it's
+	// left to the caller if New fails.
+	Backend store.Backend
+
+	// Publisher signs the deletes of the values published by the node, see
+	// node.Key.Publisher. A random key is used if it's nil, and the node can
+	// then not delete the values it published before it was restarted.
+	Publisher ed25519.PrivateKey
+}
+
+// DefaultConfig returns the configuration with the parameters from the
+// Kademlia paper.
+func DefaultConfig() Config {
+	return Config{
+		Alpha:            3,
+		K:                route.BucketSize,
+		TExpire:          86410 * time.Second,
+		TReplicate:       3600 * time.Second,
+		TRepublish:       86400 * time.Second,
+		TProvide:         86410 * time.Second,
+		TRefresh:         3600 * time.Second,
+		RefreshInterval:  60 * time.Second,
+		MaxValueSize:     DefaultMaxValueSize,
+		MaxFailures:      route.MaxFailures,
+		SnapshotInterval: 600 * time.Second,
+		Network:          network.Config{Timeout: network.DefaultTimeout},
+		Clock:            clock.New(),
+	}
+}
+
+// withDefaults returns a copy of the configuration with the zero fields
+// replaced by the defaults.
+func (c Config) withDefaults() Config {
+	d := DefaultConfig()
+
+	if c.Alpha == 0 {
+		c.Alpha = d.Alpha
+	}
+	if c.K == 0 {
+		c.K = d.K
+	}
+	if c.TExpire == 0 {
+		c.TExpire = d.TExpire
+	}
+	if c.TReplicate == 0 {
+		c.TReplicate = d.TReplicate
+	}
+	if c.TRepublish == 0 {
+		c.TRepublish = d.TRepublish
+	}
+	if c.TProvide == 0 {
+		c.TProvide = d.TProvide
+	}
+	if c.TRefresh == 0 {
+		c.TRefresh = d.TRefresh
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = d.RefreshInterval
+	}
+	if c.MaxValueSize == 0 {
+		c.MaxValueSize = d.MaxValueSize
+	}
+	if c.MaxFailures == 0 {
+		c.MaxFailures = d.MaxFailures
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = d.SnapshotInterval
+	}
+	if c.Network.Timeout == 0 {
+		c.Network.Timeout = d.Network.Timeout
+	}
+	if c.Clock == nil {
+		c.Clock = c.Network.Clock
+	}
+	if c.Clock == nil {
+		c.Clock = d.Clock
+	}
+	if c.Network.Clock == nil {
+		c.Network.Clock = c.Clock
+	}
+	return c
+}
+
+// Validate checks that the parameters are usable, zero fields are allowed as
+// they're replaced by the defaults.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+
+	if c.Alpha < 1 {
+		return errors.New("alpha must be at least 1")
+	}
+	if c.K < 1 {
+		return errors.New("k must be at least 1")
+	}
+	if c.Alpha > c.K {
+		return errors.New("alpha must not be larger than k")
+	}
+
+	if c.TExpire < 0 || c.TReplicate < 0 || c.TRepublish < 0 || c.TProvide < 0 || c.TRefresh < 0 || c.RefreshInterval < 0 || c.SnapshotInterval < 0 {
+		return errors.New("intervals must not be negative")
+	}
+
+	if c.Publisher != nil && len(c.Publisher) != ed25519.PrivateKeySize {
+		return errors.New("invalid publisher key")
+	}
+
+	if c.MaxFailures < 1 {
+		return errors.New("max failures must be at least 1")
+	}
+
+	if c.MaxValueSize < 0 || c.MaxValueSize > network.MaxValueSize {
+		return fmt.Errorf("max value size must not be negative or larger than %d bytes", network.MaxValueSize)
+	}
+
+	// The values must be republished and replicated before they expire.
+	if c.TRepublish >= c.TExpire {
+		return errors.New("republish interval must be shorter than the expiration time")
+	}
+	if c.TReplicate >= c.TExpire {
+		return errors.New("replicate interval must be shorter than the expiration time")
+	}
+	// The provided keys are announced again every republish interval.
+	if c.TRepublish >= c.TProvide {
+		return errors.New("republish interval must be shorter than the provider expiration time")
+	}
+
+	// The requests of the node must time out on the same clock as the rest of
+	// the node.
+	if c.Clock != c.Network.Clock {
+		return errors.New("clock must be the clock of the network")
+	}
+
+	return c.Network.Validate()
+}
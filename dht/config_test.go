@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/clock"
+	"github.com/optmzr/d7024e-dht/network"
+)
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{"zero", Config{}, true},
+		{"default", DefaultConfig(), true},
+		{"small", Config{Alpha: 1, K: 2, TExpire: time.Minute, TReplicate: time.Second, TRepublish: time.Second}, true},
+		{"negative alpha", Config{Alpha: -1}, false},
+		{"negative k", Config{K: -1}, false},
+		{"negative max failures", Config{MaxFailures: -1}, false},
+		{"alpha larger than k", Config{Alpha: 4, K: 3}, false},
+		{"negative interval", Config{TRefresh: -time.Second}, false},
+		{"republish after expire", Config{TExpire: time.Hour, TRepublish: 2 * time.Hour, TReplicate: time.Minute}, false},
+		{"replicate after expire", Config{TExpire: time.Hour, TRepublish: time.Minute, TReplicate: time.Hour}, false},
+		{"republish after provider expire", Config{TProvide: time.Hour, TRepublish: time.Hour}, false},
+		{"negative max value size", Config{MaxValueSize: -1}, false},
+		{"max value size larger than a packet", Config{MaxValueSize: network.MaxValueSize + 1}, false},
+		{"invalid network", Config{Network: network.Config{Timeout: -time.Second}}, false},
+		{"clock of another network", Config{Clock: clock.NewFake(time.Time{}), Network: network.Config{Clock: clock.New()}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.Validate()
+			if tc.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestConfigWithDefaults(t *testing.T) {
+	cfg := Config{K: 8, TExpire: time.Hour}.withDefaults()
+	d := DefaultConfig()
+
+	if cfg.K != 8 {
+		t.Errorf("unexpected k, got: %d, exp: %d", cfg.K, 8)
+	}
+	if cfg.TExpire != time.Hour {
+		t.Errorf("unexpected expire time, got: %v, exp: %v", cfg.TExpire, time.Hour)
+	}
+	if cfg.Alpha != d.Alpha {
+		t.Errorf("unexpected alpha, got: %d, exp: %d", cfg.Alpha, d.Alpha)
+	}
+	if cfg.Network.Timeout != network.DefaultTimeout {
+		t.Errorf("unexpected timeout, got: %v, exp: %v", cfg.Network.Timeout, network.DefaultTimeout)
+	}
+	if cfg.Clock == nil {
+		t.Error("expected default clock")
+	}
+	if cfg.Backend != nil || d.Backend != nil {
+		t.Error("unexpected default backend, it's created by New")
+	}
+}
+
+func TestNew_invalidConfig(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{Alpha: 4, K: 3})
+	if err == nil {
+		t.Error("expected error for invalid configuration")
+	}
+	if d != nil {
+		t.Error("unexpected node for invalid configuration")
+	}
+}
+
+func TestNew_clock(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+
+	d, err := New(me, others[:1], &udpNetwork{clock: c}, Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.clock != c {
+		t.Error("expected clock of the network")
+	}
+	d.Close()
+
+	d, err = New(me, others[:1], new(udpNetwork), Config{Clock: c})
+	if err == nil {
+		t.Error("expected error for clock that isn't the clock of the network")
+	}
+	if d != nil {
+		t.Error("unexpected node for clock that isn't the clock of the network")
+	}
+}
+
+func TestNew_networkConfig(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !d.cfg.Network.Equal(new(udpNetwork).Config()) {
+		t.Errorf("expected configuration of the network, got: %+v", d.cfg.Network)
+	}
+	d.Close()
+
+	_, err = New(me, others[:1], new(udpNetwork), Config{Network: network.Config{Timeout: time.Minute}})
+	if err == nil {
+		t.Error("expected error for configuration that doesn't match the network")
+	}
+}
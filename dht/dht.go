@@ -2,109 +2,538 @@ package dht
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
 	"github.com/optmzr/d7024e-dht/store"
 )
 
-const α = 3                // Degree of parallelism.
-const k = route.BucketSize // Bucket size.
+const tLeave = 5 * time.Second // Time during which a node that left is not added back to the routing table.
 
-const tExpire = 86410 * time.Second    // Time after which a key/value pair expires (TTL).
-const tReplicate = 3600 * time.Second  // Interval between replication events.
-const tRepublish = 86400 * time.Second // Time after which the original publisher must republish a key/value pair.
-const tRefresh = 3600 * time.Second    // Time after which the routing table requests a refresh of an untouched bucket.
+// Wait between rounds of join attempts through the bootstrap contacts, the wait
+// doubles after every failed round.
+const (
+	minJoinBackoff = 1 * time.Second
+	maxJoinBackoff = 1 * time.Minute
+)
+
+// errJoinSelf is returned when a bootstrap contact turns out to be the local
+// node.
+var errJoinSelf = errors.New("bootstrap contact is the local node")
 
 type DHT struct {
-	rt *route.Table
-	nw network.Network
-	me route.Contact
-	db *store.Database
+	rt        *route.Table
+	nw        network.Network
+	me        route.Contact
+	db        *store.Database
+	publisher ed25519.PrivateKey // Signs the deletes of values published by this node.
+	stats     Stats
+	ctx       context.Context // Cancelled when the node is closed.
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup // Tracks the goroutines that Close waits for.
+	closing   sync.RWMutex   // Held by Close while the context is cancelled, see goTracked.
+	joined    chan struct{}  // Closed once the node has looked itself up, or given up joining.
+	joinOnce  sync.Once
+	cfg       Config
+	clock     clock.Clock
+	left      left
+	probing   probing
 }
 
-func New(me route.Contact, others []route.Contact, nw network.Network) (dht *DHT, err error) {
-	refreshTicker := time.NewTicker(60 * time.Second)
+// probing holds the heads of full buckets that are being pinged, so that a
+// burst of new contacts for the same bucket only pings its head once.
+type probing struct {
+	sync.Mutex
+	m map[node.ID]bool
+}
 
-	dht = new(DHT)
-	dht.rt, err = route.NewTable(me, others, tRefresh, refreshTicker)
+// left holds the nodes that recently left the network and when they did, so
+// that their requests that were in flight don't add them back to the routing
+// table.
+type left struct {
+	sync.Mutex
+	m map[node.ID]time.Time
+}
+
+// Stats holds counters of events observed by the node. The counters must be
+// accessed atomically.
+type Stats struct {
+	Misbehaving uint64 // Number of responses that failed verification.
+}
+
+// New creates a new DHT node and starts the join procedure as soon as the
+// network is ready. The node joins through the bootstrap contacts in others,
+// the node ID of a contact may be zero if only its address is known. Zero
+// fields of the configuration are replaced by the defaults, and an error is
+// returned if the configuration is invalid. Nothing is started if New fails.
+func New(me route.Contact, others []route.Contact, nw network.Network, cfg Config) (dht *DHT, err error) {
+	if cfg.Network.Equal(network.Config{}) {
+		cfg.Network = nw.Config()
+	}
+
+	err = cfg.Validate()
 	if err != nil {
-		err = fmt.Errorf("cannot initialize routing table: %w", err)
-		return
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	cfg = cfg.withDefaults()
+
+	if !cfg.Network.Equal(nw.Config()) {
+		return nil, errors.New("invalid configuration: network configuration doesn't match the network")
+	}
+	clk := cfg.Clock
+
+	publisher := cfg.Publisher
+	if publisher == nil {
+		_, publisher, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate publisher key: %w", err)
+		}
+	}
+
+	// The contacts of the previous run are added to the routing table, and
+	// pinged once the network is ready.
+	var saved route.Contacts
+	if cfg.RoutesFile != "" {
+		saved, err = route.LoadSnapshot(cfg.RoutesFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Error().Err(err).Msgf("Failed to load routing table from: %s", cfg.RoutesFile)
+		}
+		err = nil
 	}
 
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
+	// The contacts with unknown node IDs are added once they've been pinged.
+	contacts := append([]route.Contact{}, saved...)
+	for _, other := range others {
+		if other.NodeID != (node.ID{}) {
+			contacts = append(contacts, other)
+		}
+	}
+
+	refreshTicker := clk.NewTicker(cfg.RefreshInterval)
+	rt, err := route.NewTable(me, contacts, cfg.K, cfg.MaxFailures, cfg.TRefresh, refreshTicker, clk)
+	if err != nil {
+		refreshTicker.Stop()
+		return nil, fmt.Errorf("cannot initialize routing table: %w", err)
+	}
+
+	dht = new(DHT)
+	dht.cfg = cfg
+	dht.rt = rt
+	dht.publisher = publisher
+
+	iHTicker := clk.NewTicker(time.Second)
+	rHTicker := clk.NewTicker(time.Second)
+
+	// Each node keeps its items apart, unless it's given a backend.
+	backend := cfg.Backend
+	if backend == nil {
+		backend = store.NewMemoryBackend()
+	}
 
-	dht.db = store.NewDatabase(tExpire, tReplicate, tRepublish, iHTicker, rHTicker)
+	dht.db = store.NewDatabase(cfg.TExpire, cfg.TReplicate, cfg.TRepublish, cfg.TProvide, iHTicker, rHTicker, clk, backend)
 
 	dht.nw = nw
 	dht.me = me
+	dht.clock = clk
+	dht.left = left{m: make(map[node.ID]time.Time)}
+	dht.probing = probing{m: make(map[node.ID]bool)}
+	dht.ctx, dht.cancel = context.WithCancel(context.Background())
+	dht.joined = make(chan struct{})
+
+	handlers := []func(){
+		dht.findNodesRequestHandler,
+		dht.findValueRequestHandler,
+		dht.storeRequestHandler,
+		dht.deleteRequestHandler,
+		dht.leaveRequestHandler,
+		dht.pongRequestHandler,
+		dht.republishRequestHandler,
+		dht.replicateRequestHandler,
+		dht.refreshRequestHandler,
+		dht.addProviderRequestHandler,
+		dht.getProvidersRequestHandler,
+		dht.reprovideRequestHandler,
+	}
+
+	if cfg.RoutesFile != "" {
+		snapshotTicker := clk.NewTicker(cfg.SnapshotInterval)
+		handlers = append(handlers, func() { dht.snapshotHandler(snapshotTicker) })
+	}
+
+	dht.wg.Add(len(handlers) + 1)
 
 	go func(dht *DHT, me route.Contact) {
-		<-dht.nw.ReadyCh() // Wait for network.
+		defer dht.wg.Done()
+		defer dht.markJoined()
 
-		retryInterval := 1 * time.Second
-		for {
-			err := dht.Join(me)
-			if err != nil {
-				log.Error().Err(err).Msgf("Failed to join the DHT network, retrying in %v", retryInterval)
-			} else {
-				break // Join successful, exit retry loop.
+		// Wait for network.
+		select {
+		case <-dht.nw.ReadyCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		dht.bootstrap(me, others, saved)
+	}(dht, me)
+
+	for _, handler := range handlers {
+		go func(handler func()) {
+			defer dht.wg.Done()
+			handler()
+		}(handler)
+	}
+
+	return
+}
+
+// Close stops the node. Ongoing lookups started by the node itself are aborted,
+// and Close waits for the request handlers to return before the database and
+// the routing table are closed. The network is not closed, as it's owned by
+// the caller.
+func (dht *DHT) Close() {
+	dht.closing.Lock()
+	dht.cancel()
+	dht.closing.Unlock()
+	dht.wg.Wait()
+
+	dht.saveRoutes()
+
+	dht.db.Close()
+	dht.rt.Close()
+}
+
+// saveRoutes saves the routing table to the routes file, if any.
+func (dht *DHT) saveRoutes() {
+	if dht.cfg.RoutesFile == "" {
+		return
+	}
+
+	err := dht.rt.Save(dht.cfg.RoutesFile)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to save routing table to: %s", dht.cfg.RoutesFile)
+	}
+}
+
+// Stats returns a snapshot of the node statistics.
+func (dht *DHT) Stats() Stats {
+	return Stats{
+		Misbehaving: atomic.LoadUint64(&dht.stats.Misbehaving),
+	}
+}
+
+// Forget removes the key and associated value from the local items DB, to stop
+// republishing it, and deletes it from the network by sending a tombstone
+// signed by this node to the k closest nodes. A receipt with the nodes that
+// acknowledged the delete is returned. The delete is aborted when the context
+// is done.
+func (dht *DHT) Forget(ctx context.Context, hash store.Key) (receipt Receipt, err error) {
+	err = dht.db.ForgetItem(hash)
+	if err != nil {
+		err = fmt.Errorf("cannot forget local item: %w", err)
+		return
+	}
+
+	receipt, err = dht.iterativeDelete(ctx, store.NewTombstone(hash, dht.publisher, dht.clock.Now()))
+	if err != nil {
+		return
+	}
+
+	if len(receipt.Stored) == 0 {
+		err = fmt.Errorf("no node acknowledged the delete of value with hash: %v", hash)
+	}
+	return
+}
+
+// Leave hands off the items that other nodes have stored on this node to the k
+// closest other nodes of each key, and then tells all contacts that this node
+// is leaving so that they evict it from their routing tables right away. Leave
+// should be called right before Close, an error is returned if any item wasn't
+// acknowledged by another node.
+func (dht *DHT) Leave(ctx context.Context) error {
+	var failed int
+
+	for _, item := range dht.db.RemoteItems() {
+		contacts, err := dht.iterativeFindNodes(ctx, node.ID(item.Key))
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to find nodes to hand off value with hash: %v", item.Key)
+			failed++
+			continue
+		}
+
+		// The local node is leaving, and can't keep the item.
+		var others []route.Contact
+		for _, contact := range contacts {
+			if !contact.NodeID.Equal(dht.me.NodeID) {
+				others = append(others, contact)
 			}
+		}
 
-			time.Sleep(retryInterval)
+		item := item
+		receipt := dht.sendTo(item.Key, others, func(contact route.Contact) (chan *network.StoreResult, error) {
+			return dht.nw.Store(ctx, item, network.StoreClassReplicate, contact.Address)
+		})
+
+		if len(receipt.Stored) == 0 {
+			log.Error().Msgf("No node acknowledged the hand off of value with hash: %v", item.Key)
+			failed++
+			continue
 		}
-	}(dht, me)
+		logStoredAt(item.Key, receipt.Stored...)
+	}
+
+	for _, contact := range dht.rt.Contacts() {
+		err := dht.nw.Leave(contact.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to tell %v (%v) about leaving", contact.NodeID, contact.Address)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to hand off %d values", failed)
+	}
+	return nil
+}
+
+// Get retrieves the value for a specified key from the network. The lookup is
+// aborted when the context is done.
+func (dht *DHT) Get(ctx context.Context, hash store.Key) (value []byte, sender node.ID, err error) {
+	item, sender, err := dht.iterativeFindValue(ctx, NewFindValueCall(hash))
+	return item.Value, sender, err
+}
+
+// GetRecord retrieves the newest record with the key from the network, see
+// store.RecordKey. The lookup is aborted when the context is done.
+func (dht *DHT) GetRecord(ctx context.Context, key store.Key) (record store.Item, sender node.ID, err error) {
+	return dht.iterativeFindValue(ctx, NewFindRecordCall(key))
+}
+
+// PutRecord stores a record signed by its publisher in the network, see
+// store.NewRecord. The nodes only replace a stored record with a record of a
+// higher sequence number. The record is republished by this node until it's
+// replaced by a newer record from this node.
+func (dht *DHT) PutRecord(ctx context.Context, record store.Item) (receipt Receipt, err error) {
+	if record.Record == nil {
+		err = errors.New("item is not a record")
+		return
+	}
+
+	err = record.Verify()
+	if err != nil {
+		return
+	}
+
+	err = dht.checkValueSize(record.Value)
+	if err != nil {
+		return
+	}
+
+	receipt, err = dht.iterativeStore(ctx, record, network.StoreClassPublish)
+	if err != nil {
+		return
+	}
 
-	go dht.findNodesRequestHandler()
-	go dht.findValueRequestHandler()
-	go dht.storeRequestHandler()
-	go dht.pongRequestHandler()
-	go dht.republishRequestHandler()
-	go dht.replicateRequestHandler()
-	go dht.refreshRequestHandler()
+	if len(receipt.Stored) == 0 {
+		err = fmt.Errorf("no node acknowledged the store of record with key: %v", receipt.Key)
+		return
+	}
 
+	err = dht.db.AddLocalRecord(record)
 	return
 }
 
-// Forget removes the key and associated value from the local items DB and
-// therefore stop republishing it on the network.
-func (dht *DHT) Forget(hash store.Key) {
-	dht.db.ForgetItem(hash)
+// CompareAndSwap stores a record signed by its publisher in the network like
+// PutRecord, but only at the nodes whose stored record has the expected
+// sequence number (or that have no record), so that concurrent writers don't
+// silently overwrite each other. An error wrapping store.ErrConflict is
+// returned if any node rejected the record, the receipt then holds the
+// sequence number of the newer record. The swap is not atomic across the
+// nodes, the nodes that accepted the record keep it.
+func (dht *DHT) CompareAndSwap(ctx context.Context, record store.Item, expected uint64) (receipt Receipt, err error) {
+	if record.Record == nil {
+		err = errors.New("item is not a record")
+		return
+	}
+	if record.Record.Seq <= expected {
+		err = fmt.Errorf("sequence number %d must be higher than the expected %d", record.Record.Seq, expected)
+		return
+	}
+
+	err = record.Verify()
+	if err != nil {
+		return
+	}
+
+	err = dht.checkValueSize(record.Value)
+	if err != nil {
+		return
+	}
+
+	receipt, err = dht.sendToClosest(ctx, record.Key, func(contact route.Contact) (chan *network.StoreResult, error) {
+		return dht.nw.CompareAndSwap(ctx, record, expected, contact.Address)
+	})
+	if err != nil {
+		return
+	}
+
+	if len(receipt.Stored) > 0 {
+		logStoredAt(record.Key, receipt.Stored...)
+	}
+
+	if len(receipt.Conflicted) > 0 {
+		err = fmt.Errorf("%w: %d nodes have a record with sequence number %d, expected %d",
+			store.ErrConflict, len(receipt.Conflicted), receipt.Seq, expected)
+		return
+	}
+
+	if len(receipt.Stored) == 0 {
+		err = fmt.Errorf("no node acknowledged the store of record with key: %v", receipt.Key)
+		return
+	}
+
+	err = dht.db.AddLocalRecord(record)
+	return
 }
 
-// Get retrieves the value for a specified key from the network.
-func (dht *DHT) Get(hash store.Key) (value string, sender node.ID, err error) {
-	value, sender, err = dht.iterativeFindValue(hash)
+// Put stores the provided value in the network and returns a receipt with the
+// key and the nodes that acknowledged the store. A non-zero TTL limits the
+// lifetime of the value, the nodes evict it and this node stops republishing it
+// once the TTL has passed. The store is aborted when the context is done.
+func (dht *DHT) Put(ctx context.Context, value []byte, ttl time.Duration) (receipt Receipt, err error) {
+	err = dht.checkValueSize(value)
+	if err != nil {
+		return
+	}
+
+	item := store.SignItem(store.Item{
+		Key:   store.KeyFromValue(value),
+		Value: value,
+		TTL:   ttl,
+	}, dht.publisher, dht.clock.Now())
+
+	receipt, err = dht.iterativeStore(ctx, item, network.StoreClassPublish)
+	if err != nil {
+		return
+	}
+
+	if len(receipt.Stored) == 0 {
+		err = fmt.Errorf("no node acknowledged the store of value with hash: %v", receipt.Key)
+		return
+	}
+
+	err = dht.db.AddLocalItem(receipt.Key, value, ttl)
 	return
 }
 
-// Put stores the provided value in the network and returns a key.
-func (dht *DHT) Put(value string) (hash store.Key, err error) {
-	hash, err = dht.iterativeStore(value, network.StoreClassPublish)
+// Provide announces to the k closest nodes of the key that this node holds the
+// content of the key, and keeps announcing it every republish interval. The
+// other nodes find this node as a provider with FindProviders. A receipt with
+// the nodes that acknowledged the announcement is returned.
+func (dht *DHT) Provide(ctx context.Context, key store.Key) (receipt Receipt, err error) {
+	receipt, err = dht.iterativeProvide(ctx, key)
+	if err != nil {
+		return
+	}
+
+	if len(receipt.Stored) == 0 {
+		err = fmt.Errorf("no node acknowledged the provider of key: %v", key)
+		return
+	}
+
+	dht.db.AddLocalProvider(key)
+	return
+}
+
+// FindProviders looks up the nodes that hold the content of the key, the walk
+// gathers the providers known by the nodes closest to the key until n
+// providers are found, or all of them if n is 0. The lookup is aborted when the
+// context is done.
+func (dht *DHT) FindProviders(ctx context.Context, key store.Key, n int) ([]route.Contact, error) {
+	call := NewFindProvidersCall(key, n)
+
+	// This node may itself know of providers.
+	call.add(dht.db.Providers(key, dht.cfg.K)...)
+	if !call.full() {
+		_, err := dht.walk(ctx, call)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	providers := call.Providers()
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("couldn't find any providers of key: %v", key)
+	}
+	return providers, nil
+}
+
+func (dht *DHT) iterativeProvide(ctx context.Context, key store.Key) (receipt Receipt, err error) {
+	receipt, err = dht.sendToClosest(ctx, key, func(contact route.Contact) (chan *network.StoreResult, error) {
+		return dht.nw.AddProvider(ctx, key, contact.Address)
+	})
+	receipt.Provided = true
 	if err != nil {
 		return
 	}
-	dht.db.AddLocalItem(hash, value)
+
+	if len(receipt.Stored) > 0 {
+		log.Info().Msgf("Provided key %v at %d nodes:\n%s",
+			key.String(), len(receipt.Stored), tabbedContactList(receipt.Stored...))
+	}
+	if len(receipt.Failed) > 0 {
+		log.Warn().Msgf("Provider of key %v was not acknowledged by %d nodes:\n%s",
+			key.String(), len(receipt.Failed), tabbedContactList(receipt.Failed...))
+	}
+
 	return
 }
 
+// MaxValueSize returns the size in bytes of the largest value that is stored
+// by the node.
+func (dht *DHT) MaxValueSize() int {
+	return dht.cfg.MaxValueSize
+}
+
+// checkValueSize returns ErrValueTooLarge if the value is larger than the
+// maximum value size.
+func (dht *DHT) checkValueSize(value []byte) error {
+	if len(value) > dht.cfg.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, max is %d bytes", ErrValueTooLarge, len(value), dht.cfg.MaxValueSize)
+	}
+	return nil
+}
+
 // Join initiates a node lookup of itself to bootstrap the node into the
 // network.
 func (dht *DHT) Join(me route.Contact) (err error) {
-	_, err = dht.iterativeFindNodes(me.NodeID)
+	ctx := dht.ctx
+
+	_, err = dht.iterativeFindNodes(ctx, me.NodeID)
 	if err != nil {
 		return
 	}
 
-	for id := range node.IDWithPrefixGenerator(me.NodeID) {
-		_, err = dht.iterativeFindNodes(id)
+	// The node knows its neighbourhood, and is known by it, the remaining
+	// lookups fill the other buckets.
+	dht.markJoined()
+
+	// The IDs are created one at a time, so that nothing is left behind if the
+	// join fails half way through (e.g. when the node is closed).
+	for i := 1; i < node.IDLength; i++ {
+		_, err = dht.iterativeFindNodes(ctx, node.NewIDWithPrefix(me.NodeID, i))
 		if err != nil {
 			return
 		}
@@ -113,123 +542,458 @@ func (dht *DHT) Join(me route.Contact) (err error) {
 	return
 }
 
-// Ping pings a specified node ID.
-func (dht *DHT) Ping(target node.ID) (chal []byte, err error) {
-	sl := dht.rt.NClosest(target, 1)
+// markJoined closes the joined channel, once.
+func (dht *DHT) markJoined() {
+	dht.joinOnce.Do(func() { close(dht.joined) })
+}
 
-	contacts := sl.SortedContacts()
-	if !(contacts.Len() > 0 && contacts[0].NodeID.Equal(target)) {
-		return nil, fmt.Errorf("ping: could not find target node (%v)", target)
+// bootstrap joins the network. The contacts saved by the previous run are tried
+// first, then the bootstrap contacts are tried one at a time until a join
+// succeeds. The saved contacts are used as bootstrap contacts if there are no
+// others.
+func (dht *DHT) bootstrap(me route.Contact, seeds, saved []route.Contact) {
+	if len(saved) > 0 {
+		err := dht.rejoin(me, saved)
+		if err == nil {
+			return
+		}
+		log.Error().Err(err).Msg("Failed to rejoin the DHT network through the saved contacts")
+
+		if len(seeds) == 0 {
+			seeds = saved
+		}
 	}
 
-	contact := contacts[0]
+	seeds = append([]route.Contact{}, seeds...)
+	backoff := minJoinBackoff
+	for i := 0; len(seeds) > 0; {
+		if dht.ctx.Err() != nil {
+			return
+		}
+
+		seed := seeds[i]
+		err := dht.joinVia(me, seed)
+		if err == nil {
+			return
+		}
+
+		if errors.Is(err, errJoinSelf) {
+			seeds = append(seeds[:i], seeds[i+1:]...)
+		} else {
+			log.Error().Err(err).Msgf("Failed to join the DHT network through: %v", seed.Address.String())
+			i++
+		}
+
+		if i < len(seeds) {
+			continue // Try the next contact right away.
+		}
+		i = 0
+
+		if len(seeds) == 0 {
+			break
+		}
+
+		log.Error().Msgf("Failed to join the DHT network through any of %d contacts, retrying in %v", len(seeds), backoff)
+		timer := dht.clock.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-dht.ctx.Done():
+			timer.Stop()
+			return
+		}
 
-	resultCh, challenge, err := dht.nw.Ping(contact.Address)
+		backoff *= 2
+		if backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+
+	log.Info().Msg("No bootstrap contacts, waiting for other nodes to join through this node")
+}
+
+// joinVia joins the network through the bootstrap contact. The contact is
+// pinged first if its node ID is unknown, to learn it.
+func (dht *DHT) joinVia(me route.Contact, seed route.Contact) error {
+	if seed.NodeID == (node.ID{}) {
+		from, ok := dht.pingAddress(dht.ctx, seed.Address)
+		if !ok {
+			return fmt.Errorf("no answer from: %v", seed.Address.String())
+		}
+		seed = from
+	}
+
+	if seed.NodeID.Equal(me.NodeID) {
+		return errJoinSelf
+	}
+
+	dht.addNode(seed)
+	return dht.Join(me)
+}
+
+// rejoin joins the network using the contacts saved by the previous run of the
+// node. The saved contacts are pinged, and those that don't answer are removed
+// from the routing table. If enough of them answer, the routing table is
+// considered warm and only the neighbourhood of the node is looked up, as the
+// other buckets are refreshed when they go untouched. Otherwise the node falls
+// back to a full join.
+func (dht *DHT) rejoin(me route.Contact, saved route.Contacts) error {
+	ctx := dht.ctx
+
+	var alive uint32
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dht.cfg.Alpha)
+	for _, contact := range saved {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(contact route.Contact) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			from, ok := dht.pingAddress(ctx, contact.Address)
+			if ok && from.NodeID.Equal(contact.NodeID) {
+				atomic.AddUint32(&alive, 1)
+				dht.addNode(contact)
+			} else {
+				dht.rt.Remove(contact.NodeID)
+			}
+		}(contact)
+	}
+	wg.Wait()
+
+	// Enough of the saved contacts are k of them, or half of them if fewer
+	// than 2k were saved.
+	enough := dht.cfg.K
+	if half := (len(saved) + 1) / 2; half < enough {
+		enough = half
+	}
+
+	log.Info().Msgf("%d of %d saved contacts answered", alive, len(saved))
+	if int(alive) < enough {
+		return dht.Join(me)
+	}
+
+	_, err := dht.iterativeFindNodes(ctx, me.NodeID)
+	return err
+}
+
+// pingAddress pings the address and returns the contact that answered, ok is
+// true if a matching pong was received before the context is done or the
+// request timed out.
+func (dht *DHT) pingAddress(ctx context.Context, addr net.UDPAddr) (from route.Contact, ok bool) {
+	response, err := dht.ping(ctx, addr)
+	if err != nil {
+		return
+	}
+	return response.From, true
+}
+
+// ping pings the address and returns the pong, an error is returned unless a
+// pong with the challenge was received before the context is done or the
+// request timed out.
+func (dht *DHT) ping(ctx context.Context, addr net.UDPAddr) (*network.PingResult, error) {
+	resultCh, challenge, err := dht.nw.Ping(ctx, addr)
 	if err != nil {
-		return nil, fmt.Errorf("ping request failed for: %v: %w",
-			contact.NodeID, err)
+		return nil, fmt.Errorf("ping request failed for: %v: %w", addr.String(), err)
 	}
 
 	response := <-resultCh
 	if response == nil {
-		return nil, fmt.Errorf("ping response from: %v timed out", contact.NodeID)
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("ping to: %v aborted: %w", addr.String(), err)
+		}
+		return nil, fmt.Errorf("ping response from: %v timed out", addr.String())
 	}
 
-	go dht.addNode(contact)
+	if !bytes.Equal(challenge, response.Challenge) {
+		return nil, fmt.Errorf("challenge mismatch")
+	}
+	return response, nil
+}
+
+// Ping pings a specified node ID. The node is looked up in the network if it's
+// not in the routing table. The ping is aborted when the context is done.
+func (dht *DHT) Ping(ctx context.Context, target node.ID) (chal []byte, err error) {
+	contacts := dht.rt.NClosest(target, 1).SortedContacts()
+	if !(contacts.Len() > 0 && contacts[0].NodeID.Equal(target)) {
+		contacts, err = dht.iterativeFindNodes(ctx, target)
+		if err != nil {
+			return nil, fmt.Errorf("ping: lookup of target node (%v) failed: %w", target, err)
+		}
+	}
+
+	for _, contact := range contacts {
+		if !contact.NodeID.Equal(target) {
+			continue
+		}
+
+		response, err := dht.ping(ctx, contact.Address)
+		if err != nil {
+			return nil, fmt.Errorf("ping: %v: %w", contact.NodeID, err)
+		}
 
-	if bytes.Equal(challenge, response.Challenge) {
+		dht.addNode(contact)
 		return response.Challenge, nil
 	}
-	return nil, fmt.Errorf("challenge mismatch")
+	return nil, fmt.Errorf("ping: could not find target node (%v)", target)
+}
+
+// PingAddress pings the node at the address, which doesn't have to be in the
+// routing table, and returns its node ID. The node is added to the routing
+// table if it answers. The ping is aborted when the context is done.
+func (dht *DHT) PingAddress(ctx context.Context, addr net.UDPAddr) (id node.ID, chal []byte, err error) {
+	response, err := dht.ping(ctx, addr)
+	if err != nil {
+		return
+	}
+
+	if !response.From.NodeID.Equal(dht.me.NodeID) {
+		dht.addNode(response.From)
+	}
+	return response.From.NodeID, response.Challenge, nil
+}
+
+// goTracked runs fn in a goroutine that Close waits for. It returns false, and
+// fn isn't run, if the node is closed.
+func (dht *DHT) goTracked(fn func()) bool {
+	dht.closing.RLock()
+	defer dht.closing.RUnlock()
+
+	// The wait group must not be added to once Close waits for it.
+	if dht.ctx.Err() != nil {
+		return false
+	}
+
+	dht.wg.Add(1)
+	go func() {
+		defer dht.wg.Done()
+		fn()
+	}()
+	return true
 }
 
 // addNode attempts to add a node to the routing table. If the bucket is full
-// for the given node, the least recently seen node will be pinged and evicted
-// if it doesn't respond. If the bucket already contain the node, it'll be moved
-// to the top of the bucket.
+// for the given node, the node is added to the replacement cache of the bucket
+// and the least recently seen node is pinged in the background. The least
+// recently seen node is replaced by the most recently seen replacement once it
+// has failed to respond MaxFailures times in a row. If the bucket already
+// contain the node, it'll be moved to the top of the bucket.
 func (dht *DHT) addNode(contact route.Contact) {
 	rt := dht.rt
 
+	if dht.hasLeft(contact.NodeID) {
+		return
+	}
+
 	ok := rt.Add(contact)
 	if ok {
 		return
 	}
 
-	old := rt.Head(contact.NodeID).NodeID
-	// Check if the oldest node is still alive.
-	// If the node answers, it'll be moved to the top of the bucket by the Ping
-	// method.
-	_, err := dht.Ping(old)
+	head := rt.Head(contact.NodeID)
+
+	dht.probing.Lock()
+	if dht.probing.m[head.NodeID] {
+		dht.probing.Unlock()
+		return // The head is already being pinged.
+	}
+	dht.probing.m[head.NodeID] = true
+	dht.probing.Unlock()
+
+	started := dht.goTracked(func() { dht.probe(head) })
+	if !started {
+		dht.probing.Lock()
+		delete(dht.probing.m, head.NodeID)
+		dht.probing.Unlock()
+	}
+}
+
+// probe pings the head of a full bucket, which is moved to the top of the
+// bucket if it answers and counted as failed otherwise.
+func (dht *DHT) probe(head route.Contact) {
+	rt := dht.rt
+
+	defer func() {
+		dht.probing.Lock()
+		delete(dht.probing.m, head.NodeID)
+		dht.probing.Unlock()
+	}()
 
+	// Check if the oldest node is still alive.
+	sent := dht.clock.Now()
+	_, err := dht.ping(dht.ctx, head.Address)
 	if err != nil {
-		// Either challenge mismatch or dead node, remove it.
-		rt.Remove(old)
+		if dht.ctx.Err() == nil {
+			rt.Fail(head.NodeID)
+		}
+		return
+	}
 
-		// Re-try to add new node.
-		ok = rt.Add(contact)
-		if !ok {
-			log.Warn().Msg("Unable to add new node even after old node was evicted")
+	// The node answered, move it to the top of the bucket.
+	head.RTT = dht.clock.Now().Sub(sent)
+	rt.Add(head)
+}
+
+// evict removes a node that is leaving the network from the routing table, and
+// keeps it from being added back for tLeave.
+func (dht *DHT) evict(id node.ID) {
+	now := dht.clock.Now()
+
+	dht.left.Lock()
+	dht.left.m[id] = now
+	for other, t := range dht.left.m {
+		if now.Sub(t) > tLeave {
+			delete(dht.left.m, other)
 		}
+	}
+	dht.left.Unlock()
+
+	dht.rt.Remove(id)
+}
+
+// hasLeft returns true if the node left the network within tLeave.
+func (dht *DHT) hasLeft(id node.ID) bool {
+	dht.left.Lock()
+	defer dht.left.Unlock()
+
+	t, ok := dht.left.m[id]
+	return ok && dht.clock.Now().Sub(t) <= tLeave
+}
+
+func (dht *DHT) iterativeFindNodes(ctx context.Context, target node.ID) ([]route.Contact, error) {
+	return dht.walk(ctx, NewFindNodesCall(target))
+}
+
+func (dht *DHT) iterativeStore(ctx context.Context, item store.Item, class network.StoreClass) (receipt Receipt, err error) {
+	receipt, err = dht.sendToClosest(ctx, item.Key, func(contact route.Contact) (chan *network.StoreResult, error) {
+		return dht.nw.Store(ctx, item, class, contact.Address)
+	})
+	if err != nil {
 		return
 	}
+
+	if len(receipt.Stored) > 0 {
+		logStoredAt(item.Key, receipt.Stored...)
+	}
+	if len(receipt.Failed) > 0 {
+		log.Warn().Msgf("Store of value with hash %v was not acknowledged by %d nodes:\n%s",
+			item.Key.String(), len(receipt.Failed), tabbedContactList(receipt.Failed...))
+	}
+
+	return
 }
 
-func (dht *DHT) iterativeFindNodes(target node.ID) ([]route.Contact, error) {
-	return dht.walk(NewFindNodesCall(target))
+func (dht *DHT) iterativeDelete(ctx context.Context, tombstone store.Tombstone) (receipt Receipt, err error) {
+	receipt, err = dht.sendToClosest(ctx, tombstone.Key, func(contact route.Contact) (chan *network.StoreResult, error) {
+		return dht.nw.Delete(ctx, tombstone, contact.Address)
+	})
+	receipt.Deleted = true
+	if err != nil {
+		return
+	}
+
+	if len(receipt.Stored) > 0 {
+		log.Info().Msgf("Deleted value with hash %v at %d nodes:\n%s",
+			tombstone.Key.String(), len(receipt.Stored), tabbedContactList(receipt.Stored...))
+	}
+	if len(receipt.Failed) > 0 {
+		log.Warn().Msgf("Delete of value with hash %v was not acknowledged by %d nodes:\n%s",
+			tombstone.Key.String(), len(receipt.Failed), tabbedContactList(receipt.Failed...))
+	}
+
+	return
 }
 
-func (dht *DHT) iterativeStore(value string, class network.StoreClass) (hash store.Key, err error) {
-	hash = store.KeyFromValue(value)
+// sendToClosest looks up the k closest nodes to the key and sends a request to
+// each of them using the send function.
+func (dht *DHT) sendToClosest(ctx context.Context, key store.Key, send func(route.Contact) (chan *network.StoreResult, error)) (receipt Receipt, err error) {
+	receipt.Key = key
 
-	contacts, err := dht.iterativeFindNodes(node.ID(hash))
+	contacts, err := dht.iterativeFindNodes(ctx, node.ID(key))
 	if err != nil {
 		return
 	}
 
+	receipt = dht.sendTo(key, contacts, send)
+	return
+}
+
+// sendTo sends a request to each of the (at most k) contacts using the send
+// function. All the requests are sent at once and then the acknowledgements
+// are awaited, a nil result means that the request failed or timed out. The
+// refused requests are counted as failed.
+func (dht *DHT) sendTo(key store.Key, contacts []route.Contact, send func(route.Contact) (chan *network.StoreResult, error)) (receipt Receipt) {
+	receipt.Key = key
+
 	// Do not replicate the value over more than k nodes.
-	if len(contacts) > k {
-		contacts = contacts[:k]
+	if len(contacts) > dht.cfg.K {
+		contacts = contacts[:dht.cfg.K]
 	}
 
-	var stored []route.Contact
-	for _, contact := range contacts {
-		if e := dht.nw.Store(hash, value, class, contact.Address); e != nil {
+	results := make([]chan *network.StoreResult, len(contacts))
+	for i, contact := range contacts {
+		ch, e := send(contact)
+		if e != nil {
 			logFailedStoreAt(contact, e)
-		} else {
-			stored = append(stored, contact)
+			continue
 		}
+		results[i] = ch
 	}
 
-	if len(stored) > 0 {
-		logStoredAt(hash, stored...)
+	for i, contact := range contacts {
+		var result *network.StoreResult
+		if results[i] != nil {
+			result = <-results[i]
+		}
+
+		switch {
+		case result == nil || result.Refused:
+			receipt.Failed = append(receipt.Failed, contact)
+		case result.Conflict:
+			receipt.Conflicted = append(receipt.Conflicted, contact)
+			if result.Seq > receipt.Seq {
+				receipt.Seq = result.Seq
+			}
+		default:
+			receipt.Stored = append(receipt.Stored, contact)
+		}
 	}
 
 	return
 }
 
-func (dht *DHT) iterativeFindValue(hash store.Key) (value string, sender node.ID, err error) {
-	call := NewFindValueCall(hash)
-	closest, err := dht.walk(call)
+func (dht *DHT) iterativeFindValue(ctx context.Context, call *FindValueCall) (item store.Item, sender node.ID, err error) {
+	hash := call.hash
+	closest, err := dht.walk(ctx, call)
 
 	if err != nil {
 		return
 	}
 
-	if call.value != "" {
-		value = call.value
+	item, found := call.Item()
+	if found {
 		sender = call.sender
 	} else {
 		err = fmt.Errorf("couldn't find any value with the hash: %v", hash)
 		return
 	}
 
-	// Store at the closest node that did not return any value.
+	// Store at the closest node that did not return any value. The
+	// acknowledgement is awaited in the background to not delay the lookup.
 	if len(closest) > 0 {
 		first := closest[0]
-		if e := dht.nw.Store(hash, value, network.StoreClassReplicate, first.Address); e != nil {
+		ch, e := dht.nw.Store(dht.ctx, item, network.StoreClassReplicate, first.Address)
+		if e != nil {
 			logFailedStoreAt(first, e)
 		} else {
-			logStoredAt(hash, first)
+			dht.goTracked(func() {
+				if <-ch != nil {
+					logStoredAt(hash, first)
+				} else {
+					logFailedStoreAt(first, errors.New("store timed out"))
+				}
+			})
 		}
 	}
 
@@ -244,6 +1008,42 @@ func logStoredAt(hash store.Key, contacts ...route.Contact) {
 	log.Info().Msgf("Stored value with hash %v at %d nodes:\n%s", hash.String(), len(contacts), tabbedContactList(contacts...))
 }
 
+// Receipt lists the nodes that acknowledged the store (or delete) of a value,
+// and the nodes that failed to do so in time. The nodes that rejected a
+// compare-and-swap are listed as conflicted, along with the highest sequence
+// number of their stored records.
+type Receipt struct {
+	Key        store.Key
+	Stored     []route.Contact
+	Failed     []route.Contact
+	Conflicted []route.Contact
+	Seq        uint64
+	Deleted    bool // Receipt of a delete.
+	Provided   bool // Receipt of a provider announcement.
+}
+
+func (r Receipt) String() (str string) {
+	action, what := "Stored", "value with hash"
+	if r.Deleted {
+		action = "Deleted"
+	}
+	if r.Provided {
+		action, what = "Provided", "key"
+	}
+
+	str = fmt.Sprintf("%s %s %v at %d of %d nodes:\n%s",
+		action, what, r.Key.String(), len(r.Stored), len(r.Stored)+len(r.Failed)+len(r.Conflicted),
+		tabbedContactList(r.Stored...))
+
+	if len(r.Failed) > 0 {
+		str += "Not acknowledged by:\n" + tabbedContactList(r.Failed...)
+	}
+	if len(r.Conflicted) > 0 {
+		str += fmt.Sprintf("Rejected by (sequence number %d):\n", r.Seq) + tabbedContactList(r.Conflicted...)
+	}
+	return
+}
+
 func tabbedContactList(contacts ...route.Contact) (cl string) {
 	for _, contact := range contacts {
 		cl += "\t" + contact.NodeID.String() + "\n"
@@ -2,24 +2,37 @@ package dht
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io/ioutil"
 	stdlog "log"
 	"math/rand" // Insecure on purpose due to testing.
 	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/network"
+	"github.com/optmzr/d7024e-dht/network/sim"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
 	"github.com/optmzr/d7024e-dht/store"
 )
 
 // udpNetwork is a mock that fulfills the network.Network interface.
-type udpNetwork struct{}
+type udpNetwork struct {
+	stored chan store.Key // Receives the key of every store, unless nil or full.
+	clock  clock.Clock    // Times out the requests, the system time is used if it's nil.
+}
 
 // findNodesResult is a mock that fulfills the network.Result interface.
 type findNodesResult struct {
@@ -31,23 +44,85 @@ func (r *findNodesResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *findNodesResult) Value() string {
-	return ""
+func (r *findNodesResult) Value() ([]byte, bool) {
+	return nil, false
+}
+
+func (r *findNodesResult) Publisher() ed25519.PublicKey {
+	return nil
+}
+
+func (r *findNodesResult) Published() time.Time {
+	return time.Time{}
+}
+
+func (r *findNodesResult) Signature() []byte {
+	return nil
+}
+
+func (r *findNodesResult) Record() *store.Record {
+	return nil
+}
+
+func (r *findNodesResult) Providers() []route.Contact {
+	return nil
+}
+
+func (r *findNodesResult) TTL() time.Duration {
+	return 0
 }
 
 // findValueResult is a mock that fulfills the network.Result interface.
 type findValueResult struct {
-	from    route.Contact
-	closest []route.Contact
-	value   string
+	from      route.Contact
+	closest   []route.Contact
+	value     []byte // Found if not nil.
+	publisher ed25519.PublicKey
+	published time.Time
+	signature []byte
+	record    *store.Record
+	ttl       time.Duration
 }
 
 func (r *findValueResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *findValueResult) Value() string {
-	return r.value
+func (r *findValueResult) Value() ([]byte, bool) {
+	return r.value, r.value != nil
+}
+
+func (r *findValueResult) Publisher() ed25519.PublicKey {
+	return r.publisher
+}
+
+func (r *findValueResult) Published() time.Time {
+	return r.published
+}
+
+func (r *findValueResult) Signature() []byte {
+	return r.signature
+}
+
+func (r *findValueResult) Record() *store.Record {
+	return r.record
+}
+
+func (r *findValueResult) Providers() []route.Contact {
+	return nil
+}
+
+func (r *findValueResult) TTL() time.Duration {
+	return r.ttl
+}
+
+type providersResult struct {
+	findNodesResult
+	providers []route.Contact
+}
+
+func (r *providersResult) Providers() []route.Contact {
+	return r.providers
 }
 
 // Accessed by multiple goroutines, must not be changed except by init().
@@ -112,7 +187,7 @@ func randomFindNodesResult(address net.UDPAddr) (node.ID, []route.Contact) {
 
 // FindNodes mocks a FindNodes call by returning a NodeListResult with some
 // random contacts as closest.
-func (net *udpNetwork) FindNodes(target node.ID, address net.UDPAddr) (chan network.FindResult, error) {
+func (net *udpNetwork) FindNodes(ctx context.Context, target node.ID, address net.UDPAddr) (chan network.FindResult, error) {
 	ch := make(chan network.FindResult)
 	go func() {
 		id, closest := randomFindNodesResult(address)
@@ -128,13 +203,33 @@ func (net *udpNetwork) FindNodes(target node.ID, address net.UDPAddr) (chan netw
 
 var findValueCalls uint32 = 0
 
-func (net *udpNetwork) FindValue(key store.Key, address net.UDPAddr) (chan network.FindResult, error) {
+// forgedValue is looked up by its key, the first contact responds with a
+// forged value and the second without any value at all.
+var forgedValue = []byte("Hej då")
+
+func (net *udpNetwork) FindValue(ctx context.Context, key store.Key, address net.UDPAddr) (chan network.FindResult, error) {
 	calls := atomic.AddUint32(&findValueCalls, 1)
 
 	ch := make(chan network.FindResult)
 	go func() {
 		id, closest := randomFindNodesResult(address)
 
+		if key == store.KeyFromValue(forgedValue) {
+			result := &findValueResult{
+				from:    route.Contact{NodeID: id, Address: address},
+				closest: closest,
+				value:   forgedValue,
+			}
+			switch address.IP[3] {
+			case 0:
+				result.value = []byte("Forged value")
+			case 1:
+				result.value = nil
+			}
+			ch <- result
+			return
+		}
+
 		if calls < 4 { // Call #4 should return a value.
 			ch <- &findValueResult{
 				from:    route.Contact{NodeID: id, Address: address},
@@ -144,37 +239,97 @@ func (net *udpNetwork) FindValue(key store.Key, address net.UDPAddr) (chan netwo
 			ch <- &findValueResult{
 				from:    route.Contact{NodeID: id, Address: address},
 				closest: closest,
-				value:   "ABC, du är mina tankar",
+				value:   []byte("ABC, du är mina tankar"),
 			}
 		}
 	}()
 	return ch, nil
 }
 
-func (net *udpNetwork) Ping(addr net.UDPAddr) (chan *network.PingResult, []byte, error) {
-	return nil, nil, nil
+// Ping mocks a Ping call that times out.
+func (net *udpNetwork) Ping(ctx context.Context, addr net.UDPAddr) (chan *network.PingResult, []byte, error) {
+	ch := make(chan *network.PingResult, 1)
+	ch <- nil
+	return ch, nil, nil
 }
 func (net *udpNetwork) Pong(challenge []byte, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
-func (net *udpNetwork) SendValue(key store.Key, value string, closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+func (net *udpNetwork) SendValue(item store.Item, found bool, closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
 func (net *udpNetwork) SendNodes(closets []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
-func (net *udpNetwork) Store(key store.Key, value string, class network.StoreClass, addr net.UDPAddr) error {
+
+// Store mocks a Store call by acknowledging the store for every contact with
+// an odd IP address, the others will time out.
+func (net *udpNetwork) Store(ctx context.Context, item store.Item, class network.StoreClass, addr net.UDPAddr) (chan *network.StoreResult, error) {
+	select {
+	case net.stored <- item.Key:
+	default:
+	}
+	return mockAck(item.Key, addr), nil
+}
+
+// CompareAndSwap mocks a CompareAndSwap call in the same way as Store.
+func (net *udpNetwork) CompareAndSwap(ctx context.Context, record store.Item, expected uint64, addr net.UDPAddr) (chan *network.StoreResult, error) {
+	return mockAck(record.Key, addr), nil
+}
+
+// Delete mocks a Delete call in the same way as Store.
+func (net *udpNetwork) Delete(ctx context.Context, tombstone store.Tombstone, addr net.UDPAddr) (chan *network.StoreResult, error) {
+	return mockAck(tombstone.Key, addr), nil
+}
+
+func mockAck(key store.Key, addr net.UDPAddr) chan *network.StoreResult {
+	ch := make(chan *network.StoreResult, 1)
+	if addr.IP[3]%2 == 1 {
+		ch <- &network.StoreResult{Key: key}
+	} else {
+		ch <- nil
+	}
+	return ch
+}
+func (net *udpNetwork) SendStoreAck(key store.Key, sessionID network.SessionID, addr net.UDPAddr) error {
+	return nil
+}
+func (net *udpNetwork) SendStoreConflict(key store.Key, seq uint64, sessionID network.SessionID, addr net.UDPAddr) error {
 	return nil
 }
-func (net *udpNetwork) StoreRequestCh() chan *network.StoreRequest         { return nil }
-func (net *udpNetwork) FindNodesRequestCh() chan *network.FindNodesRequest { return nil }
-func (net *udpNetwork) FindValueRequestCh() chan *network.FindValueRequest { return nil }
-func (net *udpNetwork) PongRequestCh() chan *network.PongRequest           { return nil }
-func (net *udpNetwork) ReadyCh() chan struct{}                             { return nil }
-func (net *udpNetwork) Listen() error                                      { return nil }
+func (net *udpNetwork) SendStoreRefusal(key store.Key, sessionID network.SessionID, addr net.UDPAddr) error {
+	return nil
+}
+func (net *udpNetwork) AddProvider(ctx context.Context, key store.Key, addr net.UDPAddr) (chan *network.StoreResult, error) {
+	return mockAck(key, addr), nil
+}
+func (net *udpNetwork) GetProviders(ctx context.Context, key store.Key, addr net.UDPAddr) (chan network.FindResult, error) {
+	return nil, nil
+}
+func (net *udpNetwork) SendProviders(key store.Key, providers []route.Contact, closest []route.Contact, sessionID network.SessionID, addr net.UDPAddr) error {
+	return nil
+}
+func (net *udpNetwork) AddProviderRequestCh() chan *network.AddProviderRequest   { return nil }
+func (net *udpNetwork) GetProvidersRequestCh() chan *network.GetProvidersRequest { return nil }
+func (net *udpNetwork) StoreRequestCh() chan *network.StoreRequest               { return nil }
+func (net *udpNetwork) DeleteRequestCh() chan *network.DeleteRequest             { return nil }
+func (net *udpNetwork) LeaveRequestCh() chan *network.LeaveRequest               { return nil }
+func (net *udpNetwork) FindNodesRequestCh() chan *network.FindNodesRequest       { return nil }
+func (net *udpNetwork) FindValueRequestCh() chan *network.FindValueRequest       { return nil }
+func (net *udpNetwork) PongRequestCh() chan *network.PongRequest                 { return nil }
+func (net *udpNetwork) ReadyCh() chan struct{}                                   { return nil }
+func (net *udpNetwork) Listen() error                                            { return nil }
+func (net *udpNetwork) Close() error                                             { return nil }
+func (net *udpNetwork) Leave(addr net.UDPAddr) error                             { return nil }
+func (net *udpNetwork) Config() network.Config {
+	if net.clock == nil {
+		return network.Config{Timeout: network.DefaultTimeout, Clock: clock.New()}
+	}
+	return network.Config{Timeout: network.DefaultTimeout, Clock: net.clock}
+}
 
 func newDHT(t *testing.T) *DHT {
-	d, err := New(me, others[:1], new(udpNetwork))
+	d, err := New(me, others[:1], new(udpNetwork), Config{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -186,17 +341,18 @@ func TestJoin(t *testing.T) {
 
 	err := d.Join(me)
 	if err != nil {
-		t.Errorf("unexpected error: %w", err)
+		t.Errorf("unexpected error: %v", err)
 	}
 }
 
 func TestPut(t *testing.T) {
 	d := newDHT(t)
 
-	hash, err := d.Put("ABC, du är mina tankar")
+	receipt, err := d.Put(context.Background(), []byte("ABC, du är mina tankar"), 0)
 	if err != nil {
-		t.Errorf("unexpected error: %w", err)
+		t.Errorf("unexpected error: %v", err)
 	}
+	hash := receipt.Key
 
 	expHash := store.Key{
 		189, 224, 233, 246, 233, 211, 250, 189, 91, 246, 132, 158, 23, 159, 10,
@@ -207,6 +363,39 @@ func TestPut(t *testing.T) {
 	if !bytes.Equal(hash[:], expHash[:]) {
 		t.Errorf("unexpected hash, got: %v, exp: %v", hash, expHash)
 	}
+
+	if len(receipt.Stored) == 0 || len(receipt.Failed) == 0 {
+		t.Errorf("expected both stored and failed contacts in receipt: %v", receipt)
+	}
+
+	for _, contact := range receipt.Stored {
+		if contact.Address.IP[3]%2 != 1 {
+			t.Errorf("unexpected contact in stored: %v", contact.Address.IP)
+		}
+	}
+
+	for _, contact := range receipt.Failed {
+		if contact.Address.IP[3]%2 != 0 {
+			t.Errorf("unexpected contact in failed: %v", contact.Address.IP)
+		}
+	}
+}
+
+func TestPut_tooLarge(t *testing.T) {
+	d, err := New(me, others[:1], new(udpNetwork), Config{MaxValueSize: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = d.Put(context.Background(), make([]byte, 11), 0)
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrValueTooLarge)
+	}
+
+	_, err = d.Put(context.Background(), make([]byte, 10), 0)
+	if errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("unexpected error for value of max size: %v", err)
+	}
 }
 
 func TestGet(t *testing.T) {
@@ -218,17 +407,227 @@ func TestGet(t *testing.T) {
 		134,
 	}
 
-	value, _, err := d.Get(hash)
+	value, _, err := d.Get(context.Background(), hash)
 	if err != nil {
-		t.Errorf("unexpected error: %w", err)
+		t.Errorf("unexpected error: %v", err)
 	}
 
-	expValue := "ABC, du är mina tankar"
-	if value != expValue {
+	expValue := []byte("ABC, du är mina tankar")
+	if !bytes.Equal(value, expValue) {
 		t.Errorf("unexpected value, got: %s, exp: %s", value, expValue)
 	}
 }
 
+func TestGet_forged(t *testing.T) {
+	d, err := New(me, others[:2], new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value, sender, err := d.Get(context.Background(), store.KeyFromValue(forgedValue))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !bytes.Equal(value, forgedValue) {
+		t.Errorf("unexpected value, got: %s, exp: %s", value, forgedValue)
+	}
+
+	if sender.Equal(others[0].NodeID) {
+		t.Errorf("unexpected sender of forged value: %v", sender)
+	}
+
+	if n := d.Stats().Misbehaving; n != 1 {
+		t.Errorf("unexpected number of misbehaving responses, got: %d, exp: 1", n)
+	}
+}
+
+// misbehavingCall is a call where the contact at the bad address responds with
+// an invalid result, and every other contact responds with the bad contact.
+type misbehavingCall struct {
+	FindNodesCall
+	bad route.Contact
+}
+
+func (call *misbehavingCall) Do(ctx context.Context, nw network.Network, address net.UDPAddr) (chan network.FindResult, error) {
+	ch := make(chan network.FindResult, 1)
+	ch <- &findNodesResult{closest: []route.Contact{call.bad}}
+	return ch, nil
+}
+
+func (call *misbehavingCall) Result(result network.FindResult, callee route.Contact) (bool, error) {
+	if callee.NodeID.Equal(call.bad.NodeID) {
+		return false, errors.New("misbehaving")
+	}
+	return false, nil
+}
+
+func TestWalk_misbehaving(t *testing.T) {
+	d, err := New(me, others[:3], new(udpNetwork), Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	call := &misbehavingCall{bad: others[0]}
+	call.target = others[0].NodeID
+
+	contacts, err := d.walk(context.Background(), call)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range contacts {
+		if c.NodeID.Equal(call.bad.NodeID) {
+			t.Errorf("unexpected misbehaving contact in result: %v", c.NodeID)
+		}
+	}
+	if n := d.Stats().Misbehaving; n != 1 {
+		t.Errorf("unexpected number of misbehaving responses, got: %d, exp: 1", n)
+	}
+}
+
+func TestFindProvidersCall(t *testing.T) {
+	call := NewFindProvidersCall(store.Key{1}, 3)
+
+	stop, _ := call.Result(&providersResult{providers: others[0:2]}, others[5])
+	if stop {
+		t.Error("unexpected stop with 2 of 3 providers")
+	}
+
+	// Providers known by several nodes are only added once.
+	stop, _ = call.Result(&providersResult{providers: others[1:4]}, others[6])
+	if !stop {
+		t.Error("expected stop with 3 of 3 providers")
+	}
+
+	got := call.Providers()
+	if len(got) != 3 {
+		t.Fatalf("unexpected number of providers, got: %d, exp: %d", len(got), 3)
+	}
+	for i, provider := range got {
+		if !provider.NodeID.Equal(others[i].NodeID) {
+			t.Errorf("unexpected provider, got: %v, exp: %v", provider.NodeID, others[i].NodeID)
+		}
+	}
+
+	// Without a limit, the walk is never stopped.
+	call = NewFindProvidersCall(store.Key{1}, 0)
+	stop, _ = call.Result(&providersResult{providers: others}, others[0])
+	if stop || len(call.Providers()) != len(others) {
+		t.Errorf("unexpected result, stop: %v, providers: %d", stop, len(call.Providers()))
+	}
+}
+
+func TestFindRecordCall_newest(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	var records []store.Item
+	for seq := uint64(1); seq <= 3; seq++ {
+		records = append(records, store.NewRecord(privateKey, salt, seq, []byte{byte(seq)}))
+	}
+	key := records[0].Key
+
+	result := func(record store.Item) *findValueResult {
+		return &findValueResult{value: record.Value, publisher: record.Publisher, record: record.Record}
+	}
+
+	call := NewFindRecordCall(key)
+	for i, j := range []int{1, 2, 0} {
+		stop, err := call.Result(result(records[j]), others[i])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stop {
+			t.Error("unexpected stop, other nodes may have a newer record")
+		}
+	}
+
+	item, found := call.Item()
+	if !found || item.Record.Seq != 3 || !call.sender.Equal(others[1].NodeID) {
+		t.Errorf("unexpected record, got: seq %d from %v, exp: seq 3 from %v", item.Record.Seq, call.sender, others[1].NodeID)
+	}
+
+	// A forged record is dropped.
+	forged := store.NewRecord(privateKey, salt, 4, []byte{4})
+	forged.Value = []byte("forged")
+	_, err := call.Result(result(forged), others[3])
+	if err == nil {
+		t.Error("expected error for forged record")
+	}
+	if item, _ := call.Item(); item.Record.Seq != 3 {
+		t.Errorf("unexpected record, got: seq %d, exp: seq 3", item.Record.Seq)
+	}
+
+	// An immutable value is not a record.
+	_, err = call.Result(&findValueResult{value: []byte("immutable")}, others[4])
+	if err == nil {
+		t.Error("expected error for immutable value")
+	}
+}
+
+func TestFindValueCall_mismatch(t *testing.T) {
+	call := NewFindValueCall(store.KeyFromValue(forgedValue))
+
+	stop, err := call.Result(&findValueResult{value: []byte("Forged value")}, others[0])
+	if err == nil {
+		t.Error("expected error for mismatched value")
+	}
+	if stop {
+		t.Error("unexpected stop for mismatched value")
+	}
+	if call.found {
+		t.Errorf("unexpected value assigned: %s", call.value)
+	}
+
+	stop, err = call.Result(&findValueResult{value: forgedValue}, others[1])
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !stop {
+		t.Error("expected stop for matching value")
+	}
+	if !bytes.Equal(call.value, forgedValue) || !call.sender.Equal(others[1].NodeID) {
+		t.Errorf("unexpected result, got: %s from %v", call.value, call.sender)
+	}
+}
+
+func TestRepublish_fakeClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	nw := &udpNetwork{stored: make(chan store.Key, 1), clock: c}
+	d, err := New(me, others[:1], nw, Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer d.Close()
+
+	key := store.KeyFromValue([]byte("ABC, du är mina tankar"))
+	d.db.AddLocalItem(key, []byte("ABC, du är mina tankar"), 0)
+
+	// Run a day worth of republish, replicate and refresh events, a minute at
+	// a time.
+	for i := 0; i < 25*60; i++ {
+		c.Advance(time.Minute)
+	}
+
+	// Nothing else is stored by the node, the value is republished.
+	if got := <-nw.stored; got != key {
+		t.Errorf("unexpected key, got: %v, exp: %v", got, key)
+	}
+}
+
+func TestGet_cancelled(t *testing.T) {
+	d := newDHT(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := d.Get(ctx, store.Key{})
+	if err != context.Canceled {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, context.Canceled)
+	}
+}
+
 func TestForget(t *testing.T) {
 	d := newDHT(t)
 
@@ -238,5 +637,912 @@ func TestForget(t *testing.T) {
 		134,
 	}
 
-	d.Forget(hash)
+	receipt, err := d.Forget(context.Background(), hash)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !receipt.Deleted || receipt.Key != hash {
+		t.Errorf("unexpected receipt: %v", receipt)
+	}
+
+	if len(receipt.Stored) == 0 {
+		t.Errorf("expected contacts that acknowledged the delete in receipt: %v", receipt)
+	}
+}
+
+// newFakeClock returns the clock of the simulated nodes. Nothing times out on
+// the fake clock unless it's advanced, so the requests to the nodes that are
+// alive never time out however slow the test is.
+func newFakeClock() *clock.Fake {
+	return clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+}
+
+// newSimulatedDHTs creates n DHT nodes connected to each other through a
+// simulated network, driven by the clock. Every node bootstraps using the
+// first node, and the nodes are returned once all of them have looked
+// themselves up. The nodes keep filling their routing tables in the background.
+func newSimulatedDHTs(t *testing.T, sb *sim.Switchboard, c clock.Clock, n int) []*DHT {
+	var keys []node.Key
+	var contacts []route.Contact
+	for i := 0; i < n; i++ {
+		key, err := node.NewKey()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		keys = append(keys, key)
+		contacts = append(contacts, route.NewContact(key.ID(), net.UDPAddr{
+			IP:   net.IP{10, 20, byte(i >> 8), byte(i)},
+			Port: 8118,
+		}))
+	}
+
+	var dhts []*DHT
+	for i, contact := range contacts {
+		nw, err := sb.NewNetwork(contact, keys[i], network.Config{Clock: c})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		d, err := New(contact, contacts[:1], newLeaveNetwork(nw), Config{Clock: c})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		go nw.Listen()
+		dhts = append(dhts, d)
+	}
+
+	for _, d := range dhts {
+		<-d.joined
+	}
+	return dhts
+}
+
+// leaveNetwork passes the leave requests of the network on to the node, and
+// sends the node ID of the leaving node on left once the node has evicted it.
+type leaveNetwork struct {
+	network.Network
+	lr   chan *network.LeaveRequest
+	left chan node.ID
+	done chan struct{}
+	once sync.Once
+}
+
+func newLeaveNetwork(nw network.Network) *leaveNetwork {
+	l := &leaveNetwork{
+		Network: nw,
+		lr:      make(chan *network.LeaveRequest),
+		left:    make(chan node.ID),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			var request *network.LeaveRequest
+			select {
+			case request = <-nw.LeaveRequestCh():
+			case <-l.done:
+				return
+			}
+
+			// The request is handed to the node twice, the second hand over
+			// only completes once the node is done with the first one.
+			// Evicting the node again has no effect.
+			for _, ch := range []chan *network.LeaveRequest{l.lr, l.lr} {
+				select {
+				case ch <- request:
+				case <-l.done:
+					return
+				}
+			}
+
+			select {
+			case l.left <- request.From.NodeID:
+			case <-l.done:
+				return
+			}
+		}
+	}()
+
+	return l
+}
+
+func (l *leaveNetwork) LeaveRequestCh() chan *network.LeaveRequest { return l.lr }
+
+func (l *leaveNetwork) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Network.Close()
+}
+
+// timeOut listens on the addresses of nodes that are gone, and advances the
+// clock past the network timeout whenever a packet is sent to any of them, so
+// that the requests to them time out. Requests to other nodes that are in
+// flight at the time time out as well. The returned function stops listening.
+func timeOut(t *testing.T, sb *sim.Switchboard, c *clock.Fake, addrs ...net.UDPAddr) (stop func()) {
+	var conns []net.PacketConn
+	for _, addr := range addrs {
+		conn, err := sb.Listen(addr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		conns = append(conns, conn)
+
+		go func(conn net.PacketConn) {
+			b := make([]byte, 65535)
+			for {
+				_, _, err := conn.ReadFrom(b)
+				if err != nil {
+					return // Stopped.
+				}
+
+				// The sessions are checked for timeouts every second.
+				c.Advance(network.DefaultTimeout + time.Second)
+			}
+		}(conn)
+	}
+
+	return func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// closeSimulatedDHTs closes the nodes and their networks.
+func closeSimulatedDHTs(dhts []*DHT) {
+	for _, d := range dhts {
+		d.Close()
+		d.nw.Close()
+	}
+}
+
+func TestSimulatedNetwork(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 100)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+	value := []byte("ABC, du är mina tankar")
+
+	receipt, err := dhts[10].Put(ctx, value, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, _, err := dhts[90].Get(ctx, receipt.Key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Errorf("unexpected value, got: %s (%v), exp: %s", got, err, value)
+	}
+}
+
+func TestSimulatedNetwork_forget(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	// Fewer nodes than k, so that every node is among the k closest for both
+	// the store and the delete.
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 20)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+	value := []byte("ABC, du är mina tankar")
+
+	receipt, err := dhts[10].Put(ctx, value, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Make sure that the value is available before it's deleted.
+	got, _, err := dhts[15].Get(ctx, receipt.Key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected value, got: %s (%v), exp: %s", got, err, value)
+	}
+
+	// Only the publisher is allowed to delete the value. Nodes that don't store
+	// the value may still acknowledge the tombstone, so the result is ignored.
+	_, _ = dhts[5].Forget(ctx, receipt.Key)
+	got, _, err = dhts[15].Get(ctx, receipt.Key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("expected value to remain after delete by other node, got: %s (%v)", got, err)
+	}
+
+	deleted, err := dhts[10].Forget(ctx, receipt.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted.Stored) < len(receipt.Stored) {
+		t.Errorf("deleted at fewer nodes (%d) than stored (%d)", len(deleted.Stored), len(receipt.Stored))
+	}
+
+	got, _, err = dhts[15].Get(ctx, receipt.Key)
+	if err == nil {
+		t.Errorf("expected value to be deleted, got: %s", got)
+	}
+}
+
+func TestSimulatedNetwork_forgetAfterRestart(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 10)
+	defer closeSimulatedDHTs(dhts)
+
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := node.NewKey()
+	me := route.NewContact(key.ID(), net.UDPAddr{IP: net.IP{10, 20, 1, 0}, Port: 8118})
+
+	start := func() *DHT {
+		nw, err := sb.NewNetwork(me, key, network.Config{Clock: c})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		backend, err := store.OpenDiskBackend(dir)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		d, err := New(me, []route.Contact{dhts[0].me}, nw, Config{Clock: c, Backend: backend, Publisher: key.Publisher()})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		go nw.Listen()
+
+		<-d.joined
+		return d
+	}
+
+	ctx := context.Background()
+	value := []byte("ABC, du är mina tankar")
+
+	d := start()
+	receipt, err := d.Put(ctx, value, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closeSimulatedDHTs([]*DHT{d})
+
+	// The restarted node signs the delete with the same publisher key.
+	d = start()
+	defer closeSimulatedDHTs([]*DHT{d})
+
+	_, err = d.Forget(ctx, receipt.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, _, err := dhts[5].Get(ctx, receipt.Key)
+	if err == nil {
+		t.Errorf("expected value to be deleted after the restart, got: %s", got)
+	}
+}
+
+func TestSimulatedNetwork_ttl(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 20)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+	value := []byte("ABC, du är mina tankar")
+	ttl := 500 * time.Millisecond
+
+	receipt, err := dhts[10].Put(ctx, value, ttl)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The storing nodes keep the remaining TTL of the value.
+	var stored int
+	for i, d := range dhts {
+		item, err := d.db.GetItem(receipt.Key)
+		if i == 10 || err != nil {
+			continue
+		}
+		stored++
+		if item.TTL <= 0 || item.TTL > ttl {
+			t.Errorf("unexpected TTL, got: %v, exp: (0, %v]", item.TTL, ttl)
+		}
+	}
+	if stored == 0 {
+		t.Fatal("expected value to be stored by other nodes")
+	}
+
+	got, _, err := dhts[15].Get(ctx, receipt.Key)
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("unexpected value, got: %s (%v), exp: %s", got, err, value)
+	}
+
+	c.Advance(ttl)
+
+	_, _, err = dhts[15].Get(ctx, receipt.Key)
+	if err == nil {
+		t.Error("expected value to be evicted once the TTL has passed")
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	// Without latency, no packet is left in flight once the nodes are closed.
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+
+	_, err := dhts[0].Put(context.Background(), []byte("ABC, du är mina tankar"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	closeSimulatedDHTs(dhts)
+
+	// The goroutines that are woken up by the close, e.g. to hand over the
+	// sessions that were cancelled, return as soon as they're scheduled.
+	after := runtime.NumGoroutine()
+	for i := 0; after > before && i < 1000; i++ {
+		runtime.Gosched()
+		after = runtime.NumGoroutine()
+	}
+
+	if after > before {
+		t.Errorf("leaked %d goroutines", after-before)
+	}
+}
+
+func TestGoTracked_closed(t *testing.T) {
+	dht := newDHT(t)
+
+	// The goroutine only returns once Close has been called.
+	var returned int32
+	if !dht.goTracked(func() {
+		<-dht.ctx.Done()
+		atomic.StoreInt32(&returned, 1)
+	}) {
+		t.Fatal("expected goroutine to be started")
+	}
+
+	dht.Close()
+	if atomic.LoadInt32(&returned) == 0 {
+		t.Error("expected Close to wait for the goroutine")
+	}
+
+	if dht.goTracked(func() { t.Error("unexpected goroutine after Close") }) {
+		t.Error("expected no goroutine to be started after Close")
+	}
+}
+
+func TestSimulatedNetwork_leave(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+	leaving, rest := dhts[5], append(append([]*DHT{}, dhts[:5]...), dhts[6:]...)
+	defer closeSimulatedDHTs(rest)
+
+	// Only stored at the leaving node.
+	value := []byte("ABC, du är mina tankar")
+	key := store.KeyFromValue(value)
+	err := leaving.db.AddItem(store.Item{Key: key, Value: value}, route.BucketSize+1, route.BucketSize, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Only the contacts of the leaving node are told about it.
+	told := make(map[node.ID]bool)
+	for _, contact := range leaving.rt.Contacts() {
+		told[contact.NodeID] = true
+	}
+
+	err = leaving.Leave(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	closeSimulatedDHTs([]*DHT{leaving})
+
+	knows := func(d *DHT) bool {
+		for _, contact := range d.rt.Contacts() {
+			if contact.NodeID.Equal(leaving.me.NodeID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The contacts are evicted as soon as the leave requests are received.
+	for _, d := range rest {
+		if !told[d.me.NodeID] {
+			continue
+		}
+
+		if id := <-d.nw.(*leaveNetwork).left; !id.Equal(leaving.me.NodeID) {
+			t.Errorf("unexpected leaving node, got: %v, exp: %v", id, leaving.me.NodeID)
+		}
+		if knows(d) {
+			t.Errorf("expected %v to have evicted the leaving node", d.me.NodeID)
+		}
+	}
+
+	// The hand off is acknowledged before Leave returns.
+	var stored int
+	for _, d := range rest {
+		if item, err := d.db.GetItem(key); err == nil && bytes.Equal(item.Value, value) {
+			stored++
+		}
+	}
+	if stored == 0 {
+		t.Error("expected value to be handed off")
+	}
+}
+
+func TestSimulatedNetwork_rejoin(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 8)
+	defer closeSimulatedDHTs(dhts)
+
+	key, _ := node.NewKey()
+	me := route.NewContact(key.ID(), net.UDPAddr{IP: net.IP{10, 20, 1, 0}, Port: 8118})
+
+	// The saved contacts are pinged one at a time, so that no other ping is in
+	// flight when the ping of a contact that is gone times out.
+	start := func(others []route.Contact) *DHT {
+		nw, err := sb.NewNetwork(me, key, network.Config{Clock: c})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		d, err := New(me, others, nw, Config{Clock: c, Alpha: 1, RoutesFile: path})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		go nw.Listen()
+
+		<-d.joined
+		return d
+	}
+
+	d := start([]route.Contact{dhts[0].me})
+
+	// The routing table is saved when the node is closed, along with a
+	// contact that has left since it was seen.
+	gone := route.NewContact(node.NewID(), net.UDPAddr{IP: net.IP{10, 20, 2, 0}, Port: 8118})
+	d.rt.Add(gone)
+	closeSimulatedDHTs([]*DHT{d})
+
+	stop := timeOut(t, sb, c, gone.Address)
+	defer stop()
+
+	// The bootstrap contact doesn't exist, the node only knows of the nodes
+	// from the snapshot.
+	d = start([]route.Contact{{Address: net.UDPAddr{IP: net.IP{10, 20, 3, 0}, Port: 8118}}})
+
+	knows := func(id node.ID) bool {
+		for _, c := range d.rt.Contacts() {
+			if c.NodeID.Equal(id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The saved contact that doesn't answer is removed.
+	if knows(gone.NodeID) {
+		t.Error("expected saved contact that left to be removed")
+	}
+	for _, other := range dhts {
+		if !knows(other.me.NodeID) {
+			t.Errorf("expected saved contact to be kept: %v", other.me.NodeID)
+		}
+	}
+
+	closeSimulatedDHTs([]*DHT{d})
+
+	saved, err := route.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range saved {
+		if c.NodeID.Equal(gone.NodeID) {
+			t.Error("unexpected saved contact that left")
+		}
+	}
+	if len(saved) < len(dhts) {
+		t.Errorf("unexpected number of saved contacts, got: %d, exp: at least %d", len(saved), len(dhts))
+	}
+}
+
+func TestSimulatedNetwork_bootstrap(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 5)
+	defer closeSimulatedDHTs(dhts)
+
+	key, _ := node.NewKey()
+	me := route.NewContact(key.ID(), net.UDPAddr{IP: net.IP{10, 20, 1, 0}, Port: 8118})
+	nw, err := sb.NewNetwork(me, key, network.Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The first seed doesn't exist, and only the address of the second seed
+	// is known. The node itself is skipped.
+	seeds := []route.Contact{
+		{Address: net.UDPAddr{IP: net.IP{10, 20, 2, 0}, Port: 8118}},
+		me,
+		{Address: dhts[2].me.Address},
+	}
+	stop := timeOut(t, sb, c, seeds[0].Address)
+	defer stop()
+
+	d, err := New(me, seeds, nw, Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeSimulatedDHTs([]*DHT{d})
+	go nw.Listen()
+
+	<-d.joined
+
+	contacts := d.rt.Contacts()
+	if len(contacts) < len(dhts) {
+		t.Fatalf("expected node to join through the address, got %d contacts", len(contacts))
+	}
+	for _, c := range contacts {
+		if c.NodeID == (node.ID{}) {
+			t.Errorf("unexpected contact without node ID: %v", c.Address.String())
+		}
+	}
+}
+
+// timerClock sends the duration of every timer that is created on timers, so
+// that the clock is only advanced once the node waits for the timer.
+type timerClock struct {
+	*clock.Fake
+	timers chan time.Duration
+}
+
+func (c timerClock) NewTimer(d time.Duration) *clock.Timer {
+	timer := c.Fake.NewTimer(d)
+	c.timers <- d
+	return timer
+}
+
+func TestSimulatedNetwork_joinBackoff(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	// The node may start one more timer as it's closed, which is never read.
+	c := timerClock{Fake: newFakeClock(), timers: make(chan time.Duration, 1)}
+
+	key, _ := node.NewKey()
+	me := route.NewContact(key.ID(), net.UDPAddr{IP: net.IP{10, 20, 1, 0}, Port: 8118})
+	nw, err := sb.NewNetwork(me, key, network.Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	seedKey, _ := node.NewKey()
+	seed := route.NewContact(seedKey.ID(), net.UDPAddr{IP: net.IP{10, 20, 2, 0}, Port: 8118})
+	stop := timeOut(t, sb, c.Fake, seed.Address)
+
+	d, err := New(me, []route.Contact{seed}, nw, Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeSimulatedDHTs([]*DHT{d})
+	go nw.Listen()
+
+	// The node retries on the fake clock while the seed is down, waiting twice
+	// as long after every failed attempt.
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		wait := <-c.timers
+		waits = append(waits, wait)
+		c.Advance(wait)
+	}
+	for i := 1; i < len(waits); i++ {
+		if waits[i] != 2*waits[i-1] {
+			t.Errorf("unexpected backoff, got: %v, exp: %v", waits[i], 2*waits[i-1])
+		}
+	}
+
+	// The seed comes up while the node waits before the next attempt.
+	wait := <-c.timers
+	stop()
+
+	seedNw, err := sb.NewNetwork(seed, seedKey, network.Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err := New(seed, nil, seedNw, Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeSimulatedDHTs([]*DHT{s})
+	go seedNw.Listen()
+	<-s.joined
+
+	c.Advance(wait)
+	<-d.joined
+
+	if len(s.rt.Contacts()) == 0 {
+		t.Error("expected node to join once the seed is up")
+	}
+}
+
+func TestSimulatedNetwork_ping(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 5)
+	defer closeSimulatedDHTs(dhts)
+
+	d, target := dhts[1], dhts[3].me
+
+	// The node is looked up if it's not in the routing table.
+	d.rt.Remove(target.NodeID)
+	chal, err := d.Ping(context.Background(), target.NodeID)
+	if err != nil || len(chal) == 0 {
+		t.Fatalf("unexpected ping result, got: %x (%v)", chal, err)
+	}
+
+	_, err = d.Ping(context.Background(), node.NewID())
+	if err == nil {
+		t.Error("expected error when pinging unknown node")
+	}
+
+	// The node ID is learned from the address.
+	d.rt.Remove(target.NodeID)
+	id, chal, err := d.PingAddress(context.Background(), target.Address)
+	if err != nil || len(chal) == 0 {
+		t.Fatalf("unexpected ping result, got: %x (%v)", chal, err)
+	}
+	if !id.Equal(target.NodeID) {
+		t.Errorf("unexpected node ID, got: %v, exp: %v", id, target.NodeID)
+	}
+
+	if closest := d.rt.NClosest(target.NodeID, 1).SortedContacts(); !closest[0].NodeID.Equal(target.NodeID) {
+		t.Error("expected pinged node to be added to the routing table")
+	}
+
+	missing := net.UDPAddr{IP: net.IP{10, 20, 2, 0}, Port: 8118}
+	stop := timeOut(t, sb, c, missing)
+	defer stop()
+
+	_, _, err = d.PingAddress(context.Background(), missing)
+	if err == nil {
+		t.Error("expected error when pinging missing address")
+	}
+}
+
+func TestSimulatedNetwork_evictFailing(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	sb.SetDefaultLink(sim.Link{Latency: time.Millisecond, Jitter: time.Millisecond})
+
+	c := newFakeClock()
+	dhts := newSimulatedDHTs(t, sb, c, 5)
+	dead, rest := dhts[4], dhts[:4]
+	defer closeSimulatedDHTs(rest)
+
+	key, _ := node.NewKey()
+	me := route.NewContact(key.ID(), net.UDPAddr{IP: net.IP{10, 20, 1, 0}, Port: 8118})
+	nw, err := sb.NewNetwork(me, key, network.Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d, err := New(me, []route.Contact{dhts[0].me}, nw, Config{Clock: c, MaxFailures: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer closeSimulatedDHTs([]*DHT{d})
+	go nw.Listen()
+
+	knows := func(id node.ID) bool {
+		for _, contact := range d.rt.Contacts() {
+			if contact.NodeID.Equal(id) {
+				return true
+			}
+		}
+		return false
+	}
+
+	<-d.joined
+	if !knows(dead.me.NodeID) {
+		t.Fatal("expected node to learn of the other node")
+	}
+
+	// Every lookup of the node times out once.
+	closeSimulatedDHTs([]*DHT{dead})
+	stop := timeOut(t, sb, c, dead.me.Address)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		d.iterativeFindNodes(context.Background(), dead.me.NodeID)
+	}
+	if knows(dead.me.NodeID) {
+		t.Error("expected node to be evicted after repeated timeouts")
+	}
+}
+
+func TestSimulatedNetwork_storeTooLarge(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 5)
+	defer closeSimulatedDHTs(dhts)
+
+	// Bypass the check in Put, the other nodes must refuse the value.
+	value := make([]byte, DefaultMaxValueSize+1)
+	item := store.Item{Key: store.KeyFromValue(value), Value: value}
+	receipt, err := dhts[0].iterativeStore(context.Background(), item, network.StoreClassPublish)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(receipt.Stored) != 0 {
+		t.Errorf("expected no node to store the value, stored at: %v", receipt.Stored)
+	}
+	for _, d := range dhts[1:] {
+		if _, err := d.db.GetItem(item.Key); err == nil {
+			t.Errorf("unexpected value stored at: %v", d.me.NodeID)
+		}
+	}
+}
+
+func TestSimulatedNetwork_record(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	first := store.NewRecord(privateKey, salt, 1, []byte("first"))
+	second := store.NewRecord(privateKey, salt, 2, []byte("second"))
+
+	_, err := dhts[1].PutRecord(ctx, first)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Updated in place, by another node.
+	_, err = dhts[2].PutRecord(ctx, second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The stale record is refused by every node.
+	receipt, err := dhts[1].PutRecord(ctx, first)
+	if err == nil {
+		t.Errorf("expected error for stale record, stored at: %v", receipt.Stored)
+	}
+
+	got, _, err := dhts[8].GetRecord(ctx, first.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Record.Seq != 2 || !bytes.Equal(got.Value, second.Value) {
+		t.Errorf("unexpected record, got: %s (seq %d), exp: %s (seq 2)", got.Value, got.Record.Seq, second.Value)
+	}
+
+	// Records are not found as immutable values.
+	_, _, err = dhts[8].Get(ctx, first.Key)
+	if err == nil {
+		t.Error("expected error for record looked up as an immutable value")
+	}
+}
+
+func TestSimulatedNetwork_compareAndSwap(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	_, err := dhts[1].PutRecord(ctx, store.NewRecord(privateKey, salt, 1, []byte("first")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Two writers have both read the first record.
+	mine := store.NewRecord(privateKey, salt, 2, []byte("mine"))
+	theirs := store.NewRecord(privateKey, salt, 2, []byte("theirs"))
+
+	_, err = dhts[2].CompareAndSwap(ctx, mine, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	receipt, err := dhts[3].CompareAndSwap(ctx, theirs, 1)
+	if !errors.Is(err, store.ErrConflict) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, store.ErrConflict)
+	}
+	if len(receipt.Conflicted) == 0 || receipt.Seq != 2 {
+		t.Errorf("unexpected receipt: %v", receipt)
+	}
+
+	got, _, err := dhts[8].GetRecord(ctx, mine.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.Value, mine.Value) {
+		t.Errorf("unexpected value, got: %s, exp: %s", got.Value, mine.Value)
+	}
+
+	// The loser retries with the sequence number of the winner.
+	_, err = dhts[3].CompareAndSwap(ctx, store.NewRecord(privateKey, salt, 3, []byte("theirs")), receipt.Seq)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSimulatedNetwork_providers(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+	key := store.KeyFromValue([]byte("ABC, du är mina tankar"))
+
+	for _, i := range []int{1, 2} {
+		receipt, err := dhts[i].Provide(ctx, key)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !receipt.Provided {
+			t.Error("expected receipt of a provider announcement")
+		}
+	}
+
+	providers, err := dhts[8].FindProviders(ctx, key, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	found := make(map[node.ID]bool)
+	for _, provider := range providers {
+		found[provider.NodeID] = true
+	}
+	if len(providers) != 2 || !found[dhts[1].me.NodeID] || !found[dhts[2].me.NodeID] {
+		t.Errorf("unexpected providers, got: %v, exp: %v and %v", providers, dhts[1].me.NodeID, dhts[2].me.NodeID)
+	}
+
+	providers, err = dhts[8].FindProviders(ctx, key, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(providers) != 1 {
+		t.Errorf("unexpected number of providers, got: %d, exp: %d", len(providers), 1)
+	}
+
+	_, err = dhts[8].FindProviders(ctx, store.Key{1}, 0)
+	if err == nil {
+		t.Error("expected error for key without providers")
+	}
 }
@@ -1,6 +1,10 @@
 package dht
 
 import (
+	"errors"
+	"net"
+
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/route"
@@ -10,43 +14,71 @@ import (
 
 func (dht *DHT) refreshRequestHandler() {
 	for {
-		index := <-dht.rt.RefreshCh()
+		var index int
+		select {
+		case index = <-dht.rt.RefreshCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Info().Msgf("Refresh request for bucket: %d", index)
 
 		id := node.NewIDWithPrefix(dht.me.NodeID, index)
 
-		_, err := dht.iterativeFindNodes(id)
+		_, err := dht.iterativeFindNodes(dht.ctx, id)
 		if err != nil {
 			log.Error().Err(err).Msgf("Refresh failed for bucket: %d using random ID: %v", index, id)
 		}
 	}
 }
 
+// snapshotHandler saves the routing table to the routes file at every tick, so
+// that a node that crashes can still warm-start from a recent snapshot.
+func (dht *DHT) snapshotHandler(ticker *clock.Ticker) {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-dht.ctx.Done():
+			return
+		}
+
+		dht.saveRoutes()
+	}
+}
+
 func (dht *DHT) findValueRequestHandler() {
 	for {
-		request := <-dht.nw.FindValueRequestCh()
+		var request *network.FindValueRequest
+		select {
+		case request = <-dht.nw.FindValueRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Info().Msgf("Find value request from: %v", request.From.NodeID)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		dht.addNode(request.From)
 
 		var closest []route.Contact
 		target := node.ID(request.Key)
 
 		// Try to fetch the value from the local storage.
 		item, err := dht.db.GetItem(request.Key)
-		if err != nil {
+		found := err == nil
+		if !found {
 			// No luck.
 			// Fetch this nodes contacts that are closest to the requested key.
-			closest = dht.rt.NClosest(target, k).SortedContacts()
+			closest = dht.rt.NClosest(target, dht.cfg.K).SortedContacts()
+			item.Key = request.Key
 		} else {
-			log.Info().Msgf("Found value: %s", item.Value)
+			log.Info().Msgf("Found value: %v", item)
 		}
 
-		err = dht.nw.SendValue(request.Key, item.Value, closest, request.SessionID, request.From.Address)
+		err = dht.nw.SendValue(item, found, closest, request.SessionID, request.From.Address)
 		if err != nil {
 			log.Error().Err(err).Msgf("Send value network call failed for: %v", request.From.Address)
 		}
@@ -55,16 +87,21 @@ func (dht *DHT) findValueRequestHandler() {
 
 func (dht *DHT) findNodesRequestHandler() {
 	for {
-		request := <-dht.nw.FindNodesRequestCh()
+		var request *network.FindNodesRequest
+		select {
+		case request = <-dht.nw.FindNodesRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Info().Msgf("Find node request from: %v", request.From.NodeID)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		dht.addNode(request.From)
 
 		// Fetch this nodes contacts that are closest to the requested target.
-		closest := dht.rt.NClosest(request.Target, k).SortedContacts()
+		closest := dht.rt.NClosest(request.Target, dht.cfg.K).SortedContacts()
 
 		err := dht.nw.SendNodes(closest, request.SessionID, request.From.Address)
 		if err != nil {
@@ -75,13 +112,18 @@ func (dht *DHT) findNodesRequestHandler() {
 
 func (dht *DHT) storeRequestHandler() {
 	for {
-		request := <-dht.nw.StoreRequestCh()
+		var request *network.StoreRequest
+		select {
+		case request = <-dht.nw.StoreRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Info().Msgf("Store value request from: %v", request.From.NodeID)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		dht.addNode(request.From)
 
 		var touch bool
 		switch request.Class {
@@ -92,21 +134,138 @@ func (dht *DHT) storeRequestHandler() {
 		}
 
 		key := store.KeyFromValue(request.Value)
+		if request.Record != nil {
+			key = request.Key // Verified by the database.
+		}
+
+		err := dht.checkValueSize(request.Value)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Refused to store value with hash: %v", key)
+			dht.refuse(key, request.SessionID, request.From.Address)
+			continue
+		}
+
 		centrality := dht.rt.Centrality(node.ID(key))
 
-		dht.db.AddItem(key, request.Value, centrality, k, touch)
+		if request.Record != nil {
+			record := store.Item{
+				Key:       key,
+				Value:     request.Value,
+				Publisher: request.Publisher,
+				Record:    request.Record,
+				TTL:       request.TTL,
+			}
+
+			if !request.CAS {
+				err = dht.db.AddRecord(record, centrality, dht.cfg.K, touch)
+			} else {
+				var seq uint64
+				seq, err = dht.db.SwapRecord(record, request.Expected, centrality, dht.cfg.K)
+				if errors.Is(err, store.ErrConflict) {
+					log.Info().Msgf("Rejected record with key %v, expected sequence number %d but has %d", key, request.Expected, seq)
+
+					err = dht.nw.SendStoreConflict(key, seq, request.SessionID, request.From.Address)
+					if err != nil {
+						log.Error().Err(err).Msgf("Store conflict network call failed for: %v", request.From.Address)
+					}
+					continue
+				}
+			}
+		} else if request.CAS {
+			err = errors.New("compare-and-swap of immutable value")
+		} else {
+			item := store.Item{
+				Key:       key,
+				Value:     request.Value,
+				Publisher: request.Publisher,
+				Published: request.Published,
+				Signature: request.Signature,
+				TTL:       request.TTL,
+			}
+			err = dht.db.AddItem(item, centrality, dht.cfg.K, touch)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Refused to store value with hash: %v", key)
+			dht.refuse(key, request.SessionID, request.From.Address)
+			continue
+		}
+
+		err = dht.nw.SendStoreAck(key, request.SessionID, request.From.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Store acknowledgement network call failed for: %v", request.From.Address)
+		}
+	}
+}
+
+// refuse answers a store or delete request that was refused, so that the
+// requester doesn't wait for the request to time out.
+func (dht *DHT) refuse(key store.Key, sessionID network.SessionID, addr net.UDPAddr) {
+	err := dht.nw.SendStoreRefusal(key, sessionID, addr)
+	if err != nil {
+		log.Error().Err(err).Msgf("Store refusal network call failed for: %v", addr)
+	}
+}
+
+func (dht *DHT) deleteRequestHandler() {
+	for {
+		var request *network.DeleteRequest
+		select {
+		case request = <-dht.nw.DeleteRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		log.Info().Msgf("Delete value request from: %v", request.From.NodeID)
+
+		// Add node so it is moved to the top of its bucket in the routing
+		// table.
+		dht.addNode(request.From)
+
+		key := request.Tombstone.Key
+
+		err := dht.db.AddTombstone(request.Tombstone)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Refused to delete value with hash: %v", key)
+			dht.refuse(key, request.SessionID, request.From.Address)
+			continue
+		}
+
+		err = dht.nw.SendStoreAck(key, request.SessionID, request.From.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Delete acknowledgement network call failed for: %v", request.From.Address)
+		}
+	}
+}
+
+func (dht *DHT) leaveRequestHandler() {
+	for {
+		var request *network.LeaveRequest
+		select {
+		case request = <-dht.nw.LeaveRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		log.Info().Msgf("Leave request from: %v", request.From.NodeID)
+
+		dht.evict(request.From.NodeID)
 	}
 }
 
 func (dht *DHT) pongRequestHandler() {
 	for {
-		request := <-dht.nw.PongRequestCh()
+		var request *network.PongRequest
+		select {
+		case request = <-dht.nw.PongRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Info().Msgf("Pong request from: %v (%x)", request.From.NodeID, request.Challenge)
 
 		// Add node so it is moved to the top of its bucket in the routing
 		// table.
-		go dht.addNode(request.From)
+		dht.addNode(request.From)
 
 		err := dht.nw.Pong(
 			request.Challenge,
@@ -120,11 +279,16 @@ func (dht *DHT) pongRequestHandler() {
 
 func (dht *DHT) replicateRequestHandler() {
 	for {
-		item := <-dht.db.ReplicateCh()
+		var item store.Item
+		select {
+		case item = <-dht.db.ReplicateCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Debug().Msgf("Replicate request on value: %v", item)
 
-		_, err := dht.iterativeStore(item.Value, network.StoreClassReplicate)
+		_, err := dht.iterativeStore(dht.ctx, item, network.StoreClassReplicate)
 		if err != nil {
 			log.Error().Err(err).Msgf("Replicate event failed for value: %v", item)
 		}
@@ -133,13 +297,93 @@ func (dht *DHT) replicateRequestHandler() {
 
 func (dht *DHT) republishRequestHandler() {
 	for {
-		item := <-dht.db.RepublishCh()
+		var item store.Item
+		select {
+		case item = <-dht.db.RepublishCh():
+		case <-dht.ctx.Done():
+			return
+		}
 
 		log.Debug().Msgf("Republish request on value: %v", item)
 
-		_, err := dht.iterativeStore(item.Value, network.StoreClassPublish)
+		// Local items are always published by this node, except for records
+		// that are signed by their publisher.
+		if item.Record == nil {
+			item = store.SignItem(item, dht.publisher, dht.clock.Now())
+		}
+
+		_, err := dht.iterativeStore(dht.ctx, item, network.StoreClassPublish)
 		if err != nil {
 			log.Error().Err(err).Msgf("Republish event failed for value: %v", item)
 		}
 	}
 }
+
+func (dht *DHT) addProviderRequestHandler() {
+	for {
+		var request *network.AddProviderRequest
+		select {
+		case request = <-dht.nw.AddProviderRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		log.Info().Msgf("Add provider request from: %v", request.From.NodeID)
+
+		// Add node so it is moved to the top of its bucket in the routing
+		// table.
+		dht.addNode(request.From)
+
+		dht.db.AddProvider(request.Key, request.From, dht.cfg.K)
+
+		err := dht.nw.SendStoreAck(request.Key, request.SessionID, request.From.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Add provider acknowledgement network call failed for: %v", request.From.Address)
+		}
+	}
+}
+
+func (dht *DHT) getProvidersRequestHandler() {
+	for {
+		var request *network.GetProvidersRequest
+		select {
+		case request = <-dht.nw.GetProvidersRequestCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		log.Info().Msgf("Get providers request from: %v", request.From.NodeID)
+
+		// Add node so it is moved to the top of its bucket in the routing
+		// table.
+		dht.addNode(request.From)
+
+		// The closest contacts are always sent, as other nodes may know of
+		// more providers.
+		providers := dht.db.Providers(request.Key, dht.cfg.K)
+		closest := dht.rt.NClosest(node.ID(request.Key), dht.cfg.K).SortedContacts()
+
+		err := dht.nw.SendProviders(request.Key, providers, closest, request.SessionID, request.From.Address)
+		if err != nil {
+			log.Error().Err(err).Msgf("Get providers network call failed for: %v", request.From.Address)
+		}
+	}
+}
+
+func (dht *DHT) reprovideRequestHandler() {
+	for {
+		var key store.Key
+		select {
+		case key = <-dht.db.ReprovideCh():
+		case <-dht.ctx.Done():
+			return
+		}
+
+		log.Debug().Msgf("Reprovide request on key: %v", key)
+
+		_, err := dht.iterativeProvide(dht.ctx, key)
+		if err != nil {
+			log.Error().Err(err).Msgf("Reprovide event failed for key: %v", key)
+		}
+	}
+}
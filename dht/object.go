@@ -0,0 +1,290 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/optmzr/d7024e-dht/packet"
+	"github.com/optmzr/d7024e-dht/store"
+)
+
+const manifestVersion = 1
+
+// manifestOverhead is the largest encoded size of the fields of a manifest
+// other than the keys, i.e. a tag byte and the largest varint of each of the
+// version, depth and size. manifestKeySize is the encoded size of every key.
+const manifestOverhead = 1 + binary.MaxVarintLen32 + 1 + binary.MaxVarintLen32 + 1 + binary.MaxVarintLen64
+const manifestKeySize = 2 + len(store.Key{})
+
+// maxManifestDepth limits the depth of the manifests that are followed, so
+// that a forged manifest can't make the lookup recurse forever.
+const maxManifestDepth = 8
+
+// objectParallelism is the number of chunks or manifests that are stored or
+// fetched at the same time.
+const objectParallelism = 8
+
+// ErrNotObject is returned when the value of a key is not an object manifest.
+var ErrNotObject = errors.New("value is not an object manifest")
+
+// PutObject splits the content of the reader into chunks of the maximum value
+// size, and stores every chunk at the network. The keys of the chunks are
+// stored in a tree of manifests, and the returned receipt is the receipt of the
+// root manifest, whose key is the key of the object.
+func (dht *DHT) PutObject(ctx context.Context, r io.Reader) (receipt Receipt, err error) {
+	fanout := (dht.cfg.MaxValueSize - manifestOverhead) / manifestKeySize
+	if fanout < 2 {
+		err = fmt.Errorf("max value size of %d bytes is too small for objects", dht.cfg.MaxValueSize)
+		return
+	}
+
+	var keys []store.Key
+	var sizes []uint64
+
+	for eof := false; !eof; {
+		var chunks [][]byte
+		for len(chunks) < objectParallelism {
+			chunk := make([]byte, dht.cfg.MaxValueSize)
+			n, e := io.ReadFull(r, chunk)
+			if e == io.EOF || e == io.ErrUnexpectedEOF {
+				eof = true
+			} else if e != nil {
+				err = fmt.Errorf("cannot read object: %w", e)
+				return
+			}
+
+			if n > 0 {
+				chunks = append(chunks, chunk[:n])
+			}
+			if eof {
+				break
+			}
+		}
+
+		var stored []store.Key
+		stored, err = dht.putAll(ctx, chunks)
+		if err != nil {
+			return
+		}
+
+		keys = append(keys, stored...)
+		for _, chunk := range chunks {
+			sizes = append(sizes, uint64(len(chunk)))
+		}
+	}
+
+	// Group the keys into manifests until they fit in the root manifest.
+	var depth uint32
+	for ; len(keys) > fanout; depth++ {
+		var manifests [][]byte
+		var manifestSizes []uint64
+		for i := 0; i < len(keys); i += fanout {
+			end := i + fanout
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			m, size := newManifest(depth, keys[i:end], sizes[i:end])
+			manifests = append(manifests, m)
+			manifestSizes = append(manifestSizes, size)
+		}
+
+		keys, err = dht.putAll(ctx, manifests)
+		if err != nil {
+			return
+		}
+		sizes = manifestSizes
+	}
+
+	root, _ := newManifest(depth, keys, sizes)
+	return dht.Put(ctx, root, 0)
+}
+
+// GetObject fetches the object with the key, i.e. the key of its root
+// manifest. The chunks are fetched in the background while the returned reader
+// is read, and every chunk is verified against its key. The reader must be read
+// until EOF or closed, otherwise the fetching is never finished.
+func (dht *DHT) GetObject(ctx context.Context, key store.Key) (io.ReadCloser, error) {
+	values, err := dht.getAll(ctx, []store.Key{key})
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parseManifest(values[0])
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(dht.writeManifest(ctx, pw, root))
+	}()
+
+	return pr, nil
+}
+
+// writeManifest writes the part of the object below the manifest to the
+// writer.
+func (dht *DHT) writeManifest(ctx context.Context, w io.Writer, m *packet.Manifest) error {
+	if m.Depth > maxManifestDepth {
+		return fmt.Errorf("manifest depth %d exceeds the max depth of %d", m.Depth, maxManifestDepth)
+	}
+
+	keys := make([]store.Key, len(m.Keys))
+	for i, k := range m.Keys {
+		if len(k) != len(store.Key{}) {
+			return fmt.Errorf("%w: invalid key size: %d", ErrNotObject, len(k))
+		}
+		copy(keys[i][:], k)
+	}
+
+	var written uint64
+	for i := 0; i < len(keys); i += objectParallelism {
+		end := i + objectParallelism
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		values, err := dht.getAll(ctx, keys[i:end])
+		if err != nil {
+			return err
+		}
+
+		for _, value := range values {
+			if m.Depth == 0 {
+				written += uint64(len(value))
+				if written > m.Size {
+					return fmt.Errorf("object is larger than its manifest size of %d bytes", m.Size)
+				}
+
+				_, err = w.Write(value)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			child, err := parseManifest(value)
+			if err != nil {
+				return err
+			}
+			if child.Depth != m.Depth-1 {
+				return fmt.Errorf("%w: unexpected depth %d below depth %d", ErrNotObject, child.Depth, m.Depth)
+			}
+
+			written += child.Size
+			if written > m.Size {
+				return fmt.Errorf("object is larger than its manifest size of %d bytes", m.Size)
+			}
+
+			err = dht.writeManifest(ctx, w, child)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if written != m.Size {
+		return fmt.Errorf("object of %d bytes does not match its manifest size of %d bytes", written, m.Size)
+	}
+	return nil
+}
+
+// putAll stores the values in parallel and returns their keys, in the same
+// order as the values.
+func (dht *DHT) putAll(ctx context.Context, values [][]byte) ([]store.Key, error) {
+	keys := make([]store.Key, len(values))
+	errs := make([]error, len(values))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, objectParallelism)
+	for i, value := range values {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, value []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			receipt, err := dht.Put(ctx, value, 0)
+			keys[i], errs[i] = receipt.Key, err
+		}(i, value)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// getAll fetches the values of the keys in parallel, in the same order as the
+// keys. Every value is verified against its key.
+func (dht *DHT) getAll(ctx context.Context, keys []store.Key) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key store.Key) {
+			defer wg.Done()
+
+			value, _, err := dht.Get(ctx, key)
+			if err == nil && store.KeyFromValue(value) != key {
+				err = fmt.Errorf("chunk does not match its key: %v", key)
+			}
+			values[i], errs[i] = value, err
+		}(i, key)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// newManifest encodes the manifest of the keys, and returns it along with the
+// size of the part of the object below it.
+func newManifest(depth uint32, keys []store.Key, sizes []uint64) ([]byte, uint64) {
+	m := &packet.Manifest{
+		Version: manifestVersion,
+		Depth:   depth,
+	}
+
+	for i := range keys {
+		m.Keys = append(m.Keys, keys[i][:])
+		m.Size += sizes[i]
+	}
+
+	// Cannot fail, the manifest only contains valid fields.
+	b, _ := proto.Marshal(m)
+	return b, m.Size
+}
+
+// parseManifest decodes a manifest, ErrNotObject is returned if the value is
+// not a manifest.
+func parseManifest(value []byte) (*packet.Manifest, error) {
+	m := new(packet.Manifest)
+	err := proto.Unmarshal(value, m)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotObject, err)
+	}
+
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("%w: unsupported version: %d", ErrNotObject, m.Version)
+	}
+	return m, nil
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math"
+	"math/rand" // Insecure on purpose due to testing.
+	"testing"
+
+	"github.com/optmzr/d7024e-dht/network/sim"
+	"github.com/optmzr/d7024e-dht/store"
+)
+
+func TestManifest(t *testing.T) {
+	keys := []store.Key{{1}, {2}, {3}}
+	sizes := []uint64{1000, 1000, 10}
+
+	b, size := newManifest(1, keys, sizes)
+	if size != 2010 {
+		t.Errorf("unexpected size, got: %d, exp: %d", size, 2010)
+	}
+
+	// A full manifest fits in a value even if its fields take their largest
+	// encoded size.
+	for _, maxValueSize := range []int{DefaultMaxValueSize, 1000, manifestOverhead + 2*manifestKeySize} {
+		fanout := (maxValueSize - manifestOverhead) / manifestKeySize
+		sizes := make([]uint64, fanout)
+		sizes[0] = math.MaxUint64
+		full, _ := newManifest(math.MaxUint32, make([]store.Key, fanout), sizes)
+		if len(full) > maxValueSize {
+			t.Errorf("manifest of %d keys is larger than the max value size: %d > %d bytes", fanout, len(full), maxValueSize)
+		}
+	}
+
+	m, err := parseManifest(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.Depth != 1 || m.Size != 2010 || len(m.Keys) != len(keys) {
+		t.Errorf("unexpected manifest: %v", m)
+	}
+	for i, k := range m.Keys {
+		if !bytes.Equal(k, keys[i][:]) {
+			t.Errorf("unexpected key, got: %x, exp: %x", k, keys[i])
+		}
+	}
+
+	_, err = parseManifest([]byte("ABC, du är mina tankar"))
+	if !errors.Is(err, ErrNotObject) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrNotObject)
+	}
+}
+
+func TestSimulatedNetwork_object(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 10)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+
+	for _, size := range []int{0, 10, DefaultMaxValueSize, 40 * DefaultMaxValueSize} {
+		object := make([]byte, size)
+		rand.Read(object)
+
+		receipt, err := dhts[1].PutObject(ctx, bytes.NewReader(object))
+		if err != nil {
+			t.Fatalf("unexpected error for object of %d bytes: %v", size, err)
+		}
+
+		r, err := dhts[8].GetObject(ctx, receipt.Key)
+		if err != nil {
+			t.Fatalf("unexpected error for object of %d bytes: %v", size, err)
+		}
+
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("unexpected error for object of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, object) {
+			t.Errorf("unexpected object of %d bytes, got %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestSimulatedNetwork_objectForged(t *testing.T) {
+	sb := sim.NewSwitchboard(1)
+	dhts := newSimulatedDHTs(t, sb, newFakeClock(), 5)
+	defer closeSimulatedDHTs(dhts)
+
+	ctx := context.Background()
+
+	chunk := []byte("ABC, du är mina tankar")
+	receipt, err := dhts[1].Put(ctx, chunk, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The manifest claims a larger object than its chunks.
+	forged, _ := newManifest(0, []store.Key{receipt.Key}, []uint64{uint64(len(chunk) + 1)})
+	receipt, err = dhts[1].Put(ctx, forged, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r, err := dhts[3].GetObject(ctx, receipt.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer r.Close()
+
+	_, err = ioutil.ReadAll(r)
+	if err == nil {
+		t.Error("expected error for object that does not match its manifest")
+	}
+
+	// A plain value is not an object.
+	_, err = dhts[3].GetObject(ctx, store.KeyFromValue(chunk))
+	if !errors.Is(err, ErrNotObject) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrNotObject)
+	}
+}
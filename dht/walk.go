@@ -1,7 +1,10 @@
 package dht
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/optmzr/d7024e-dht/network"
 	"github.com/optmzr/d7024e-dht/node"
@@ -12,6 +15,7 @@ import (
 type awaitChannel struct {
 	ch     chan network.FindResult
 	callee route.Contact
+	sent   time.Time
 }
 
 type awaitResult struct {
@@ -19,19 +23,25 @@ type awaitResult struct {
 	callee route.Contact
 }
 
-func (dht *DHT) walk(call Call) ([]route.Contact, error) {
+// walk performs an iterative lookup using the provided call. The walk is
+// aborted, and the context error returned, as soon as the context is done.
+func (dht *DHT) walk(ctx context.Context, call Call) ([]route.Contact, error) {
 	nw := dht.nw
 	me := dht.me
 	target := call.Target()
 
 	// The first α contacts selected are used to create a *shortlist* for the
 	// search.
-	sl := dht.rt.NClosest(target, α)
+	sl := dht.rt.NClosest(target, dht.cfg.Alpha)
 
 	// Keep a map of contacts that has been sent to, to make sure we do not
 	// contact the same node multiple times.
 	sent := make(map[node.ID]bool)
 
+	// Keep a map of misbehaving contacts, so that they're not added back to
+	// the shortlist by the responses of other contacts.
+	bad := make(map[node.ID]bool)
+
 	// If a cycle results in an unchanged `closest` node, then a FindNode
 	// network call should be made to each of the closest nodes that has not
 	// already been queried.
@@ -49,19 +59,23 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 	closest := contacts[0]
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		// Holds a slice of channels that are awaiting a response from the
 		// network.
 		await := []awaitChannel{}
 
 		for i, contact := range contacts {
-			if i >= α && !rest {
+			if i >= dht.cfg.Alpha && !rest {
 				break // Limit to α contacts per shortlist.
 			}
 			if sent[contact.NodeID] || contact.NodeID.Equal(me.NodeID) {
 				continue // Ignore already contacted contacts or local node.
 			}
 
-			ch, err := call.Do(nw, contact.Address)
+			ch, err := call.Do(ctx, nw, contact.Address)
 			if err != nil {
 				log.Error().Err(err).Msgf("Unable to dial: %v, removing from candidates...", contact.NodeID)
 
@@ -71,45 +85,76 @@ func (dht *DHT) walk(call Call) ([]route.Contact, error) {
 				sent[contact.NodeID] = true
 
 				// Add to await channel queue.
-				await = append(await, awaitChannel{ch: ch, callee: contact})
+				await = append(await, awaitChannel{ch: ch, callee: contact, sent: dht.clock.Now()})
 			}
 		}
 
-		results := make(chan awaitResult)
+		// Buffered so that the goroutines below never block if the walk is
+		// aborted before all the responses are read.
+		results := make(chan awaitResult, len(await))
 		for _, ac := range await {
 			go func(ac awaitChannel) {
 				// Redirect all responses to the results channel.
 				r := <-ac.ch
-				results <- awaitResult{result: r, callee: ac.callee}
+				callee := ac.callee
+				callee.RTT = dht.clock.Now().Sub(ac.sent)
+				results <- awaitResult{result: r, callee: callee}
 			}(ac)
 		}
 
 		// Iterate through every result from the responding nodes and add their
 		// closest contacts to the shortlist.
 		for i := 0; i < len(await); i++ {
-			ac := <-results
+			var ac awaitResult
+			select {
+			case ac = <-results:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+
 			result := ac.result
 			callee := ac.callee
 
 			if result != nil {
+				// Update callee with intermediate results.
+				stop, err := call.Result(result, callee)
+				if err != nil {
+					// The callee is misbehaving, neither the callee nor its
+					// closest contacts can be trusted.
+					log.Warn().Err(err).Msgf("Misbehaving response from: %v (%v), removing from candidates...", callee.NodeID, callee.Address)
+					atomic.AddUint64(&dht.stats.Misbehaving, 1)
+
+					bad[callee.NodeID] = true
+					sl.Remove(callee)
+					continue
+				}
+
 				// Add node so it is moved to the top of its bucket in the
-				// routing table.
-				go dht.addNode(callee)
+				// routing table, along with the round-trip time.
+				dht.addNode(callee)
 
 				// Add the responding node's closest contacts.
-				sl.Add(result.Closest()...)
+				for _, contact := range result.Closest() {
+					if !bad[contact.NodeID] {
+						sl.Add(contact)
+					}
+				}
 
-				// Update callee with intermediate results.
-				stop := call.Result(result, callee)
 				if stop {
-					break // Callee requested that the walk must be stopped.
+					// Callee requested that the walk must be stopped.
+					return sl.SortedContacts(), nil
 				}
 			} else {
 				// Network response timed out.
 				log.Warn().Msgf("Network response from: %v timed out, removing from candidates...", callee.NodeID)
 
-				// Remove the callee from the candidates.
+				// Remove the callee from the candidates, and count the failure
+				// so that it's evicted from the routing table if it keeps
+				// failing.
 				sl.Remove(callee)
+				if ctx.Err() == nil {
+					dht.rt.Fail(callee.NodeID)
+				}
 			}
 		}
 
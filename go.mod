@@ -1,6 +1,6 @@
 module github.com/optmzr/d7024e-dht
 
-go 1.12
+go 1.13
 
 require (
 	github.com/golang/protobuf v1.3.2
@@ -0,0 +1,123 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/clock"
+)
+
+// MinPreSharedKeySize is the minimum size of a pre-shared key in bytes.
+const MinPreSharedKeySize = 16
+
+// MaxValueSize is the largest value that fits in a packet, leaving room for
+// the rest of the packet within a UDP datagram.
+const MaxValueSize = 60000
+
+// DefaultTimeout is the time after which a request is considered lost, unless
+// the context of the request has an earlier deadline.
+const DefaultTimeout = 1 * time.Second
+
+// Encryption selects if the packets between nodes are encrypted.
+type Encryption int
+
+const (
+	// EncryptionDisabled sends every packet in plaintext, and drops encrypted
+	// packets. Compatible with nodes that don't support encryption.
+	EncryptionDisabled Encryption = iota
+	// EncryptionEnabled encrypts the packets to peers that support encryption,
+	// while packets to other peers are sent in plaintext.
+	EncryptionEnabled
+	// EncryptionRequired encrypts every packet, and drops plaintext packets
+	// except for the handshakes.
+	EncryptionRequired
+)
+
+var encryptionNames = map[Encryption]string{
+	EncryptionDisabled: "disabled",
+	EncryptionEnabled:  "enabled",
+	EncryptionRequired: "required",
+}
+
+func (e Encryption) String() string {
+	if name, ok := encryptionNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Encryption(%d)", int(e))
+}
+
+// ParseEncryption parses the name of an encryption mode, i.e. "disabled",
+// "enabled" or "required".
+func ParseEncryption(name string) (Encryption, error) {
+	for e, n := range encryptionNames {
+		if n == name {
+			return e, nil
+		}
+	}
+	return EncryptionDisabled, fmt.Errorf("unknown encryption mode: %s", name)
+}
+
+// Config configures the transport of a network. The zero value is a valid
+// configuration that sends every packet in plaintext.
+type Config struct {
+	Encryption Encryption
+
+	// Timeout of requests, DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// PreSharedKey makes the network private, every packet is authenticated
+	// with a HMAC using the key and packets without a valid MAC are dropped.
+	// Only nodes with the same key can talk to each other.
+	PreSharedKey []byte
+
+	// Clock times out the requests, the system time is used if it's nil.
+	Clock clock.Clock
+}
+
+// Validate checks that the configuration can be used by a network.
+func (c Config) Validate() error {
+	if _, ok := encryptionNames[c.Encryption]; !ok {
+		return fmt.Errorf("invalid encryption mode: %v", c.Encryption)
+	}
+
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+
+	if c.PreSharedKey != nil && len(c.PreSharedKey) < MinPreSharedKeySize {
+		return fmt.Errorf("pre-shared key must be at least %d bytes", MinPreSharedKeySize)
+	}
+	return nil
+}
+
+// Equal returns true if the configurations are the same.
+func (c Config) Equal(o Config) bool {
+	return c.Encryption == o.Encryption &&
+		c.Timeout == o.Timeout &&
+		bytes.Equal(c.PreSharedKey, o.PreSharedKey) &&
+		c.Clock == o.Clock
+}
+
+// LoadPreSharedKey reads a pre-shared key from a file containing its
+// hexadecimal representation.
+func LoadPreSharedKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pre-shared key file: %w", err)
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode pre-shared key file as hex: %w", err)
+	}
+
+	if len(key) < MinPreSharedKeySize {
+		return nil, fmt.Errorf("pre-shared key must be at least %d bytes", MinPreSharedKeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,80 @@
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseEncryption(t *testing.T) {
+	for _, exp := range []Encryption{EncryptionDisabled, EncryptionEnabled, EncryptionRequired} {
+		e, err := ParseEncryption(exp.String())
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if e != exp {
+			t.Errorf("unexpected encryption, got: %v, exp: %v", e, exp)
+		}
+	}
+
+	_, err := ParseEncryption("sometimes")
+	if err == nil {
+		t.Error("expected error for unknown encryption mode")
+	}
+}
+
+func TestLoadPreSharedKey(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		valid   bool
+	}{
+		{"000102030405060708090a0b0c0d0e0f\n", true},
+		{"0001", false},
+		{"not hex", false},
+	} {
+		f, err := ioutil.TempFile("", "camomile")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.Remove(f.Name())
+
+		_, err = f.WriteString(tc.content)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		f.Close()
+
+		key, err := LoadPreSharedKey(f.Name())
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %q: %v", tc.content, err)
+		}
+		if tc.valid && len(key) != 16 {
+			t.Errorf("unexpected key size, got: %d, exp: %d", len(key), 16)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected error for %q", tc.content)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		cfg   Config
+		valid bool
+	}{
+		{Config{}, true},
+		{Config{Encryption: EncryptionRequired, Timeout: time.Second}, true},
+		{Config{Encryption: Encryption(42)}, false},
+		{Config{Timeout: -time.Second}, false},
+		{Config{PreSharedKey: []byte("short")}, false},
+	} {
+		err := tc.cfg.Validate()
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %+v: %v", tc.cfg, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected error for %+v", tc.cfg)
+		}
+	}
+}
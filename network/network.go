@@ -1,14 +1,25 @@
 package network
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 	"github.com/optmzr/d7024e-dht/packet"
 	"github.com/optmzr/d7024e-dht/route"
@@ -25,10 +36,19 @@ const (
 
 const Size256 = 256 / 8
 
-const networkTimeout = 1 * time.Second
+// LeaveWindow is how far the time of a leave may be from the time of the
+// receiver, older leaves are rejected as replays.
+const LeaveWindow = time.Minute
 
 type SessionID [Size256]byte
 
+// leaves holds the time of the latest leave accepted from each node within the
+// leave window, so that a leave is only accepted once.
+type leaves struct {
+	sync.Mutex
+	m map[node.ID]time.Time
+}
+
 type randRead func([]byte) (int, error)
 
 var rng randRead
@@ -38,41 +58,95 @@ func init() {
 }
 
 type udpNetwork struct {
-	conn  *net.UDPConn
-	me    route.Contact
-	fnt   *table
-	fvt   *table
-	pt    *table
-	fnr   chan *FindNodesRequest
-	fvr   chan *FindValueRequest
-	pr    chan *PongRequest
-	sr    chan *StoreRequest
-	ready chan struct{}
+	conn     net.PacketConn
+	listen   func() (net.PacketConn, error)
+	me       route.Contact
+	key      node.Key
+	cfg      Config
+	sessions *sessions
+	fnt      *table
+	fvt      *table
+	pt       *table
+	st       *table
+	gpt      *table
+	fnr      chan *FindNodesRequest
+	fvr      chan *FindValueRequest
+	pr       chan *PongRequest
+	sr       chan *StoreRequest
+	dr       chan *DeleteRequest
+	lr       chan *LeaveRequest
+	apr      chan *AddProviderRequest
+	gpr      chan *GetProvidersRequest
+	clock    clock.Clock
+	leaves   leaves
+	ready    chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex // Guards conn and closed.
+	closed   bool
 }
 
+// ErrClosed is returned when listening on a closed network.
+var ErrClosed = errors.New("network is closed")
+
 type Network interface {
-	Ping(addr net.UDPAddr) (chan *PingResult, []byte, error)
+	Ping(ctx context.Context, addr net.UDPAddr) (chan *PingResult, []byte, error)
 	Pong(challenge []byte, sessionID SessionID, addr net.UDPAddr) error
-	FindNodes(target node.ID, addr net.UDPAddr) (chan FindResult, error)
-	Store(key store.Key, value string, class StoreClass, addr net.UDPAddr) error
-	FindValue(key store.Key, addr net.UDPAddr) (chan FindResult, error)
-	SendValue(key store.Key, value string, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
+	FindNodes(ctx context.Context, target node.ID, addr net.UDPAddr) (chan FindResult, error)
+	Store(ctx context.Context, item store.Item, class StoreClass, addr net.UDPAddr) (chan *StoreResult, error)
+	CompareAndSwap(ctx context.Context, record store.Item, expected uint64, addr net.UDPAddr) (chan *StoreResult, error)
+	Delete(ctx context.Context, tombstone store.Tombstone, addr net.UDPAddr) (chan *StoreResult, error)
+	SendStoreAck(key store.Key, sessionID SessionID, addr net.UDPAddr) error
+	SendStoreConflict(key store.Key, seq uint64, sessionID SessionID, addr net.UDPAddr) error
+	SendStoreRefusal(key store.Key, sessionID SessionID, addr net.UDPAddr) error
+	FindValue(ctx context.Context, key store.Key, addr net.UDPAddr) (chan FindResult, error)
+	SendValue(item store.Item, found bool, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
 	SendNodes(closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
+	AddProvider(ctx context.Context, key store.Key, addr net.UDPAddr) (chan *StoreResult, error)
+	GetProviders(ctx context.Context, key store.Key, addr net.UDPAddr) (chan FindResult, error)
+	SendProviders(key store.Key, providers []route.Contact, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error
+	Leave(addr net.UDPAddr) error
+	Config() Config
 	FindNodesRequestCh() chan *FindNodesRequest
 	FindValueRequestCh() chan *FindValueRequest
 	StoreRequestCh() chan *StoreRequest
+	DeleteRequestCh() chan *DeleteRequest
+	LeaveRequestCh() chan *LeaveRequest
+	AddProviderRequestCh() chan *AddProviderRequest
+	GetProvidersRequestCh() chan *GetProvidersRequest
 	PongRequestCh() chan *PongRequest
 	ReadyCh() chan struct{}
 	Listen() error
+	Close() error
 }
 
 type FindResult interface {
 	Closest() []route.Contact
-	Value() string
+	Value() (value []byte, found bool)
+	Publisher() ed25519.PublicKey
+	Published() time.Time
+	Signature() []byte
+	Record() *store.Record
+	TTL() time.Duration
+	Providers() []route.Contact
 }
 
+// PingResult is the answer to a ping. From is the node that answered, its ID
+// is verified by the signature of the packet, so a node can be pinged by its
+// address alone to learn its ID.
 type PingResult struct {
 	Challenge []byte
+	From      route.Contact
+}
+
+// StoreResult is the acknowledgement of a store or delete request. Conflict is
+// set if a compare-and-swap was rejected, Seq is then the sequence number of
+// the stored record. Refused is set if the request was refused.
+type StoreResult struct {
+	Key      store.Key
+	Conflict bool
+	Seq      uint64
+	Refused  bool
 }
 
 type PongRequest struct {
@@ -82,9 +156,42 @@ type PongRequest struct {
 }
 
 type StoreRequest struct {
-	Class StoreClass
-	Value string
-	From  route.Contact
+	SessionID SessionID
+	Class     StoreClass
+	Key       store.Key
+	Value     []byte
+	Publisher ed25519.PublicKey
+	Published time.Time     // Time the publisher signed the value, see store.SignItem.
+	Signature []byte        // Signature of the publisher.
+	Record    *store.Record // Only set for mutable records.
+	TTL       time.Duration // Upper bound of the lifetime of the value, 0 for no limit.
+	CAS       bool          // Set for a compare-and-swap of a record.
+	Expected  uint64        // Expected sequence number of the stored record.
+	From      route.Contact
+}
+
+type DeleteRequest struct {
+	SessionID SessionID
+	Tombstone store.Tombstone
+	From      route.Contact
+}
+
+// LeaveRequest tells that the sender is leaving the network.
+type LeaveRequest struct {
+	From route.Contact
+}
+
+// AddProviderRequest announces that the sender holds the content of the key.
+type AddProviderRequest struct {
+	SessionID SessionID
+	Key       store.Key
+	From      route.Contact
+}
+
+type GetProvidersRequest struct {
+	SessionID SessionID
+	Key       store.Key
+	From      route.Contact
 }
 
 type FindNodesResult struct {
@@ -95,23 +202,124 @@ type FindValueResult struct {
 	SessionID SessionID
 	closest   []route.Contact
 	Key       store.Key
-	value     string
+	value     []byte
+	found     bool
+	publisher ed25519.PublicKey
+	published time.Time
+	signature []byte
+	record    *store.Record
+	ttl       time.Duration
 }
 
 func (r *FindNodesResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *FindNodesResult) Value() string {
-	return ""
+func (r *FindNodesResult) Value() ([]byte, bool) {
+	return nil, false
+}
+
+func (r *FindNodesResult) Publisher() ed25519.PublicKey {
+	return nil
+}
+
+func (r *FindNodesResult) Published() time.Time {
+	return time.Time{}
+}
+
+func (r *FindNodesResult) Signature() []byte {
+	return nil
+}
+
+func (r *FindNodesResult) Record() *store.Record {
+	return nil
+}
+
+func (r *FindNodesResult) TTL() time.Duration {
+	return 0
+}
+
+func (r *FindNodesResult) Providers() []route.Contact {
+	return nil
 }
 
 func (r *FindValueResult) Closest() []route.Contact {
 	return r.closest
 }
 
-func (r *FindValueResult) Value() string {
-	return r.value
+// Value returns the value of the result, found is false if the node didn't
+// have the value and only returned its closest contacts.
+func (r *FindValueResult) Value() (value []byte, found bool) {
+	return r.value, r.found
+}
+
+func (r *FindValueResult) Publisher() ed25519.PublicKey {
+	return r.publisher
+}
+
+// Published returns the time the publisher signed the value, see
+// store.SignItem.
+func (r *FindValueResult) Published() time.Time {
+	return r.published
+}
+
+// Signature returns the signature of the publisher of the value.
+func (r *FindValueResult) Signature() []byte {
+	return r.signature
+}
+
+// Record returns the record of the value, nil if the value is immutable.
+func (r *FindValueResult) Record() *store.Record {
+	return r.record
+}
+
+// TTL returns the remaining lifetime of the value, 0 for no limit.
+func (r *FindValueResult) TTL() time.Duration {
+	return r.ttl
+}
+
+func (r *FindValueResult) Providers() []route.Contact {
+	return nil
+}
+
+// ProvidersResult is the response to a GetProviders request.
+type ProvidersResult struct {
+	closest   []route.Contact
+	providers []route.Contact
+}
+
+func (r *ProvidersResult) Closest() []route.Contact {
+	return r.closest
+}
+
+func (r *ProvidersResult) Value() ([]byte, bool) {
+	return nil, false
+}
+
+func (r *ProvidersResult) Publisher() ed25519.PublicKey {
+	return nil
+}
+
+func (r *ProvidersResult) Published() time.Time {
+	return time.Time{}
+}
+
+func (r *ProvidersResult) Signature() []byte {
+	return nil
+}
+
+func (r *ProvidersResult) Record() *store.Record {
+	return nil
+}
+
+func (r *ProvidersResult) TTL() time.Duration {
+	return 0
+}
+
+// Providers returns the nodes that the responding node knows hold the content
+// of the key.
+func (r *ProvidersResult) Providers() []route.Contact {
+	return r.providers
 }
 
 type FindNodesRequest struct {
@@ -126,34 +334,108 @@ type FindValueRequest struct {
 	From      route.Contact
 }
 
-func NewUDPNetwork(me route.Contact) (Network, error) {
-	fvtTicker := time.NewTicker(time.Second)
-	fntTicker := time.NewTicker(time.Second)
-	ptTicker := time.NewTicker(time.Second)
+// NewUDPNetwork creates a network that listens for packets on an UDP socket
+// bound to the address of the local contact. All packets are signed with the
+// key, which must be the key of the local contact. The packets are encrypted as
+// set by the configuration.
+func NewUDPNetwork(me route.Contact, key node.Key, cfg Config) (Network, error) {
+	n, err := newNetwork(me, key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	n.listen = func() (net.PacketConn, error) {
+		return net.ListenUDP("udp", &me.Address)
+	}
+	return n, nil
+}
+
+// NewPacketNetwork creates a network that uses the provided packet connection
+// instead of an UDP socket, e.g. an in-memory connection used for simulations.
+// The addresses read from the connection must be of the type *net.UDPAddr.
+func NewPacketNetwork(me route.Contact, key node.Key, conn net.PacketConn, cfg Config) (Network, error) {
+	n, err := newNetwork(me, key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	n.conn = conn
+	return n, nil
+}
+
+func newNetwork(me route.Contact, key node.Key, cfg Config) (*udpNetwork, error) {
+	if !key.ID().Equal(me.NodeID) {
+		return nil, fmt.Errorf("node ID %v is not derived from the key (%v)", me.NodeID, key.ID())
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	sessions, err := newSessions()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.New()
+	}
+	clk := cfg.Clock
+
+	fvtTicker := clk.NewTicker(time.Second)
+	fntTicker := clk.NewTicker(time.Second)
+	ptTicker := clk.NewTicker(time.Second)
+	stTicker := clk.NewTicker(time.Second)
+	gptTicker := clk.NewTicker(time.Second)
 
 	n := &udpNetwork{
-		me:  me,
-		fvt: newTable(networkTimeout, fvtTicker),
-		fnt: newTable(networkTimeout, fntTicker),
-		pt:  newTable(networkTimeout, ptTicker),
+		me:       me,
+		key:      key,
+		cfg:      cfg,
+		sessions: sessions,
+		fvt:      newTable(cfg.Timeout, fvtTicker, clk),
+		fnt:      newTable(cfg.Timeout, fntTicker, clk),
+		pt:       newTable(cfg.Timeout, ptTicker, clk),
+		st:       newTable(cfg.Timeout, stTicker, clk),
+		gpt:      newTable(cfg.Timeout, gptTicker, clk),
+		clock:    clk,
+		leaves:   leaves{m: make(map[node.ID]time.Time)},
 	}
 
 	n.fnr = make(chan *FindNodesRequest)
 	n.fvr = make(chan *FindValueRequest)
 	n.sr = make(chan *StoreRequest)
+	n.dr = make(chan *DeleteRequest)
+	n.lr = make(chan *LeaveRequest)
 	n.pr = make(chan *PongRequest)
+	n.apr = make(chan *AddProviderRequest)
+	n.gpr = make(chan *GetProvidersRequest)
 	n.ready = make(chan struct{})
+	n.done = make(chan struct{})
 
 	return n, nil
 }
 
-func (u *udpNetwork) StoreRequestCh() chan *StoreRequest         { return u.sr }
-func (u *udpNetwork) FindNodesRequestCh() chan *FindNodesRequest { return u.fnr }
-func (u *udpNetwork) FindValueRequestCh() chan *FindValueRequest { return u.fvr }
-func (u *udpNetwork) PongRequestCh() chan *PongRequest           { return u.pr }
-func (u *udpNetwork) ReadyCh() chan struct{}                     { return u.ready }
+// Config returns the configuration of the network, with the zero fields
+// replaced by the defaults.
+func (u *udpNetwork) Config() Config {
+	return u.cfg
+}
 
-func (u *udpNetwork) Ping(addr net.UDPAddr) (chan *PingResult, []byte, error) {
+func (u *udpNetwork) StoreRequestCh() chan *StoreRequest               { return u.sr }
+func (u *udpNetwork) DeleteRequestCh() chan *DeleteRequest             { return u.dr }
+func (u *udpNetwork) LeaveRequestCh() chan *LeaveRequest               { return u.lr }
+func (u *udpNetwork) AddProviderRequestCh() chan *AddProviderRequest   { return u.apr }
+func (u *udpNetwork) GetProvidersRequestCh() chan *GetProvidersRequest { return u.gpr }
+func (u *udpNetwork) FindNodesRequestCh() chan *FindNodesRequest       { return u.fnr }
+func (u *udpNetwork) FindValueRequestCh() chan *FindValueRequest       { return u.fvr }
+func (u *udpNetwork) PongRequestCh() chan *PongRequest                 { return u.pr }
+func (u *udpNetwork) ReadyCh() chan struct{}                           { return u.ready }
+
+func (u *udpNetwork) Ping(ctx context.Context, addr net.UDPAddr) (chan *PingResult, []byte, error) {
 	id := generateID()
 	c := generateChallenge()
 
@@ -166,16 +448,16 @@ func (u *udpNetwork) Ping(addr net.UDPAddr) (chan *PingResult, []byte, error) {
 		Payload:   &packet.Packet_Ping{Ping: payload},
 	}
 
+	result := makeResultChan()
+	u.pt.Put(ctx, id, result)
+
 	err := u.send(addr, *p)
 	if err != nil {
+		u.pt.Remove(id)
 		return nil, nil, err
 	}
 
-	result := makeResultChan()
-	pingResult := toPingResult(result)
-	u.pt.Put(id, result)
-
-	return pingResult, c, nil
+	return toPingResult(result), c, nil
 }
 
 func (u *udpNetwork) Pong(challenge []byte, sessionID SessionID, addr net.UDPAddr) error {
@@ -191,7 +473,7 @@ func (u *udpNetwork) Pong(challenge []byte, sessionID SessionID, addr net.UDPAdd
 	return u.send(addr, *p)
 }
 
-func (u *udpNetwork) FindNodes(target node.ID, addr net.UDPAddr) (chan FindResult, error) {
+func (u *udpNetwork) FindNodes(ctx context.Context, target node.ID, addr net.UDPAddr) (chan FindResult, error) {
 	id := generateID()
 
 	payload := &packet.FindNode{
@@ -204,34 +486,147 @@ func (u *udpNetwork) FindNodes(target node.ID, addr net.UDPAddr) (chan FindResul
 	}
 
 	result := makeResultChan()
-	findResult := toFindResult(result)
-	u.fnt.Put(id, result)
+	u.fnt.Put(ctx, id, result)
 
 	err := u.send(addr, *p)
 	if err != nil {
+		u.fnt.Remove(id)
 		return nil, err
 	}
 
-	return findResult, nil
+	return toFindResult(result), nil
 }
 
-func (u *udpNetwork) Store(key store.Key, value string, class StoreClass, addr net.UDPAddr) error {
-	id := generateID()
+func (u *udpNetwork) Store(ctx context.Context, item store.Item, class StoreClass, addr net.UDPAddr) (chan *StoreResult, error) {
+	payload := &packet.Store{
+		Class:     class,
+		Key:       item.Key[:],
+		Value:     item.Value,
+		Publisher: item.Publisher,
+		Record:    toPacketRecord(item.Record),
+		Ttl:       toPacketTTL(item.TTL),
+		Published: toPacketTime(item.Published),
+		Signature: item.Signature,
+	}
 
+	return u.store(ctx, payload, addr)
+}
+
+// CompareAndSwap publishes a record that the receiver only stores if its
+// stored record has the expected sequence number. A rejection is acknowledged
+// with a conflicting result.
+func (u *udpNetwork) CompareAndSwap(ctx context.Context, record store.Item, expected uint64, addr net.UDPAddr) (chan *StoreResult, error) {
 	payload := &packet.Store{
-		Class: class,
-		Value: value,
+		Class:       StoreClassPublish,
+		Key:         record.Key[:],
+		Value:       record.Value,
+		Publisher:   record.Publisher,
+		Record:      toPacketRecord(record.Record),
+		Cas:         true,
+		ExpectedSeq: expected,
+		Ttl:         toPacketTTL(record.TTL),
 	}
+
+	return u.store(ctx, payload, addr)
+}
+
+func (u *udpNetwork) store(ctx context.Context, payload *packet.Store, addr net.UDPAddr) (chan *StoreResult, error) {
+	id := generateID()
+
 	p := &packet.Packet{
 		SessionId: id[:],
 		SenderId:  u.me.NodeID.Bytes(),
 		Payload:   &packet.Packet_Store{Store: payload},
 	}
 
+	result := makeResultChan()
+	u.st.Put(ctx, id, result)
+
+	err := u.send(addr, *p)
+	if err != nil {
+		u.st.Remove(id)
+		return nil, err
+	}
+
+	return toStoreResult(result), nil
+}
+
+// Delete sends a tombstone to the address, the deletion is acknowledged in the
+// same way as a store.
+func (u *udpNetwork) Delete(ctx context.Context, tombstone store.Tombstone, addr net.UDPAddr) (chan *StoreResult, error) {
+	id := generateID()
+
+	payload := &packet.Delete{
+		Key:       tombstone.Key[:],
+		Publisher: tombstone.Publisher,
+		Signature: tombstone.Signature,
+		Time:      tombstone.Time.UnixNano(),
+	}
+	p := &packet.Packet{
+		SessionId: id[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_Delete{Delete: payload},
+	}
+
+	result := makeResultChan()
+	u.st.Put(ctx, id, result)
+
+	err := u.send(addr, *p)
+	if err != nil {
+		u.st.Remove(id)
+		return nil, err
+	}
+
+	return toStoreResult(result), nil
+}
+
+func (u *udpNetwork) SendStoreAck(key store.Key, sessionID SessionID, addr net.UDPAddr) error {
+	payload := &packet.StoreAck{
+		Key: key[:],
+	}
+	p := &packet.Packet{
+		SessionId: sessionID[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_StoreAck{StoreAck: payload},
+	}
+
 	return u.send(addr, *p)
 }
 
-func (u *udpNetwork) FindValue(key store.Key, addr net.UDPAddr) (chan FindResult, error) {
+// SendStoreConflict rejects a compare-and-swap, as the stored record has the
+// sequence number seq.
+func (u *udpNetwork) SendStoreConflict(key store.Key, seq uint64, sessionID SessionID, addr net.UDPAddr) error {
+	payload := &packet.StoreAck{
+		Key:      key[:],
+		Conflict: true,
+		Seq:      seq,
+	}
+	p := &packet.Packet{
+		SessionId: sessionID[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_StoreAck{StoreAck: payload},
+	}
+
+	return u.send(addr, *p)
+}
+
+// SendStoreRefusal answers a store or delete request that was refused, so that
+// the sender doesn't have to wait for it to time out.
+func (u *udpNetwork) SendStoreRefusal(key store.Key, sessionID SessionID, addr net.UDPAddr) error {
+	payload := &packet.StoreAck{
+		Key:     key[:],
+		Refused: true,
+	}
+	p := &packet.Packet{
+		SessionId: sessionID[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_StoreAck{StoreAck: payload},
+	}
+
+	return u.send(addr, *p)
+}
+
+func (u *udpNetwork) FindValue(ctx context.Context, key store.Key, addr net.UDPAddr) (chan FindResult, error) {
 	id := generateID()
 
 	payload := &packet.FindValue{
@@ -244,18 +639,20 @@ func (u *udpNetwork) FindValue(key store.Key, addr net.UDPAddr) (chan FindResult
 	}
 
 	result := makeResultChan()
-	findResult := toFindResult(result)
-	u.fvt.Put(id, result)
+	u.fvt.Put(ctx, id, result)
 
 	err := u.send(addr, *p)
 	if err != nil {
+		u.fvt.Remove(id)
 		return nil, err
 	}
 
-	return findResult, nil
+	return toFindResult(result), nil
 }
 
-func (u *udpNetwork) SendValue(key store.Key, value string, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error {
+// SendValue responds to a FindValue request, with the item if it was found and
+// otherwise with the closest contacts to the key.
+func (u *udpNetwork) SendValue(item store.Item, found bool, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error {
 	var nodes []*packet.NodeInfo
 	var contacts []route.Contact
 
@@ -275,9 +672,15 @@ func (u *udpNetwork) SendValue(key store.Key, value string, closest []route.Cont
 	}
 
 	payload := &packet.Value{
-		Key:      key[:],
-		Value:    value,
-		NodeList: internalPayload,
+		Key:       item.Key[:],
+		Value:     item.Value,
+		NodeList:  internalPayload,
+		Publisher: item.Publisher,
+		Found:     found,
+		Record:    toPacketRecord(item.Record),
+		Ttl:       toPacketTTL(item.TTL),
+		Published: toPacketTime(item.Published),
+		Signature: item.Signature,
 	}
 	p := &packet.Packet{
 		SessionId: sessionID[:],
@@ -323,36 +726,200 @@ func (u *udpNetwork) SendNodes(closest []route.Contact, sessionID SessionID, add
 	return nil
 }
 
+// AddProvider announces to the node at the address that this node holds the
+// content of the key, the announcement is acknowledged in the same way as a
+// store.
+func (u *udpNetwork) AddProvider(ctx context.Context, key store.Key, addr net.UDPAddr) (chan *StoreResult, error) {
+	id := generateID()
+
+	payload := &packet.AddProvider{
+		Key: key[:],
+	}
+	p := &packet.Packet{
+		SessionId: id[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_AddProvider{AddProvider: payload},
+	}
+
+	result := makeResultChan()
+	u.st.Put(ctx, id, result)
+
+	err := u.send(addr, *p)
+	if err != nil {
+		u.st.Remove(id)
+		return nil, err
+	}
+
+	return toStoreResult(result), nil
+}
+
+func (u *udpNetwork) GetProviders(ctx context.Context, key store.Key, addr net.UDPAddr) (chan FindResult, error) {
+	id := generateID()
+
+	payload := &packet.GetProviders{
+		Key: key[:],
+	}
+	p := &packet.Packet{
+		SessionId: id[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_GetProviders{GetProviders: payload},
+	}
+
+	result := makeResultChan()
+	u.gpt.Put(ctx, id, result)
+
+	err := u.send(addr, *p)
+	if err != nil {
+		u.gpt.Remove(id)
+		return nil, err
+	}
+
+	return toFindResult(result), nil
+}
+
+// SendProviders responds to a GetProviders request with the known providers of
+// the key, and the closest contacts to the key.
+func (u *udpNetwork) SendProviders(key store.Key, providers []route.Contact, closest []route.Contact, sessionID SessionID, addr net.UDPAddr) error {
+	payload := &packet.ProviderList{
+		Key:       key[:],
+		Providers: toNodeList(providers),
+		NodeList:  toNodeList(closest),
+	}
+	p := &packet.Packet{
+		SessionId: sessionID[:],
+		SenderId:  u.me.NodeID.Bytes(),
+		Payload:   &packet.Packet_ProviderList{ProviderList: payload},
+	}
+
+	return u.send(addr, *p)
+}
+
+// Leave tells the node at the address that this node is leaving the network.
+// The packet is not acknowledged, and is stamped with the current time so that
+// it can't be replayed once the node is back.
+func (u *udpNetwork) Leave(addr net.UDPAddr) error {
+	p := &packet.Packet{
+		SenderId: u.me.NodeID.Bytes(),
+		Payload: &packet.Packet_Leave{Leave: &packet.Leave{
+			Time: u.clock.Now().UnixNano(),
+		}},
+	}
+
+	return u.send(addr, *p)
+}
+
+// acceptLeave returns true if the leave sent by the node at the time is within
+// the leave window, and newer than the previous leave accepted from the node.
+func (u *udpNetwork) acceptLeave(id node.ID, t time.Time) bool {
+	now := u.clock.Now()
+	if d := now.Sub(t); d > LeaveWindow || d < -LeaveWindow {
+		return false
+	}
+
+	u.leaves.Lock()
+	defer u.leaves.Unlock()
+
+	if last, ok := u.leaves.m[id]; ok && !t.After(last) {
+		return false
+	}
+	u.leaves.m[id] = t
+
+	// Older leaves are rejected by the window alone.
+	for other, last := range u.leaves.m {
+		if now.Sub(last) > LeaveWindow {
+			delete(u.leaves.m, other)
+		}
+	}
+	return true
+}
+
+// Listen reads packets from the connection until the network is closed, in
+// which case nil is returned.
 func (u *udpNetwork) Listen() (err error) {
 	log.Info().Msgf("Listening for UDP packets on: %s", u.me.Address.String())
 
-	u.conn, err = net.ListenUDP("udp", &u.me.Address)
-	if err != nil {
-		return err
+	u.mu.Lock()
+	if u.closed {
+		u.mu.Unlock()
+		return ErrClosed
 	}
+	if u.conn == nil {
+		u.conn, err = u.listen()
+		if err != nil {
+			u.mu.Unlock()
+			return err
+		}
+	}
+	u.wg.Add(1)
+	u.mu.Unlock()
+
+	defer u.wg.Done()
 	defer u.conn.Close()
 
 	// Notify everyone that we're ready.
-	u.ready <- struct{}{}
+	select {
+	case u.ready <- struct{}{}:
+	case <-u.done:
+		return nil
+	}
 
 	// Reusable buffer, can be used between every read loop as it will be copied
 	// before sending the data to the packet handler.
 	buffer := make([]byte, 65535)
 
 	for {
-		n, addr, err := u.conn.ReadFromUDP(buffer)
+		n, addr, err := u.conn.ReadFrom(buffer)
 
 		if err != nil {
+			select {
+			case <-u.done:
+				return nil // Closed.
+			default:
+			}
+
 			log.Error().Err(err).Msgf("Error when reading from UDP from address %v: %s", addr, err)
 			continue
 		}
 
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			log.Error().Msgf("Unexpected address type %T from: %v", addr, addr)
+			continue
+		}
+
 		// Make a copy of the current data in the buffer.
 		rawPacket := make([]byte, n)
 		copy(rawPacket, buffer)
 
-		go u.handlePacket(rawPacket, *addr)
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.handlePacket(rawPacket, *udpAddr)
+		}()
+	}
+}
+
+// Close closes the connection and waits for the packet handlers to return. All
+// pending requests are signalled as timed out, and incoming requests that
+// haven't been received from the request channels are dropped.
+func (u *udpNetwork) Close() (err error) {
+	u.mu.Lock()
+	if !u.closed {
+		u.closed = true
+		close(u.done)
+
+		if u.conn != nil {
+			err = u.conn.Close()
+		}
+
+		for _, t := range []*table{u.fnt, u.fvt, u.pt, u.st, u.gpt} {
+			t.close()
+		}
 	}
+	u.mu.Unlock()
+
+	u.wg.Wait()
+	return err
 }
 
 func logChannelNotFound(id SessionID) {
@@ -360,14 +927,76 @@ func logChannelNotFound(id SessionID) {
 }
 
 func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
+	// Packets from nodes outside of a private network are dropped before
+	// anything else is done with them.
+	if u.cfg.PreSharedKey != nil {
+		var ok bool
+		b, ok = u.verifyMAC(b)
+		if !ok {
+			log.Debug().Msgf("Rejected packet without valid MAC from: %v", addr.String())
+
+			return
+		}
+	}
+
+	e := &packet.Envelope{}
+	err := proto.Unmarshal(b, e)
+	if err != nil {
+		log.Error().Err(err).Msg("Error unserializing envelope")
+
+		return
+	}
+
+	encrypted := len(e.Sealed) > 0
+	exchangeKey := e.ExchangeKey
+	if encrypted {
+		e, err = u.open(e, addr)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Rejected encrypted packet from: %v", addr.String())
+
+			return
+		}
+	}
+
 	p := &packet.Packet{}
-	err := proto.Unmarshal(b, p)
+	err = proto.Unmarshal(e.Packet, p)
 	if err != nil {
 		log.Error().Err(err).Msg("Error unserializing packet")
 
 		return
 	}
 
+	// The packet must be signed by the key of the sender.
+	senderID := node.IDFromBytes(p.SenderId)
+	err = node.Verify(senderID, e.PublicKey, e.Packet, e.Signature)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Rejected packet from: %v (%v)", senderID, addr.String())
+
+		return
+	}
+
+	// The exchange key used to encrypt the packet must be signed by the sender.
+	if encrypted && !bytes.Equal(p.ExchangeKey, exchangeKey) {
+		log.Warn().Msgf("Rejected packet encrypted with another key from: %v (%v)", senderID, addr.String())
+
+		return
+	}
+
+	if !encrypted && u.cfg.Encryption == EncryptionRequired && p.GetHello() == nil {
+		log.Warn().Msgf("Rejected plaintext packet from: %v (%v)", senderID, addr.String())
+
+		return
+	}
+
+	if u.cfg.Encryption != EncryptionDisabled && len(p.ExchangeKey) > 0 {
+		err = u.sessions.learn(addr, senderID, p.ExchangeKey)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Rejected exchange key from: %v (%v)", senderID, addr.String())
+
+			return
+		}
+	}
+
 	switch p.Payload.(type) {
 	case *packet.Packet_Value:
 		var sessionID SessionID
@@ -389,7 +1018,7 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			})
 		}
 
-		ch, ok := u.fvt.Get(sessionID)
+		ch, ok := u.fvt.Pop(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
@@ -400,10 +1029,14 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			closest:   closest,
 			Key:       key,
 			value:     p.GetValue().Value,
+			found:     p.GetValue().Found,
+			publisher: p.GetValue().Publisher,
+			published: fromPacketTime(p.GetValue().Published),
+			signature: p.GetValue().Signature,
+			record:    fromPacketRecord(p.GetValue().Record),
+			ttl:       fromPacketTTL(p.GetValue().Ttl),
 		}
 
-		u.fvt.Remove(sessionID)
-
 	case *packet.Packet_NodeList:
 		var sessionID SessionID
 		var senderID node.ID
@@ -422,7 +1055,7 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			})
 		}
 
-		ch, ok := u.fnt.Get(sessionID)
+		ch, ok := u.fnt.Pop(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
@@ -432,8 +1065,6 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			closest: closest,
 		}
 
-		u.fnt.Remove(sessionID)
-
 	case *packet.Packet_FindValue:
 		var key store.Key
 		var senderID node.ID
@@ -442,7 +1073,7 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.GetSenderId())
 		copy(sessionID[:], p.GetSessionId())
 
-		u.fvr <- &FindValueRequest{
+		request := &FindValueRequest{
 			Key:       key,
 			SessionID: sessionID,
 			From: route.Contact{
@@ -454,13 +1085,18 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			},
 		}
 
+		select {
+		case u.fvr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
 	case *packet.Packet_Ping:
 		var sessionID SessionID
 		var senderID node.ID
 		copy(senderID[:], p.GetSenderId())
 		copy(sessionID[:], p.GetSessionId())
 
-		u.pr <- &PongRequest{
+		request := &PongRequest{
 			From: route.Contact{
 				NodeID: senderID,
 				Address: net.UDPAddr{
@@ -472,11 +1108,16 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			Challenge: p.GetPing().GetChallenge(),
 		}
 
+		select {
+		case u.pr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
 	case *packet.Packet_Pong:
 		var sessionID SessionID
 		copy(sessionID[:], p.GetSessionId())
 
-		ch, ok := u.pt.Get(sessionID)
+		ch, ok := u.pt.Pop(sessionID)
 		if !ok {
 			logChannelNotFound(sessionID)
 			return
@@ -484,10 +1125,12 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 
 		ch <- &PingResult{
 			Challenge: p.GetPong().GetChallenge(),
+			From: route.Contact{
+				NodeID:  node.IDFromBytes(p.GetSenderId()),
+				Address: addr,
+			},
 		}
 
-		u.pt.Remove(sessionID)
-
 	case *packet.Packet_FindNode:
 		var sessionID SessionID
 		var senderID node.ID
@@ -496,7 +1139,7 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 		copy(senderID[:], p.GetSenderId())
 		copy(targetID[:], p.GetFindNode().NodeId)
 
-		u.fnr <- &FindNodesRequest{
+		request := &FindNodesRequest{
 			SessionID: sessionID,
 			Target:    targetID,
 			From: route.Contact{
@@ -508,15 +1151,34 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			},
 		}
 
+		select {
+		case u.fnr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
 	case *packet.Packet_Store:
+		var sessionID SessionID
 		var senderID node.ID
+		var key store.Key
+		copy(sessionID[:], p.GetSessionId())
 		copy(senderID[:], p.GetSenderId())
+		copy(key[:], p.GetStore().Key)
 		value := p.GetStore().Value
 		class := p.GetStore().Class
+		publisher := p.GetStore().Publisher
 
-		u.sr <- &StoreRequest{
-			Class: class,
-			Value: value,
+		request := &StoreRequest{
+			SessionID: sessionID,
+			Class:     class,
+			Key:       key,
+			Value:     value,
+			Publisher: publisher,
+			Published: fromPacketTime(p.GetStore().Published),
+			Signature: p.GetStore().Signature,
+			Record:    fromPacketRecord(p.GetStore().Record),
+			TTL:       fromPacketTTL(p.GetStore().Ttl),
+			CAS:       p.GetStore().Cas,
+			Expected:  p.GetStore().ExpectedSeq,
 			From: route.Contact{
 				NodeID: senderID,
 				Address: net.UDPAddr{
@@ -526,11 +1188,184 @@ func (u *udpNetwork) handlePacket(b []byte, addr net.UDPAddr) {
 			},
 		}
 
+		select {
+		case u.sr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
+	case *packet.Packet_Delete:
+		var sessionID SessionID
+		var senderID node.ID
+		var key store.Key
+		copy(sessionID[:], p.GetSessionId())
+		copy(senderID[:], p.GetSenderId())
+		copy(key[:], p.GetDelete().Key)
+
+		request := &DeleteRequest{
+			SessionID: sessionID,
+			Tombstone: store.Tombstone{
+				Key:       key,
+				Publisher: p.GetDelete().Publisher,
+				Time:      time.Unix(0, p.GetDelete().GetTime()),
+				Signature: p.GetDelete().Signature,
+			},
+			From: route.Contact{
+				NodeID: senderID,
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+				},
+			},
+		}
+
+		select {
+		case u.dr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
+	case *packet.Packet_StoreAck:
+		var sessionID SessionID
+		var key store.Key
+		copy(sessionID[:], p.GetSessionId())
+		copy(key[:], p.GetStoreAck().Key)
+
+		ch, ok := u.st.Pop(sessionID)
+		if !ok {
+			logChannelNotFound(sessionID)
+			return
+		}
+
+		ch <- &StoreResult{
+			Key:      key,
+			Conflict: p.GetStoreAck().Conflict,
+			Seq:      p.GetStoreAck().Seq,
+			Refused:  p.GetStoreAck().Refused,
+		}
+
+	case *packet.Packet_Leave:
+		if !u.acceptLeave(senderID, time.Unix(0, p.GetLeave().GetTime())) {
+			log.Warn().Msgf("Rejected stale or replayed leave from: %v (%v)", senderID, addr.String())
+
+			return
+		}
+
+		request := &LeaveRequest{
+			From: route.Contact{
+				NodeID: senderID,
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+				},
+			},
+		}
+
+		select {
+		case u.lr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
+	case *packet.Packet_AddProvider:
+		var sessionID SessionID
+		var key store.Key
+		copy(sessionID[:], p.GetSessionId())
+		copy(key[:], p.GetAddProvider().Key)
+
+		// The provider is the sender, at the address the packet was sent from.
+		request := &AddProviderRequest{
+			SessionID: sessionID,
+			Key:       key,
+			From: route.Contact{
+				NodeID: node.IDFromBytes(p.GetSenderId()),
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+				},
+			},
+		}
+
+		select {
+		case u.apr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
+	case *packet.Packet_GetProviders:
+		var sessionID SessionID
+		var key store.Key
+		copy(sessionID[:], p.GetSessionId())
+		copy(key[:], p.GetGetProviders().Key)
+
+		request := &GetProvidersRequest{
+			SessionID: sessionID,
+			Key:       key,
+			From: route.Contact{
+				NodeID: node.IDFromBytes(p.GetSenderId()),
+				Address: net.UDPAddr{
+					IP:   addr.IP,
+					Port: addr.Port,
+				},
+			},
+		}
+
+		select {
+		case u.gpr <- request:
+		case <-u.done: // Closed, drop the request.
+		}
+
+	case *packet.Packet_ProviderList:
+		var sessionID SessionID
+		copy(sessionID[:], p.GetSessionId())
+
+		ch, ok := u.gpt.Pop(sessionID)
+		if !ok {
+			logChannelNotFound(sessionID)
+			return
+		}
+
+		ch <- &ProvidersResult{
+			closest:   fromNodeList(p.GetProviderList().GetNodeList()),
+			providers: fromNodeList(p.GetProviderList().GetProviders()),
+		}
+
+	case *packet.Packet_Hello:
+		if u.cfg.Encryption == EncryptionDisabled || p.GetHello().Reply {
+			return
+		}
+
+		err = u.sendHello(addr, true)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to reply to handshake from: %v", addr.String())
+		}
+
 	default:
 		log.Debug().Msgf("Unhandled packet: %v", p)
 	}
 }
 
+// open decrypts an encrypted envelope, and returns the signed envelope within.
+func (u *udpNetwork) open(e *packet.Envelope, addr net.UDPAddr) (*packet.Envelope, error) {
+	if u.cfg.Encryption == EncryptionDisabled {
+		return nil, errors.New("encryption is disabled")
+	}
+
+	b, err := u.sessions.open(addr, e.ExchangeKey, e.Nonce, e.Sealed)
+	if err != nil {
+		// The peer might have encrypted the packet with an old key, e.g. from
+		// before a restart, so a new handshake is made for it to learn the
+		// current key.
+		if err := u.sendHello(addr, false); err != nil {
+			log.Error().Err(err).Msgf("Failed to send handshake to: %v", addr.String())
+		}
+		return nil, fmt.Errorf("cannot decrypt envelope: %w", err)
+	}
+
+	inner := &packet.Envelope{}
+	err = proto.Unmarshal(b, inner)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unserialize encrypted envelope: %w", err)
+	}
+	return inner, nil
+}
+
 func generateID() (id SessionID) {
 	_, err := rng(id[:])
 	if err != nil {
@@ -548,18 +1383,231 @@ func generateChallenge() []byte {
 	return c
 }
 
-func (u *udpNetwork) send(addr net.UDPAddr, packet packet.Packet) error {
-	b, err := proto.Marshal(&packet)
+func (u *udpNetwork) send(addr net.UDPAddr, p packet.Packet) error {
+	var aead cipher.AEAD
+	if u.cfg.Encryption != EncryptionDisabled {
+		var err error
+		aead, err = u.session(addr)
+		if err != nil {
+			return err
+		}
+
+		// Let the receiver know our exchange key, so that it can encrypt its
+		// replies.
+		p.ExchangeKey = u.sessions.public[:]
+	}
+
+	b, err := u.sign(p)
 	if err != nil {
 		return err
 	}
-	_, err = u.conn.WriteTo(b, &addr)
+
+	if aead != nil {
+		nonce, sealed, err := u.sessions.seal(aead, b)
+		if err != nil {
+			return err
+		}
+
+		b, err = proto.Marshal(&packet.Envelope{
+			ExchangeKey: u.sessions.public[:],
+			Nonce:       nonce,
+			Sealed:      sealed,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.write(addr, b)
+}
+
+// write sends the datagram to the address, with a MAC appended if the network
+// is private.
+func (u *udpNetwork) write(addr net.UDPAddr, b []byte) error {
+	if u.cfg.PreSharedKey != nil {
+		mac := hmac.New(sha256.New, u.cfg.PreSharedKey)
+		mac.Write(b)
+		b = mac.Sum(b)
+	}
+
+	_, err := u.conn.WriteTo(b, &addr)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// verifyMAC checks the MAC at the end of the datagram, and returns the
+// datagram without the MAC.
+func (u *udpNetwork) verifyMAC(b []byte) ([]byte, bool) {
+	if len(b) < sha256.Size {
+		return nil, false
+	}
+
+	data, sum := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+
+	mac := hmac.New(sha256.New, u.cfg.PreSharedKey)
+	mac.Write(data)
+	return data, hmac.Equal(sum, mac.Sum(nil))
+}
+
+// sign serializes the packet and wraps it in a signed envelope, so that the
+// receiver can verify the sender.
+func (u *udpNetwork) sign(p packet.Packet) ([]byte, error) {
+	b, err := proto.Marshal(&p)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &packet.Envelope{
+		Packet:    b,
+		PublicKey: u.key.Public(),
+		Signature: u.key.Sign(b),
+	}
+	return proto.Marshal(e)
+}
+
+// session returns the AEAD used to encrypt the packets to the address, or nil
+// if they're sent in plaintext. A handshake is made with peers with unknown
+// exchange keys if encryption is required.
+func (u *udpNetwork) session(addr net.UDPAddr) (cipher.AEAD, error) {
+	aead, ok := u.sessions.lookup(addr)
+	if ok || u.cfg.Encryption != EncryptionRequired {
+		return aead, nil
+	}
+
+	known := u.sessions.known(addr)
+
+	err := u.sendHello(addr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := u.clock.NewTimer(u.cfg.Timeout)
+	defer timer.Stop()
+
+	select {
+	case <-known:
+	case <-u.done:
+		return nil, ErrClosed
+	case <-timer.C:
+		return nil, fmt.Errorf("encryption handshake with %v timed out", addr.String())
+	}
+
+	aead, _ = u.sessions.lookup(addr)
+	return aead, nil
+}
+
+// sendHello sends the exchange key in a plaintext handshake, the receiver
+// replies with its exchange key unless the handshake is a reply.
+func (u *udpNetwork) sendHello(addr net.UDPAddr, reply bool) error {
+	payload := &packet.Hello{
+		Reply: reply,
+	}
+	p := packet.Packet{
+		SenderId:    u.me.NodeID.Bytes(),
+		ExchangeKey: u.sessions.public[:],
+		Payload:     &packet.Packet_Hello{Hello: payload},
+	}
+
+	b, err := u.sign(p)
+	if err != nil {
+		return err
+	}
+
+	return u.write(addr, b)
+}
+
 func (id SessionID) String() string {
 	return hex.EncodeToString(id[:])
 }
+
+// toPacketRecord converts a record to its packet representation, nil for
+// immutable values.
+func toPacketRecord(r *store.Record) *packet.Record {
+	if r == nil {
+		return nil
+	}
+	return &packet.Record{
+		Salt:      r.Salt,
+		Seq:       r.Seq,
+		Signature: r.Signature,
+	}
+}
+
+// fromPacketRecord converts the packet representation of a record, nil for
+// immutable values.
+func fromPacketRecord(r *packet.Record) *store.Record {
+	if r == nil {
+		return nil
+	}
+	return &store.Record{
+		Salt:      r.Salt,
+		Seq:       r.Seq,
+		Signature: r.Signature,
+	}
+}
+
+// toPacketTTL converts a TTL to milliseconds, rounded up so that a short TTL
+// is never sent as no limit.
+func toPacketTTL(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// fromPacketTTL converts a TTL in milliseconds, a TTL too long for a duration
+// is capped.
+func fromPacketTTL(ms uint64) time.Duration {
+	const max = uint64(math.MaxInt64 / int64(time.Millisecond))
+	if ms > max {
+		ms = max
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// toPacketTime converts a time to nanoseconds since the Unix epoch, the zero
+// time is sent as zero.
+func toPacketTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromPacketTime converts nanoseconds since the Unix epoch to a time, see
+// toPacketTime.
+func fromPacketTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// toNodeList converts the contacts to their packet representation.
+func toNodeList(contacts []route.Contact) *packet.NodeList {
+	var nodes []*packet.NodeInfo
+	for _, c := range contacts {
+		nodes = append(nodes, &packet.NodeInfo{
+			NodeId: c.NodeID.Bytes(),
+			Ip:     c.Address.IP,
+			Port:   uint32(c.Address.Port),
+		})
+	}
+	return &packet.NodeList{Nodes: nodes}
+}
+
+// fromNodeList converts the packet representation of contacts.
+func fromNodeList(list *packet.NodeList) (contacts []route.Contact) {
+	for _, n := range list.GetNodes() {
+		contacts = append(contacts, route.Contact{
+			NodeID: node.IDFromBytes(n.NodeId),
+			Address: net.UDPAddr{
+				IP:   n.Ip,
+				Port: int(n.Port),
+			},
+		})
+	}
+	return
+}
@@ -2,21 +2,27 @@ package network
 
 import (
 	"bytes"
+	"context"
 	stdlog "log"
+	"math"
 	"net"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/packet"
 	"github.com/optmzr/d7024e-dht/route"
 	"github.com/optmzr/d7024e-dht/store"
 )
 
-const value = "ABC, du är mina tankar."
+var value = []byte("ABC, du är mina tankar.")
 
 var nAddr *net.UDPAddr
 var mAddr *net.UDPAddr
@@ -55,19 +61,25 @@ func init() {
 	mAddr, err = net.ResolveUDPAddr("udp", "127.0.0.1:8119")
 	panicOnErr(err)
 
+	nKey, err := node.NewKey()
+	panicOnErr(err)
+
+	mKey, err := node.NewKey()
+	panicOnErr(err)
+
 	nNode = route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  nKey.ID(),
 		Address: *nAddr,
 	}
 	mNode = route.Contact{
-		NodeID:  node.NewID(),
+		NodeID:  mKey.ID(),
 		Address: *mAddr,
 	}
 
-	n, err = NewUDPNetwork(nNode)
+	n, err = NewUDPNetwork(nNode, nKey, Config{})
 	panicOnErr(err)
 
-	m, err = NewUDPNetwork(mNode)
+	m, err = NewUDPNetwork(mNode, mKey, Config{})
 	panicOnErr(err)
 
 	go func(n Network) {
@@ -95,7 +107,7 @@ func TestFindValue_value(t *testing.T) {
 	rng = nextFakeID([]byte{1})
 
 	// Send a FindValue request to a node at mNode
-	ch, err := n.FindValue(store.Key{}, *mAddr)
+	ch, err := n.FindValue(context.Background(), store.Key{}, *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -109,7 +121,7 @@ func TestFindValue_value(t *testing.T) {
 	}
 
 	// Respond to a FindValue request with a value.
-	err = m.SendValue(store.Key{}, value, contacts, SessionID{1}, *nAddr)
+	err = m.SendValue(store.Item{Value: value}, true, contacts, SessionID{1}, *nAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -123,8 +135,8 @@ func TestFindValue_value(t *testing.T) {
 		t.Errorf("unexpected number of contacts in closest, got: %v, exp: 5", r.Closest())
 	}
 
-	res := r.Value()
-	if res != value {
+	res, found := r.Value()
+	if !found || !bytes.Equal(res, value) {
 		t.Errorf("Expected: %s Got: %s", value, res)
 	}
 }
@@ -133,13 +145,13 @@ func TestFindValue_contacts(t *testing.T) {
 	rng = nextFakeID([]byte{2})
 
 	// Send a FindValue request to a node at mNode
-	ch, err := n.FindValue(store.Key{}, *mAddr)
+	ch, err := n.FindValue(context.Background(), store.Key{}, *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
 
 	// Respond to a FindValue request with a list of contacts
-	err = n.SendValue(store.Key{}, value, []route.Contact{}, SessionID{2}, *nAddr)
+	err = n.SendValue(store.Item{Value: value}, true, []route.Contact{}, SessionID{2}, *nAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -148,19 +160,66 @@ func TestFindValue_contacts(t *testing.T) {
 	if r == nil {
 		t.Errorf("unexpected nil channel")
 	}
-	res := r.Value()
+	res, found := r.Value()
 
-	if res != value {
+	if !found || !bytes.Equal(res, value) {
 		t.Errorf("Expected: %s Got: %s", value, res)
 	}
 }
 
+func TestFindValue_empty(t *testing.T) {
+	rng = nextFakeID([]byte{8})
+
+	ch, err := n.FindValue(context.Background(), store.Key{}, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Respond with an empty value, which is distinct from no value.
+	err = m.SendValue(store.Item{Value: []byte{}}, true, nil, SessionID{8}, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-ch
+	res, found := r.Value()
+	if !found {
+		t.Error("expected empty value to be found")
+	}
+	if len(res) != 0 {
+		t.Errorf("unexpected value, got: %x, exp: empty", res)
+	}
+}
+
+func TestFindValue_notFound(t *testing.T) {
+	rng = nextFakeID([]byte{9})
+
+	ch, err := n.FindValue(context.Background(), store.Key{}, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	contacts := []route.Contact{route.NewContact(node.NewID(), net.UDPAddr{})}
+	err = m.SendValue(store.Item{}, false, contacts, SessionID{9}, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-ch
+	if _, found := r.Value(); found {
+		t.Error("unexpected value in result")
+	}
+	if len(r.Closest()) != len(contacts) {
+		t.Errorf("unexpected number of contacts in closest, got: %v, exp: %d", r.Closest(), len(contacts))
+	}
+}
+
 func TestPingPongShow_correctChallengeReply(t *testing.T) {
 	rng = nextFakeID([]byte{3})
 
 	correctChallenge := []byte{254}
 
-	res, _, err := n.Ping(*mAddr)
+	res, _, err := n.Ping(context.Background(), *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -178,6 +237,11 @@ func TestPingPongShow_correctChallengeReply(t *testing.T) {
 	if comp != 0 {
 		t.Errorf("Got: %v Expected: %v", rc, correctChallenge)
 	}
+
+	// The ID of the node is learned from the pong.
+	if !r.From.NodeID.Equal(mNode.NodeID) {
+		t.Errorf("unexpected sender, got: %v, exp: %v", r.From.NodeID, mNode.NodeID)
+	}
 }
 
 func TestPingPongShow_wrongChallengeReply(t *testing.T) {
@@ -186,7 +250,7 @@ func TestPingPongShow_wrongChallengeReply(t *testing.T) {
 	correctChallenge := []byte{254}
 	wrongChallenge := []byte{0}
 
-	res, _, err := n.Ping(*mAddr)
+	res, _, err := n.Ping(context.Background(), *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -209,7 +273,7 @@ func TestPingPongShow_wrongChallengeReply(t *testing.T) {
 func TestFindNodes_closest(t *testing.T) {
 	rng = nextFakeID([]byte{5})
 
-	ch, err := n.FindNodes(node.ID{}, *mAddr)
+	ch, err := n.FindNodes(context.Background(), node.ID{}, *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
@@ -228,8 +292,8 @@ func TestFindNodes_closest(t *testing.T) {
 
 	r := <-ch
 
-	if r.Value() != "" {
-		t.Errorf("unexpected value in result, got: %v, exp: \"\" (none)", r.Value())
+	if res, found := r.Value(); found {
+		t.Errorf("unexpected value in result, got: %v, exp: (none)", res)
 	}
 
 	if len(r.Closest()) != len(contacts) {
@@ -243,21 +307,649 @@ func TestFindNodes_closest(t *testing.T) {
 
 func TestStore(t *testing.T) {
 	rng = nextFakeID([]byte{6})
-	value := "ABC, du är mina tankar"
+	value := []byte("ABC, du är mina tankar")
 	key := store.Key{1}
 
-	err := n.Store(key, value, StoreClassPublish, *mAddr)
+	publisher, privateKey, _ := ed25519.GenerateKey(nil)
+
+	item := store.SignItem(store.Item{Key: key, Value: value, TTL: 10 * time.Minute}, privateKey, time.Now())
+	ch, err := n.Store(context.Background(), item, StoreClassPublish, *mAddr)
 	if err != nil {
 		t.Error(err)
 	}
 
 	r := <-m.StoreRequestCh()
 
-	if r.Value != value {
+	if !bytes.Equal(r.Value, value) {
 		t.Errorf("unexpected value in request, got: %s, exp: %s", r.Value, value)
 	}
 
+	if !bytes.Equal(r.Publisher, publisher) {
+		t.Errorf("unexpected publisher in request, got: %x, exp: %x", r.Publisher, publisher)
+	}
+
+	if !r.Published.Equal(item.Published) || !bytes.Equal(r.Signature, item.Signature) {
+		t.Errorf("unexpected signature in request, got: %v %x, exp: %v %x", r.Published, r.Signature, item.Published, item.Signature)
+	}
+
+	if r.Key != key {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", r.Key, key)
+	}
+
+	if r.TTL != item.TTL {
+		t.Errorf("unexpected TTL in request, got: %v, exp: %v", r.TTL, item.TTL)
+	}
+
+	if !r.From.NodeID.Equal(nNode.NodeID) {
+		t.Errorf("unexpected from node ID in request, got: %v, exp: %v", r.From.NodeID, nNode.NodeID)
+	}
+
+	err = m.SendStoreAck(r.Key, r.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ack := <-ch
+	if ack == nil {
+		t.Fatal("unexpected nil acknowledgement")
+	}
+
+	if ack.Key != key {
+		t.Errorf("unexpected key in acknowledgement, got: %v, exp: %v", ack.Key, key)
+	}
+}
+
+func TestPacketTTL(t *testing.T) {
+	for _, tc := range []struct {
+		ttl time.Duration
+		exp time.Duration
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Nanosecond, time.Millisecond}, // Never sent as no limit.
+		{1500 * time.Microsecond, 2 * time.Millisecond},
+		{10 * time.Minute, 10 * time.Minute},
+	} {
+		if got := fromPacketTTL(toPacketTTL(tc.ttl)); got != tc.exp {
+			t.Errorf("unexpected TTL for %v, got: %v, exp: %v", tc.ttl, got, tc.exp)
+		}
+	}
+
+	if got := fromPacketTTL(math.MaxUint64); got <= 0 {
+		t.Errorf("unexpected TTL for max milliseconds, got: %v", got)
+	}
+}
+
+func TestStore_record(t *testing.T) {
+	rng = nextFakeID([]byte{10})
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	item := store.NewRecord(privateKey, []byte("config"), 7, []byte("ABC, du är mina tankar"))
+
+	_, err := n.Store(context.Background(), item, StoreClassPublish, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-m.StoreRequestCh()
+	if r.Record == nil {
+		t.Fatal("expected record in request")
+	}
+
+	got := store.Item{Key: r.Key, Value: r.Value, Publisher: r.Publisher, Record: r.Record}
+	if err := got.Verify(); err != nil {
+		t.Errorf("unexpected error verifying received record: %v", err)
+	}
+	if r.Record.Seq != 7 {
+		t.Errorf("unexpected sequence number, got: %d, exp: %d", r.Record.Seq, 7)
+	}
+
+	// Respond with the record to a FindValue request.
+	ch, err := n.FindValue(context.Background(), item.Key, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = m.SendValue(item, true, nil, SessionID{10}, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res := <-ch
+	if res.Record() == nil || res.Record().Seq != 7 {
+		t.Errorf("unexpected record in result: %+v", res.Record())
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	rng = nextFakeID([]byte{11})
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	item := store.NewRecord(privateKey, []byte("config"), 8, []byte("ABC, du är mina tankar"))
+
+	ch, err := n.CompareAndSwap(context.Background(), item, 7, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-m.StoreRequestCh()
+	if !r.CAS || r.Expected != 7 || r.Class != StoreClassPublish {
+		t.Errorf("unexpected compare-and-swap in request, got: %v %d %v", r.CAS, r.Expected, r.Class)
+	}
+
+	err = m.SendStoreConflict(r.Key, 9, r.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ack := <-ch
+	if ack == nil {
+		t.Fatal("unexpected nil acknowledgement")
+	}
+	if !ack.Conflict || ack.Seq != 9 {
+		t.Errorf("unexpected acknowledgement, got: %+v", ack)
+	}
+}
+
+func TestStoreRefusal(t *testing.T) {
+	rng = nextFakeID([]byte{13})
+
+	value := []byte("ABC, du är mina tankar")
+	item := store.Item{Key: store.KeyFromValue(value), Value: value}
+
+	ch, err := n.Store(context.Background(), item, StoreClassPublish, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-m.StoreRequestCh()
+	err = m.SendStoreRefusal(r.Key, r.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ack := <-ch
+	if ack == nil {
+		t.Fatal("unexpected nil acknowledgement")
+	}
+	if !ack.Refused || ack.Key != item.Key {
+		t.Errorf("unexpected acknowledgement, got: %+v", ack)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	rng = nextFakeID([]byte{12})
+	key := store.Key{2}
+
+	ack, err := n.AddProvider(context.Background(), key, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-m.AddProviderRequestCh()
+	if r.Key != key {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", r.Key, key)
+	}
+
+	// The provider is the sender, at the address it sent from.
+	if !r.From.NodeID.Equal(nNode.NodeID) || r.From.Address.Port != nAddr.Port {
+		t.Errorf("unexpected provider in request, got: %v, exp: %v", r.From, nNode)
+	}
+
+	err = m.SendStoreAck(r.Key, r.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+	if <-ack == nil {
+		t.Fatal("unexpected nil acknowledgement")
+	}
+
+	ch, err := n.GetProviders(context.Background(), key, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	g := <-m.GetProvidersRequestCh()
+	if g.Key != key {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", g.Key, key)
+	}
+
+	closest := []route.Contact{{NodeID: node.NewID(), Address: *mAddr}}
+	err = m.SendProviders(g.Key, []route.Contact{r.From}, closest, g.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	res := <-ch
+	if res == nil {
+		t.Fatal("unexpected nil result")
+	}
+	if len(res.Providers()) != 1 || !res.Providers()[0].NodeID.Equal(nNode.NodeID) {
+		t.Errorf("unexpected providers in result, got: %v, exp: %v", res.Providers(), nNode)
+	}
+	if len(res.Closest()) != 1 || !res.Closest()[0].NodeID.Equal(closest[0].NodeID) {
+		t.Errorf("unexpected closest in result, got: %v, exp: %v", res.Closest(), closest)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	rng = nextFakeID([]byte{7})
+	key := store.Key{1}
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	tombstone := store.NewTombstone(key, privateKey, time.Now())
+
+	ch, err := n.Delete(context.Background(), tombstone, *mAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	r := <-m.DeleteRequestCh()
+
+	if err := r.Tombstone.Verify(); err != nil {
+		t.Errorf("unexpected invalid tombstone in request: %v", err)
+	}
+
+	if !r.Tombstone.Time.Equal(tombstone.Time) {
+		t.Errorf("unexpected time in request, got: %v, exp: %v", r.Tombstone.Time, tombstone.Time)
+	}
+
+	if r.Tombstone.Key != key {
+		t.Errorf("unexpected key in request, got: %v, exp: %v", r.Tombstone.Key, key)
+	}
+
 	if !r.From.NodeID.Equal(nNode.NodeID) {
 		t.Errorf("unexpected from node ID in request, got: %v, exp: %v", r.From.NodeID, nNode.NodeID)
 	}
+
+	err = m.SendStoreAck(r.Tombstone.Key, r.SessionID, *nAddr)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if ack := <-ch; ack == nil {
+		t.Fatal("unexpected nil acknowledgement")
+	}
+}
+
+// sendRaw sends a ping packet from the sender, wrapped in an envelope signed by
+// the key, to the address.
+func sendRaw(t *testing.T, sender node.ID, key node.Key, addr *net.UDPAddr) {
+	sendPacket(t, &packet.Packet{
+		SessionId: []byte{9},
+		SenderId:  sender.Bytes(),
+		Payload:   &packet.Packet_Ping{Ping: &packet.Ping{Challenge: []byte{9}}},
+	}, key, addr)
+}
+
+// sendPacket sends the packet wrapped in an envelope signed by the key to the
+// address.
+func sendPacket(t *testing.T, p *packet.Packet, key node.Key, addr *net.UDPAddr) {
+	b, err := proto.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = proto.Marshal(&packet.Envelope{
+		Packet:    b,
+		PublicKey: key.Public(),
+		Signature: key.Sign(b),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandlePacket_signature(t *testing.T) {
+	oAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8120")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oKey, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := NewUDPNetwork(route.NewContact(oKey.ID(), *oAddr), oKey, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Listen()
+	<-o.ReadyCh()
+
+	key, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed with a key that doesn't belong to the sender ID.
+	sendRaw(t, nNode.NodeID, key, oAddr)
+
+	select {
+	case r := <-o.PongRequestCh():
+		t.Errorf("unexpected request from forged sender: %v", r.From.NodeID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sendRaw(t, key.ID(), key, oAddr)
+
+	select {
+	case r := <-o.PongRequestCh():
+		if !r.From.NodeID.Equal(key.ID()) {
+			t.Errorf("unexpected sender, got: %v, exp: %v", r.From.NodeID, key.ID())
+		}
+	case <-time.After(time.Second):
+		t.Error("expected request from signed sender")
+	}
+}
+
+func TestNewUDPNetwork_keyMismatch(t *testing.T) {
+	key, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewUDPNetwork(route.NewContact(node.NewID(), *nAddr), key, Config{})
+	if err == nil {
+		t.Error("expected error for node ID not derived from the key")
+	}
+}
+
+func TestNewUDPNetwork_clock(t *testing.T) {
+	key, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	nw, err := NewUDPNetwork(route.NewContact(key.ID(), *nAddr), key, Config{Clock: c})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The requests time out by the clock of the network.
+	id := generateID()
+	ch := makeResultChan()
+	nw.(*udpNetwork).pt.Put(context.Background(), id, ch)
+
+	c.Advance(2 * DefaultTimeout)
+
+	select {
+	case v := <-ch:
+		if v != nil {
+			t.Errorf("expected to receive nil value from channel, got: %v", v)
+		}
+	case <-time.After(DefaultTimeout / 2):
+		t.Error("expected request to time out by the fake clock")
+	}
+}
+
+func TestEncryption_required(t *testing.T) {
+	oAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8121")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8122")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oKey, _ := node.NewKey()
+	pKey, _ := node.NewKey()
+
+	cfg := Config{Encryption: EncryptionRequired}
+
+	o, err := NewUDPNetwork(route.NewContact(oKey.ID(), *oAddr), oKey, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewUDPNetwork(route.NewContact(pKey.ID(), *pAddr), pKey, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Listen()
+	go p.Listen()
+	<-o.ReadyCh()
+	<-p.ReadyCh()
+
+	key, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed, but not encrypted.
+	sendRaw(t, key.ID(), key, oAddr)
+
+	select {
+	case r := <-o.PongRequestCh():
+		t.Errorf("unexpected plaintext request from: %v", r.From.NodeID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, _, err = p.Ping(context.Background(), *oAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case r := <-o.PongRequestCh():
+		if !r.From.NodeID.Equal(pKey.ID()) {
+			t.Errorf("unexpected sender, got: %v, exp: %v", r.From.NodeID, pKey.ID())
+		}
+	case <-time.After(time.Second):
+		t.Error("expected encrypted request")
+	}
+}
+
+func TestEncryption_disabledPeer(t *testing.T) {
+	oAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8123")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oKey, _ := node.NewKey()
+
+	o, err := NewUDPNetwork(route.NewContact(oKey.ID(), *oAddr), oKey, Config{Encryption: EncryptionRequired})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.Listen()
+	<-o.ReadyCh()
+
+	// The handshake is never answered by the plaintext only network at nAddr.
+	_, _, err = o.Ping(context.Background(), *nAddr)
+	if err == nil {
+		t.Error("expected error for peer without encryption")
+	}
+}
+
+func TestPreSharedKey(t *testing.T) {
+	psk := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+
+	var networks []Network
+	var keys []node.Key
+	for i, k := range [][]byte{psk, psk, other} {
+		addr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8124 + i}
+		key, _ := node.NewKey()
+
+		nw, err := NewUDPNetwork(route.NewContact(key.ID(), addr), key, Config{PreSharedKey: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go nw.Listen()
+		<-nw.ReadyCh()
+
+		networks = append(networks, nw)
+		keys = append(keys, key)
+	}
+	o, p, q := networks[0], networks[1], networks[2]
+	oAddr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8124}
+
+	// Without a MAC.
+	key, _ := node.NewKey()
+	sendRaw(t, key.ID(), key, &oAddr)
+
+	// With a MAC of another key.
+	_, _, err := q.Ping(context.Background(), oAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case r := <-o.PongRequestCh():
+		t.Errorf("unexpected request from outside of the network: %v", r.From.NodeID)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, _, err = p.Ping(context.Background(), oAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case r := <-o.PongRequestCh():
+		if !r.From.NodeID.Equal(keys[1].ID()) {
+			t.Errorf("unexpected sender, got: %v, exp: %v", r.From.NodeID, keys[1].ID())
+		}
+	case <-time.After(time.Second):
+		t.Error("expected request from inside of the network")
+	}
+}
+
+func TestNewUDPNetwork_shortPreSharedKey(t *testing.T) {
+	key, _ := node.NewKey()
+
+	_, err := NewUDPNetwork(route.NewContact(key.ID(), *nAddr), key, Config{PreSharedKey: []byte{1}})
+	if err == nil {
+		t.Error("expected error for short pre-shared key")
+	}
+}
+
+func TestClose(t *testing.T) {
+	oAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:8127")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oKey, _ := node.NewKey()
+
+	o, err := NewUDPNetwork(route.NewContact(oKey.ID(), *oAddr), oKey, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listening := make(chan error)
+	go func() {
+		listening <- o.Listen()
+	}()
+	<-o.ReadyCh()
+
+	// Unanswered, as nobody listens at the address.
+	ch, _, err := o.Ping(context.Background(), net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 8128})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = o.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-listening:
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected listen to return after close")
+	}
+
+	select {
+	case r := <-ch:
+		if r != nil {
+			t.Errorf("unexpected ping result: %v", r)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Error("expected pending ping to be cancelled by close")
+	}
+
+	err = o.Listen()
+	if err != ErrClosed {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrClosed)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	err := n.Leave(*mAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-m.LeaveRequestCh():
+		if !r.From.NodeID.Equal(nNode.NodeID) {
+			t.Errorf("unexpected sender, got: %v, exp: %v", r.From.NodeID, nNode.NodeID)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected leave request")
+	}
+}
+
+func TestLeave_replay(t *testing.T) {
+	key, err := node.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leave := func(at time.Time) *packet.Packet {
+		return &packet.Packet{
+			SenderId: key.ID().Bytes(),
+			Payload:  &packet.Packet_Leave{Leave: &packet.Leave{Time: at.UnixNano()}},
+		}
+	}
+
+	expect := func(accepted bool) {
+		t.Helper()
+		select {
+		case r := <-m.LeaveRequestCh():
+			if !accepted {
+				t.Errorf("unexpected leave request from: %v", r.From.NodeID)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if accepted {
+				t.Error("expected leave request")
+			}
+		}
+	}
+
+	now := time.Now()
+	sendPacket(t, leave(now), key, mAddr)
+	expect(true)
+
+	// The same leave is only accepted once.
+	sendPacket(t, leave(now), key, mAddr)
+	expect(false)
+
+	// Leaves outside of the window are rejected.
+	sendPacket(t, leave(now.Add(-2*LeaveWindow)), key, mAddr)
+	expect(false)
+	sendPacket(t, leave(now.Add(2*LeaveWindow)), key, mAddr)
+	expect(false)
+
+	// A later leave, after the node came back, is accepted.
+	sendPacket(t, leave(now.Add(time.Second)), key, mAddr)
+	expect(true)
 }
@@ -0,0 +1,192 @@
+package network
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+const exchangeKeySize = 32
+
+const sessionInfo = "camomile session"
+
+// sessions keeps the X25519 keypair of the local node, and the keys shared
+// with the peers that it has exchanged public keys with. The keypair is
+// generated for every run, so that past sessions can't be decrypted if the key
+// of the node leaks. The key of a peer is bound to the node ID that signed it,
+// so that another node can't replace it by spoofing the address of the peer.
+type sessions struct {
+	private [exchangeKeySize]byte
+	public  [exchangeKeySize]byte
+	peers   map[string]*peer
+	sync.Mutex
+}
+
+type peer struct {
+	id     node.ID // The node that signed the public key.
+	public [exchangeKeySize]byte
+	aead   cipher.AEAD
+	known  chan struct{} // Closed when the public key of the peer is known.
+}
+
+func newSessions() (*sessions, error) {
+	s := &sessions{
+		peers: make(map[string]*peer),
+	}
+
+	_, err := io.ReadFull(rand.Reader, s.private[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate exchange key: %w", err)
+	}
+	curve25519.ScalarBaseMult(&s.public, &s.private)
+
+	return s, nil
+}
+
+// derive creates the AEAD for the key shared with the owner of the public key.
+func (s *sessions) derive(public []byte) (cipher.AEAD, error) {
+	if len(public) != exchangeKeySize {
+		return nil, errors.New("invalid exchange key")
+	}
+
+	var theirs, shared [exchangeKeySize]byte
+	copy(theirs[:], public)
+	curve25519.ScalarMult(&shared, &s.private, &theirs)
+
+	var zero [exchangeKeySize]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.New("exchange key of low order")
+	}
+
+	// Both sides must derive the same key, so the public keys are added to the
+	// info in the same order.
+	info := []byte(sessionInfo)
+	if string(s.public[:]) < string(public) {
+		info = append(append(info, s.public[:]...), public...)
+	} else {
+		info = append(append(info, public...), s.public[:]...)
+	}
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+// peer returns the peer at the address, it's created if it doesn't exist.
+// Requires the lock to be held.
+func (s *sessions) peer(addr net.UDPAddr) *peer {
+	p, ok := s.peers[addr.String()]
+	if !ok {
+		p = &peer{known: make(chan struct{})}
+		s.peers[addr.String()] = p
+	}
+	return p
+}
+
+// learn records the public key of the peer at the address, signed by the node
+// with the ID. The key is only replaced by a key signed by the same node.
+func (s *sessions) learn(addr net.UDPAddr, id node.ID, public []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.peer(addr)
+	if p.aead != nil && !p.id.Equal(id) {
+		return fmt.Errorf("exchange key of %v is signed by another node: %v", addr.String(), p.id)
+	}
+	if p.aead != nil && subtle.ConstantTimeCompare(p.public[:], public) == 1 {
+		return nil // Already known.
+	}
+
+	aead, err := s.derive(public)
+	if err != nil {
+		return err
+	}
+
+	p.id = id
+	copy(p.public[:], public)
+	if p.aead == nil {
+		close(p.known)
+	}
+	p.aead = aead
+
+	return nil
+}
+
+// lookup returns the AEAD for the peer at the address, if its public key is
+// known.
+func (s *sessions) lookup(addr net.UDPAddr) (cipher.AEAD, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	p, ok := s.peers[addr.String()]
+	if !ok || p.aead == nil {
+		return nil, false
+	}
+	return p.aead, true
+}
+
+// known returns a channel that is closed when the public key of the peer at
+// the address is known.
+func (s *sessions) known(addr net.UDPAddr) chan struct{} {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.peer(addr).known
+}
+
+// seal encrypts the data for a peer.
+func (s *sessions) seal(aead cipher.AEAD, b []byte) (nonce, sealed []byte, err error) {
+	nonce = make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The public key is authenticated as additional data.
+	return nonce, aead.Seal(nil, nonce, b, s.public[:]), nil
+}
+
+// open decrypts the data sealed by the owner of the public key, received from
+// the address.
+func (s *sessions) open(addr net.UDPAddr, public, nonce, sealed []byte) ([]byte, error) {
+	var aead cipher.AEAD
+
+	s.Lock()
+	p, ok := s.peers[addr.String()]
+	if ok && p.aead != nil && subtle.ConstantTimeCompare(p.public[:], public) == 1 {
+		aead = p.aead
+	}
+	s.Unlock()
+
+	if aead == nil {
+		// The peer is new or has a new key, the key is not learned until the
+		// decrypted packet has been verified.
+		var err error
+		aead, err = s.derive(public)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+
+	return aead.Open(nil, nonce, sealed, public)
+}
@@ -0,0 +1,128 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+func TestSessions_sealOpen(t *testing.T) {
+	a, err := newSessions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := newSessions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	aAddr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+	bAddr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 2}
+
+	if _, ok := a.lookup(bAddr); ok {
+		t.Fatal("unexpected session before the exchange key is known")
+	}
+
+	known := a.known(bAddr)
+
+	err = a.learn(bAddr, node.NewID(), b.public[:])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-known:
+	default:
+		t.Error("expected exchange key to be known")
+	}
+
+	aead, ok := a.lookup(bAddr)
+	if !ok {
+		t.Fatal("expected session after the exchange key is known")
+	}
+
+	message := []byte("ABC, du är mina tankar")
+	nonce, sealed, err := a.seal(aead, message)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if bytes.Contains(sealed, message) {
+		t.Error("expected message to be encrypted")
+	}
+
+	opened, err := b.open(aAddr, a.public[:], nonce, sealed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(opened, message) {
+		t.Errorf("unexpected message, got: %s, exp: %s", opened, message)
+	}
+
+	sealed[0] ^= 1
+	_, err = b.open(aAddr, a.public[:], nonce, sealed)
+	if err == nil {
+		t.Error("expected error for tampered message")
+	}
+	sealed[0] ^= 1
+
+	c, _ := newSessions()
+	_, err = c.open(aAddr, a.public[:], nonce, sealed)
+	if err == nil {
+		t.Error("expected error for message sealed for another node")
+	}
+}
+
+func TestSessions_learnInvalid(t *testing.T) {
+	s, err := newSessions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	addr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+
+	err = s.learn(addr, node.NewID(), []byte{1, 2, 3})
+	if err == nil {
+		t.Error("expected error for short exchange key")
+	}
+
+	// The identity element is of low order.
+	err = s.learn(addr, node.NewID(), make([]byte, exchangeKeySize))
+	if err == nil {
+		t.Error("expected error for exchange key of low order")
+	}
+}
+
+func TestSessions_learnSpoofed(t *testing.T) {
+	s, err := newSessions()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	victim, _ := newSessions()
+	spoofer, _ := newSessions()
+
+	addr := net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+	id := node.NewID()
+
+	err = s.learn(addr, id, victim.public[:])
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Another node can't replace the key by spoofing the address.
+	err = s.learn(addr, node.NewID(), spoofer.public[:])
+	if err == nil {
+		t.Error("expected error for exchange key signed by another node")
+	}
+	if p := s.peers[addr.String()]; p.public != victim.public {
+		t.Error("expected exchange key of the victim to be kept")
+	}
+
+	// The node itself can replace its key, e.g. after a restart.
+	err = s.learn(addr, id, spoofer.public[:])
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+// Package sim implements an in-process switchboard that simulates a packet
+// switched network. Every node gets an in-memory packet connection that is used
+// by the regular network implementation, so multiple DHT nodes can run in the
+// same process without opening any sockets.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"math/rand" // Insecure on purpose, only used for simulations.
+	"net"
+	"sync"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/network"
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// inboxSize is the number of packets that can be queued for a connection
+// before new packets are dropped, similar to the receive buffer of a socket.
+const inboxSize = 1024
+
+// Link describes the properties of the path between two addresses.
+type Link struct {
+	Latency time.Duration // Delay added to every packet.
+	Jitter  time.Duration // Random delay in [0, Jitter) added to every packet, reorders packets.
+	Loss    float64       // Probability, between 0 and 1, that a packet is dropped.
+	Down    bool          // Partitioned link, every packet is dropped.
+}
+
+type link struct {
+	from string
+	to   string
+}
+
+// Switchboard connects the simulated connections with each other.
+type Switchboard struct {
+	conns       map[string]*conn
+	links       map[link]Link
+	defaultLink Link
+	rng         *rand.Rand
+	rngMu       sync.Mutex
+	sync.RWMutex
+}
+
+type datagram struct {
+	b    []byte
+	from net.UDPAddr
+}
+
+// conn implements the net.PacketConn interface on top of a switchboard.
+type conn struct {
+	sb        *Switchboard
+	addr      net.UDPAddr
+	inbox     chan datagram
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var errClosed = errors.New("use of closed simulated connection")
+
+// NewSwitchboard creates a new switchboard. The seed is used for the random
+// packet loss and jitter, so that simulations can be reproduced.
+func NewSwitchboard(seed int64) *Switchboard {
+	return &Switchboard{
+		conns: make(map[string]*conn),
+		links: make(map[link]Link),
+		rng:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetDefaultLink sets the link properties used between all addresses that do
+// not have a specific link set.
+func (s *Switchboard) SetDefaultLink(l Link) {
+	s.Lock()
+	s.defaultLink = l
+	s.Unlock()
+}
+
+// SetLink sets the link properties between two addresses, in both directions.
+func (s *Switchboard) SetLink(a, b net.UDPAddr, l Link) {
+	s.Lock()
+	s.links[link{from: a.String(), to: b.String()}] = l
+	s.links[link{from: b.String(), to: a.String()}] = l
+	s.Unlock()
+}
+
+// Partition drops all packets between two addresses until Heal is called.
+func (s *Switchboard) Partition(a, b net.UDPAddr) {
+	s.setDown(a, b, true)
+}
+
+// Heal restores a link that has been partitioned.
+func (s *Switchboard) Heal(a, b net.UDPAddr) {
+	s.setDown(a, b, false)
+}
+
+func (s *Switchboard) setDown(a, b net.UDPAddr, down bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, k := range []link{
+		{from: a.String(), to: b.String()},
+		{from: b.String(), to: a.String()},
+	} {
+		l, ok := s.links[k]
+		if !ok {
+			l = s.defaultLink
+		}
+		l.Down = down
+		s.links[k] = l
+	}
+}
+
+// Listen creates a simulated packet connection bound to the address.
+func (s *Switchboard) Listen(addr net.UDPAddr) (net.PacketConn, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("address already in use: %v", addr.String())
+	}
+
+	c := &conn{
+		sb:    s,
+		addr:  addr,
+		inbox: make(chan datagram, inboxSize),
+		done:  make(chan struct{}),
+	}
+	s.conns[addr.String()] = c
+
+	return c, nil
+}
+
+// NewNetwork creates a network for the local contact that sends and receives
+// its packets through the switchboard, configured by the configuration.
+func (s *Switchboard) NewNetwork(me route.Contact, key node.Key, cfg network.Config) (network.Network, error) {
+	c, err := s.Listen(me.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	nw, err := network.NewPacketNetwork(me, key, c, cfg)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return nw, nil
+}
+
+func (s *Switchboard) link(from, to net.UDPAddr) Link {
+	s.RLock()
+	defer s.RUnlock()
+
+	l, ok := s.links[link{from: from.String(), to: to.String()}]
+	if !ok {
+		return s.defaultLink
+	}
+	return l
+}
+
+// float64 and int63n guard the random source, as it's not safe for concurrent
+// use.
+func (s *Switchboard) float64() float64 {
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	return s.rng.Float64()
+}
+
+func (s *Switchboard) int63n(n int64) int64 {
+	s.rngMu.Lock()
+	defer s.rngMu.Unlock()
+	return s.rng.Int63n(n)
+}
+
+// send delivers a packet to the connection bound to the destination address,
+// with respect to the link properties. Packets to unknown addresses are
+// silently dropped, like UDP.
+func (s *Switchboard) send(from, to net.UDPAddr, b []byte) {
+	l := s.link(from, to)
+
+	if l.Down || (l.Loss > 0 && s.float64() < l.Loss) {
+		return // Dropped.
+	}
+
+	delay := l.Latency
+	if l.Jitter > 0 {
+		delay += time.Duration(s.int63n(int64(l.Jitter)))
+	}
+
+	d := datagram{b: b, from: from}
+	if delay <= 0 {
+		s.deliver(to, d)
+		return
+	}
+
+	time.AfterFunc(delay, func() {
+		s.deliver(to, d)
+	})
+}
+
+func (s *Switchboard) deliver(to net.UDPAddr, d datagram) {
+	s.RLock()
+	c, ok := s.conns[to.String()]
+	s.RUnlock()
+
+	if !ok {
+		return // Nobody listening.
+	}
+
+	select {
+	case c.inbox <- d:
+	case <-c.done:
+	default:
+		// Inbox full, drop the packet.
+	}
+}
+
+func (c *conn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case d := <-c.inbox:
+		from := d.from
+		return copy(p, d.b), &from, nil
+	case <-c.done:
+		return 0, nil, errClosed
+	}
+}
+
+func (c *conn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-c.done:
+		return 0, errClosed
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unexpected address type: %T", addr)
+	}
+
+	// Copy the packet, the caller is allowed to reuse the buffer.
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	c.sb.send(c.addr, *to, b)
+	return len(p), nil
+}
+
+// Close closes the connection and releases its address on the switchboard.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.sb.Lock()
+		delete(c.sb.conns, c.addr.String())
+		c.sb.Unlock()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	addr := c.addr
+	return &addr
+}
+
+// Deadlines are not supported by the simulated connection.
+func (c *conn) SetDeadline(t time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
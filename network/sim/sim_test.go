@@ -0,0 +1,250 @@
+package sim
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/network"
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+func init() {
+	// Disable all logging.
+	log.Logger = zerolog.New(ioutil.Discard)
+}
+
+func addr(port int) net.UDPAddr {
+	return net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: port}
+}
+
+func listen(t *testing.T, sb *Switchboard, port int) net.PacketConn {
+	c, err := sb.Listen(addr(port))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func write(t *testing.T, c net.PacketConn, b []byte, port int) {
+	to := addr(port)
+	_, err := c.WriteTo(b, &to)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// packets reads all packets from the connection into a channel.
+func packets(c net.PacketConn) chan []byte {
+	ch := make(chan []byte, inboxSize)
+	go func() {
+		for {
+			b := make([]byte, 64)
+			n, _, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			ch <- b[:n]
+		}
+	}()
+	return ch
+}
+
+// read reads a packet or returns nil if nothing is received within the timeout.
+func read(ch chan []byte, timeout time.Duration) []byte {
+	select {
+	case b := <-ch:
+		return b
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestListen_inUse(t *testing.T) {
+	sb := NewSwitchboard(1)
+	listen(t, sb, 1)
+
+	_, err := sb.Listen(addr(1))
+	if err == nil {
+		t.Error("expected error when address is already in use")
+	}
+}
+
+func TestSend(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+	b := packets(listen(t, sb, 2))
+
+	write(t, a, []byte("hej"), 2)
+
+	r := read(b, time.Second)
+	if !bytes.Equal(r, []byte("hej")) {
+		t.Errorf("unexpected packet, got: %q, exp: %q", r, "hej")
+	}
+}
+
+func TestSend_latency(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+	b := packets(listen(t, sb, 2))
+
+	sb.SetLink(addr(1), addr(2), Link{Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	write(t, a, []byte("hej"), 2)
+
+	r := read(b, time.Second)
+	if r == nil {
+		t.Fatal("expected packet")
+	}
+
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("packet arrived too early, after: %v", d)
+	}
+}
+
+func TestSend_loss(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+	b := packets(listen(t, sb, 2))
+
+	sb.SetLink(addr(1), addr(2), Link{Loss: 1})
+
+	write(t, a, []byte("hej"), 2)
+
+	if r := read(b, 50*time.Millisecond); r != nil {
+		t.Errorf("expected packet to be dropped, got: %q", r)
+	}
+}
+
+func TestSend_reorder(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+	b := packets(listen(t, sb, 2))
+
+	sb.SetLink(addr(1), addr(2), Link{Jitter: 20 * time.Millisecond})
+
+	n := 50
+	for i := 0; i < n; i++ {
+		write(t, a, []byte{byte(i)}, 2)
+	}
+
+	reordered := false
+	for i := 0; i < n; i++ {
+		r := read(b, time.Second)
+		if r == nil {
+			t.Fatalf("expected packet #%d", i)
+		}
+		if int(r[0]) != i {
+			reordered = true
+		}
+	}
+
+	if !reordered {
+		t.Error("expected packets to be reordered")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+	b := packets(listen(t, sb, 2))
+
+	sb.Partition(addr(1), addr(2))
+
+	write(t, a, []byte("hej"), 2)
+	if r := read(b, 50*time.Millisecond); r != nil {
+		t.Errorf("expected packet to be dropped, got: %q", r)
+	}
+
+	sb.Heal(addr(1), addr(2))
+
+	write(t, a, []byte("då"), 2)
+	if r := read(b, time.Second); !bytes.Equal(r, []byte("då")) {
+		t.Errorf("unexpected packet, got: %q, exp: %q", r, "då")
+	}
+}
+
+func TestClose(t *testing.T) {
+	sb := NewSwitchboard(1)
+	a := listen(t, sb, 1)
+
+	err := a.Close()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, _, err = a.ReadFrom(make([]byte, 1))
+	if err == nil {
+		t.Error("expected error when reading from closed connection")
+	}
+
+	// The address should be released.
+	listen(t, sb, 1)
+}
+
+func TestNewNetwork_ping(t *testing.T) {
+	for _, encryption := range []network.Encryption{
+		network.EncryptionDisabled,
+		network.EncryptionEnabled,
+		network.EncryptionRequired,
+	} {
+		t.Run(encryption.String(), func(t *testing.T) {
+			testNewNetworkPing(t, network.Config{Encryption: encryption})
+		})
+	}
+}
+
+func testNewNetworkPing(t *testing.T, cfg network.Config) {
+	sb := NewSwitchboard(1)
+
+	nKey, _ := node.NewKey()
+	mKey, _ := node.NewKey()
+
+	n := route.NewContact(nKey.ID(), addr(1))
+	m := route.NewContact(mKey.ID(), addr(2))
+
+	nw, err := sb.NewNetwork(n, nKey, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mw, err := sb.NewNetwork(m, mKey, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	go nw.Listen()
+	go mw.Listen()
+	<-nw.ReadyCh()
+	<-mw.ReadyCh()
+
+	ch, challenge, err := nw.Ping(context.Background(), m.Address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	request := <-mw.PongRequestCh()
+	if !request.From.NodeID.Equal(n.NodeID) {
+		t.Errorf("unexpected sender, got: %v, exp: %v", request.From.NodeID, n.NodeID)
+	}
+
+	err = mw.Pong(request.Challenge, request.SessionID, request.From.Address)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result := <-ch
+	if result == nil {
+		t.Fatal("ping timed out")
+	}
+	if !bytes.Equal(result.Challenge, challenge) {
+		t.Errorf("unexpected challenge, got: %x, exp: %x", result.Challenge, challenge)
+	}
+}
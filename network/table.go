@@ -1,40 +1,59 @@
 package network
 
 import (
+	"context"
 	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/clock"
 )
 
 type item struct {
 	result chan interface{}
 	ttl    time.Time
+	done   chan struct{}
 }
 
 type table struct {
-	items map[SessionID]item
-	ttl   time.Duration
+	items  map[SessionID]item
+	ttl    time.Duration
+	clock  clock.Clock
+	ticker *clock.Ticker
+	done   chan struct{}
+	closed bool
 	sync.Mutex
 }
 
 func makeResultChan() chan interface{} {
-	return make(chan interface{})
+	return make(chan interface{}, 1)
 }
 
-func newTable(ttl time.Duration, ticker *time.Ticker) *table {
+func newTable(ttl time.Duration, ticker *clock.Ticker, clk clock.Clock) *table {
 	t := &table{
-		ttl:   ttl,
-		items: make(map[SessionID]item),
+		ttl:    ttl,
+		clock:  clk,
+		items:  make(map[SessionID]item),
+		ticker: ticker,
+		done:   make(chan struct{}),
 	}
 
 	go func() {
-		for now := range ticker.C {
+		for {
+			var now time.Time
+			select {
+			case now = <-ticker.C:
+			case <-t.done:
+				return
+			}
+
 			t.Lock()
 			for k, v := range t.items {
 				if now.After(v.ttl) {
 					log.Debug().Msgf("Session timed out (ID: %v)", k)
 					v.result <- nil // Signal removal of channel.
+					close(v.done)
 					delete(t.items, k)
 				}
 			}
@@ -45,12 +64,46 @@ func newTable(ttl time.Duration, ticker *time.Ticker) *table {
 	return t
 }
 
-func (t *table) Put(id SessionID, ch chan interface{}) {
+// Put adds a session to the table. The session is removed when the table TTL
+// has passed, or when the context is done. If the context has a deadline it
+// replaces the TTL of the table.
+func (t *table) Put(ctx context.Context, id SessionID, ch chan interface{}) {
+	ttl := t.clock.Now().Add(t.ttl)
+	if deadline, ok := ctx.Deadline(); ok {
+		ttl = deadline
+	}
+
+	done := make(chan struct{})
+
 	t.Lock()
-	defer t.Unlock()
+	if t.closed {
+		t.Unlock()
+		ch <- nil // The session can never be answered.
+		return
+	}
 	t.items[id] = item{
 		result: ch,
-		ttl:    time.Now().Add(t.ttl),
+		ttl:    ttl,
+		done:   done,
+	}
+	t.Unlock()
+
+	if ctx.Done() != nil {
+		go t.watch(ctx, id, done)
+	}
+}
+
+// watch removes the session as soon as the context is done, unless the
+// session has already been removed.
+func (t *table) watch(ctx context.Context, id SessionID, done chan struct{}) {
+	select {
+	case <-ctx.Done():
+		ch, ok := t.Pop(id)
+		if ok {
+			log.Debug().Msgf("Session cancelled (ID: %v): %v", id, ctx.Err())
+			ch <- nil // Signal removal of channel.
+		}
+	case <-done:
 	}
 }
 
@@ -61,14 +114,46 @@ func (t *table) Get(id SessionID) (chan interface{}, bool) {
 	return i.result, ok
 }
 
+// Pop retrieves and removes a session from the table in one operation, this
+// makes sure that only one caller is able to respond to the session.
+func (t *table) Pop(id SessionID) (chan interface{}, bool) {
+	t.Lock()
+	defer t.Unlock()
+	i, ok := t.items[id]
+	if ok {
+		close(i.done)
+		delete(t.items, id)
+	}
+	return i.result, ok
+}
+
 func (t *table) Remove(id SessionID) {
+	t.Pop(id)
+}
+
+// close stops the ticker of the table and removes all sessions, the waiting
+// callers are signalled in the same way as when the sessions time out.
+func (t *table) close() {
 	t.Lock()
 	defer t.Unlock()
-	delete(t.items, id)
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+
+	t.ticker.Stop()
+	close(t.done)
+
+	for k, v := range t.items {
+		v.result <- nil // Signal removal of channel.
+		close(v.done)
+		delete(t.items, k)
+	}
 }
 
 func toPingResult(results chan interface{}) chan *PingResult {
-	ch := make(chan *PingResult)
+	ch := make(chan *PingResult, 1)
 	go func() {
 		r := <-results
 		if r == nil {
@@ -82,7 +167,7 @@ func toPingResult(results chan interface{}) chan *PingResult {
 }
 
 func toFindResult(results chan interface{}) chan FindResult {
-	ch := make(chan FindResult)
+	ch := make(chan FindResult, 1)
 	go func() {
 		r := <-results
 		if r == nil {
@@ -94,3 +179,17 @@ func toFindResult(results chan interface{}) chan FindResult {
 	}()
 	return ch
 }
+
+func toStoreResult(results chan interface{}) chan *StoreResult {
+	ch := make(chan *StoreResult, 1)
+	go func() {
+		r := <-results
+		if r == nil {
+			ch <- nil
+		} else {
+			ch <- r.(*StoreResult)
+		}
+		close(ch)
+	}()
+	return ch
+}
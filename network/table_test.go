@@ -1,20 +1,23 @@
 package network
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/optmzr/d7024e-dht/clock"
 )
 
 func TestTable_putGet(t *testing.T) {
 	// Create ticker that doesn't remove any element during the lifetime of this
 	// test.
-	ticker := time.NewTicker(time.Hour)
-	table := newTable(time.Hour, ticker)
+	ticker := clock.New().NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker, clock.New())
 
 	id := generateID()
 	ch := makeResultChan()
 
-	table.Put(id, ch)
+	table.Put(context.Background(), id, ch)
 
 	c, ok := table.Get(id)
 	if !ok {
@@ -34,13 +37,13 @@ func TestTable_putGet(t *testing.T) {
 func TestTable_remove(t *testing.T) {
 	// Create ticker that doesn't remove any element during the lifetime of this
 	// test.
-	ticker := time.NewTicker(time.Hour)
-	table := newTable(time.Hour, ticker)
+	ticker := clock.New().NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker, clock.New())
 
 	id := generateID()
 	ch := makeResultChan()
 
-	table.Put(id, ch)
+	table.Put(context.Background(), id, ch)
 
 	_, ok := table.Get(id)
 	if !ok {
@@ -57,7 +60,7 @@ func TestTable_remove(t *testing.T) {
 
 func TestTable_ttl(t *testing.T) {
 	tch := make(chan time.Time)
-	ticker := &time.Ticker{
+	ticker := &clock.Ticker{
 		C: tch,
 	}
 
@@ -70,8 +73,8 @@ func TestTable_ttl(t *testing.T) {
 	id := generateID()
 	ch := makeResultChan()
 
-	table := newTable(time.Nanosecond, ticker)
-	table.Put(id, ch)
+	table := newTable(time.Nanosecond, ticker, clock.New())
+	table.Put(context.Background(), id, ch)
 
 	select {
 	case v := <-ch: // Wait for removal.
@@ -88,3 +91,79 @@ func TestTable_ttl(t *testing.T) {
 		t.Error("expected channel to be removed")
 	}
 }
+
+func TestTable_cancel(t *testing.T) {
+	// Create ticker that doesn't remove any element during the lifetime of this
+	// test.
+	ticker := clock.New().NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker, clock.New())
+
+	id := generateID()
+	ch := makeResultChan()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	table.Put(ctx, id, ch)
+	cancel()
+
+	select {
+	case v := <-ch: // Wait for removal.
+		if v != nil {
+			t.Errorf("expected to receive nil value from channel, got: %v", v)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("channel didn't receive null within 1 second")
+	}
+
+	_, ok := table.Get(id)
+	if ok {
+		t.Error("expected channel to be removed")
+	}
+}
+
+func TestTable_deadline(t *testing.T) {
+	// Create ticker that doesn't remove any element during the lifetime of this
+	// test.
+	ticker := clock.New().NewTicker(time.Hour)
+	table := newTable(time.Hour, ticker, clock.New())
+
+	id := generateID()
+	ch := makeResultChan()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	table.Put(ctx, id, ch)
+
+	select {
+	case v := <-ch: // Wait for removal.
+		if v != nil {
+			t.Errorf("expected to receive nil value from channel, got: %v", v)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("channel didn't receive null within 1 second")
+	}
+}
+
+func TestTable_fakeClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	table := newTable(time.Second, c.NewTicker(time.Second), c)
+
+	id := generateID()
+	ch := makeResultChan()
+	table.Put(context.Background(), id, ch)
+
+	c.Advance(time.Second)
+	if _, ok := table.Get(id); !ok {
+		t.Error("expected session to still be in the table")
+	}
+
+	c.Advance(time.Second)
+
+	select {
+	case v := <-ch: // Wait for removal.
+		if v != nil {
+			t.Errorf("expected to receive nil value from channel, got: %v", v)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("channel didn't receive null within 1 second")
+	}
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Key is the ed25519 keypair of a node. The ID of a node is derived from the
+// hash of its public key, so that packets signed by the node can be verified
+// against its ID.
+type Key struct {
+	private ed25519.PrivateKey
+}
+
+// NewKey generates a new random keypair.
+func NewKey() (key Key, err error) {
+	_, key.private, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		err = fmt.Errorf("cannot generate key: %w", err)
+	}
+	return
+}
+
+// KeyFromSeed creates the keypair for a 32 byte seed.
+func KeyFromSeed(seed []byte) (key Key, err error) {
+	if len(seed) != ed25519.SeedSize {
+		err = fmt.Errorf("seed must be %d bytes", ed25519.SeedSize)
+		return
+	}
+
+	key.private = ed25519.NewKeyFromSeed(seed)
+	return
+}
+
+// LoadKey reads a keypair from a file containing the hexadecimal
+// representation of its seed.
+func LoadKey(path string) (key Key, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("cannot read key file: %w", err)
+		return
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		err = fmt.Errorf("cannot decode key file as hex: %w", err)
+		return
+	}
+
+	return KeyFromSeed(seed)
+}
+
+// Save writes the hexadecimal representation of the seed of the keypair to a
+// file that is only readable by the owner.
+func (k Key) Save(path string) error {
+	seed := hex.EncodeToString(k.private.Seed()) + "\n"
+
+	err := ioutil.WriteFile(path, []byte(seed), 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write key file: %w", err)
+	}
+	return nil
+}
+
+// Public returns the public key of the keypair.
+func (k Key) Public() ed25519.PublicKey {
+	return k.private.Public().(ed25519.PublicKey)
+}
+
+// ID returns the node ID derived from the public key.
+func (k Key) ID() ID {
+	return IDFromPublicKey(k.Public())
+}
+
+// Sign signs the message with the private key.
+func (k Key) Sign(message []byte) []byte {
+	return ed25519.Sign(k.private, message)
+}
+
+// Publisher returns the keypair that signs the values published by the node,
+// derived from the seed of the node key so that it survives restarts. It's
+// kept apart from the node key, so that a signature of a value can never pass
+// as a signature of a packet.
+func (k Key) Publisher() ed25519.PrivateKey {
+	h, _ := blake2b.New256([]byte("publisher"))
+	h.Write(k.private.Seed())
+	return ed25519.NewKeyFromSeed(h.Sum(nil))
+}
+
+// IDFromPublicKey derives a node ID from a public key, using the blake2b256
+// hash of the key.
+func IDFromPublicKey(publicKey ed25519.PublicKey) ID {
+	return blake2b.Sum256(publicKey)
+}
+
+// Verify checks that the message is signed by the public key, and that the
+// public key belongs to the node with the ID.
+func Verify(id ID, publicKey ed25519.PublicKey, message, signature []byte) error {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+
+	if !IDFromPublicKey(publicKey).Equal(id) {
+		return fmt.Errorf("public key doesn't belong to node: %v", id)
+	}
+
+	if !ed25519.Verify(publicKey, message, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package node
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestKey_signVerify(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	message := []byte("ABC, du är mina tankar")
+	signature := key.Sign(message)
+
+	err = Verify(key.ID(), key.Public(), message, signature)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Signed by the right key, but claiming to be another node.
+	err = Verify(NewID(), key.Public(), message, signature)
+	if err == nil {
+		t.Error("expected error for public key of another node")
+	}
+
+	// Tampered message.
+	err = Verify(key.ID(), key.Public(), []byte("ABC, du är inte mina tankar"), signature)
+	if err == nil {
+		t.Error("expected error for tampered message")
+	}
+
+	err = Verify(key.ID(), nil, message, signature)
+	if err == nil {
+		t.Error("expected error for missing public key")
+	}
+}
+
+func TestKey_saveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "camomile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "dhtnode.key")
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = key.Save(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("unexpected permissions, got: %v, exp: %v", perm, os.FileMode(0600))
+	}
+
+	loaded, err := LoadKey(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !loaded.ID().Equal(key.ID()) {
+		t.Errorf("unexpected ID of loaded key, got: %v, exp: %v", loaded.ID(), key.ID())
+	}
+}
+
+func TestLoadKey_invalid(t *testing.T) {
+	_, err := LoadKey(filepath.Join(os.TempDir(), "camomile-does-not-exist.key"))
+	if err == nil {
+		t.Error("expected error for missing key file")
+	}
+
+	f, err := ioutil.TempFile("", "camomile")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("not hex")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+
+	_, err = LoadKey(f.Name())
+	if err == nil {
+		t.Error("expected error for invalid key file")
+	}
+}
+
+func TestKeyFromSeed(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+
+	a, err := KeyFromSeed(seed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, _ := KeyFromSeed(seed)
+
+	if !a.ID().Equal(b.ID()) {
+		t.Error("expected the same ID for the same seed")
+	}
+
+	_, err = KeyFromSeed([]byte{1})
+	if err == nil {
+		t.Error("expected error for short seed")
+	}
+}
+
+func TestKey_publisher(t *testing.T) {
+	seed := bytes.Repeat([]byte{1}, 32)
+	a, _ := KeyFromSeed(seed)
+	b, _ := KeyFromSeed(seed)
+
+	if !bytes.Equal(a.Publisher(), b.Publisher()) {
+		t.Error("expected the same publisher key for the same seed")
+	}
+	if bytes.Equal(a.Publisher().Public().(ed25519.PublicKey), a.Public()) {
+		t.Error("expected publisher key to differ from the node key")
+	}
+}
@@ -37,7 +37,7 @@ func TestEqual(t *testing.T) {
 func TestIDFromStringValid(t *testing.T) {
 	id, err := IDFromString("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
 	if err != nil {
-		t.Errorf("unexpected error: %w", err)
+		t.Errorf("unexpected error: %v", err)
 	}
 
 	for _, b := range id {
@@ -103,7 +103,7 @@ func ExamplePong() {
 func ExampleStore() {
 	payload := &packet.Store{
 		Key:   []byte{111},
-		Value: "ABC, du är mina tankar",
+		Value: []byte("ABC, du är mina tankar"),
 	}
 
 	r := &packet.Packet{
@@ -125,7 +125,7 @@ func ExampleStore() {
 
 	switch p := rr.GetPayload().(type) {
 	case *packet.Packet_Store:
-		fmt.Printf("got store: %v=%v", rr.GetStore().GetKey(), p.Store.GetValue())
+		fmt.Printf("got store: %v=%s", rr.GetStore().GetKey(), p.Store.GetValue())
 	case nil:
 		fmt.Printf("expected type '*Packet_Store' as payload, got '%v'", p)
 	}
@@ -136,7 +136,7 @@ func ExampleStore() {
 func ExampleValue() {
 	payload := &packet.Value{
 		Key:   []byte{111},
-		Value: "ABC, du är mina tankar",
+		Value: []byte("ABC, du är mina tankar"),
 	}
 
 	r := &packet.Packet{
@@ -158,7 +158,7 @@ func ExampleValue() {
 
 	switch p := rr.GetPayload().(type) {
 	case *packet.Packet_Value:
-		fmt.Printf("got value: %v=%v", rr.GetValue().GetKey(), rr.GetValue().GetValue())
+		fmt.Printf("got value: %v=%s", rr.GetValue().GetKey(), rr.GetValue().GetValue())
 	case nil:
 		fmt.Printf("expected type '*Packet_Value' as payload, got '%v'", p)
 	}
@@ -3,17 +3,33 @@ package route
 import (
 	"net"
 	"sort"
+	"time"
 
 	"github.com/optmzr/d7024e-dht/node"
 )
 
-// Contact contains the node ID and an UDP address.
+// Contact contains the node ID and an UDP address. LastSeen is set by the
+// routing table when the node is added to it, and Failures counts the requests
+// to the node that failed since. RTT is the smoothed round-trip time of the
+// requests to the node, zero if it's unknown.
 type Contact struct {
 	NodeID   node.ID
 	Address  net.UDPAddr
+	LastSeen time.Time
+	Failures int
+	RTT      time.Duration
 	distance Distance
 }
 
+// smoothRTT returns the smoothed round-trip time with a new sample, as in
+// RFC 6298.
+func smoothRTT(srtt, rtt time.Duration) time.Duration {
+	if srtt == 0 {
+		return rtt
+	}
+	return srtt + (rtt-srtt)/8
+}
+
 // Contacts implements a sortable list of contacts.
 type Contacts []Contact
 
@@ -0,0 +1,102 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/node"
+)
+
+const snapshotVersion = 1
+
+// snapshot is the encoding of the contacts of a routing table.
+type snapshot struct {
+	Version  int               `json:"version"`
+	Saved    time.Time         `json:"saved"`
+	Contacts []snapshotContact `json:"contacts"`
+}
+
+type snapshotContact struct {
+	NodeID   string    `json:"id"`
+	Address  string    `json:"address"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Save writes the contacts of the routing table, and the times they were last
+// seen, to the file. The file is replaced atomically, so a crash while saving
+// leaves the previous snapshot intact.
+func (rt *Table) Save(path string) error {
+	s := snapshot{
+		Version: snapshotVersion,
+		Saved:   rt.clock.Now(),
+	}
+	for _, c := range rt.Contacts() {
+		s.Contacts = append(s.Contacts, snapshotContact{
+			NodeID:   c.NodeID.String(),
+			Address:  c.Address.String(),
+			LastSeen: c.LastSeen,
+		})
+	}
+
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot write snapshot: %w", err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot reads the contacts saved with Save. The contacts are passed to
+// NewTable to warm-start a routing table, they should be pinged before they're
+// trusted as the nodes may have left the network since.
+func LoadSnapshot(path string) (Contacts, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s snapshot
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", s.Version)
+	}
+
+	var contacts Contacts
+	for _, sc := range s.Contacts {
+		id, err := node.IDFromString(sc.NodeID)
+		if err != nil {
+			return nil, err
+		}
+
+		addr, err := net.ResolveUDPAddr("udp", sc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse address of %v: %w", id, err)
+		}
+
+		c := NewContact(id, *addr)
+		c.LastSeen = sc.LastSeen
+		if c.LastSeen.IsZero() {
+			c.LastSeen = s.Saved
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
@@ -0,0 +1,71 @@
+package route
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/clock"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "route")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	me := Contact{NodeID: zeroID()}
+	boot := NewContact(makeID([]byte{0xff}), net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8118})
+	a := NewContact(makeID([]byte{0x80, 1}), net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 8118})
+	b := NewContact(makeID([]byte{0x80, 2}), net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 8118})
+
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Hour, clock.New().NewTicker(time.Hour), c)
+	defer rt.Close()
+
+	rt.Add(a)
+	c.Advance(time.Minute)
+	rt.Add(b)
+	c.Advance(time.Minute)
+	rt.Add(a) // Seen again.
+
+	err = rt.Save(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	saved, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored, _ := NewTable(me, saved, BucketSize, MaxFailures,
+		time.Hour, clock.New().NewTicker(time.Hour), clock.New())
+	defer restored.Close()
+
+	exp := rt.Contacts()
+	got := restored.Contacts()
+	if len(got) != len(exp) {
+		t.Fatalf("unexpected number of contacts, got: %d, exp: %d", len(got), len(exp))
+	}
+	for i := range exp {
+		if !got[i].NodeID.Equal(exp[i].NodeID) || got[i].Address.String() != exp[i].Address.String() ||
+			!got[i].LastSeen.Equal(exp[i].LastSeen) {
+			t.Errorf("unexpected contact %d, got: %v (%v), exp: %v (%v)", i, got[i].NodeID, got[i].LastSeen, exp[i].NodeID, exp[i].LastSeen)
+		}
+	}
+	if !got[0].NodeID.Equal(a.NodeID) || !got[0].LastSeen.Equal(c.Now()) {
+		t.Errorf("expected most recently seen contact first, got: %v", got[0].NodeID)
+	}
+
+	_, err = LoadSnapshot(filepath.Join(dir, "missing.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("unexpected error for missing snapshot: %v", err)
+	}
+}
@@ -4,17 +4,28 @@ import (
 	"bytes"
 	"container/list"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
+// BucketSize is the default bucket size, k.
 const BucketSize = 32
 
+// MaxFailures is the default number of failed requests in a row after which a
+// contact is evicted.
+const MaxFailures = 5
+
 type bucket struct {
 	*list.List
+	cache      *list.List // Replacement cache, most recently seen first.
+	size       int
+	maxFails   int
 	lastAccess time.Time
+	clock      clock.Clock
 	rw         sync.RWMutex
 }
 
@@ -23,7 +34,12 @@ type Table struct {
 	buckets   [node.IDLength]*bucket
 	me        Contact
 	tRefresh  time.Duration
+	clock     clock.Clock
 	refreshCh chan int
+	ticker    *clock.Ticker
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 // Distance represents the distance between two node IDs.
@@ -60,13 +76,18 @@ func distance(a, b node.ID) (d Distance) {
 // touch updates the last access timestamp to now.
 func (b *bucket) touch() {
 	b.rw.Lock()
-	b.lastAccess = time.Now()
+	b.lastAccess = b.clock.Now()
 	b.rw.Unlock()
 }
 
 // add adds the contact to the bucket, it'll return false if the bucket is full.
+// The contact of a full bucket is added to the replacement cache instead. The
+// contact is marked as seen now, and its failures are reset. The round-trip
+// time of the contact is smoothed with the round-trip time of c, if any.
 func (b *bucket) add(c Contact) (ok bool) {
 	b.touch()
+	c.LastSeen = b.clock.Now()
+	c.Failures = 0
 
 	b.rw.Lock()
 	defer b.rw.Unlock()
@@ -75,6 +96,13 @@ func (b *bucket) add(c Contact) (ok bool) {
 	// front.
 	for e := b.Front(); e != nil; e = e.Next() {
 		if c.NodeID.Equal(e.Value.(Contact).NodeID) {
+			seen := e.Value.(Contact)
+			seen.LastSeen = c.LastSeen
+			seen.Failures = 0
+			if c.RTT > 0 {
+				seen.RTT = smoothRTT(seen.RTT, c.RTT)
+			}
+			e.Value = seen
 			b.MoveToFront(e)
 			// Successfully "added", in reality, the position in the list was
 			// just updated.
@@ -83,14 +111,80 @@ func (b *bucket) add(c Contact) (ok bool) {
 	}
 
 	// Make sure the bucket is not larger than the maximum bucket size, k.
-	if b.Len() < BucketSize {
+	if b.Len() < b.size {
+		b.uncache(c.NodeID)
 		b.PushFront(c) // Add the contact in the front, last seen.
 		return true
 	}
 
+	b.cacheReplacement(c)
 	return false // Full bucket, contact was not added.
 }
 
+// cacheReplacement adds the contact to the front of the replacement cache, or
+// moves it there if it's already cached. The least recently seen replacement
+// is dropped when the cache holds more than k contacts. The bucket lock must
+// be held.
+func (b *bucket) cacheReplacement(c Contact) {
+	for e := b.cache.Front(); e != nil; e = e.Next() {
+		if c.NodeID.Equal(e.Value.(Contact).NodeID) {
+			e.Value = c
+			b.cache.MoveToFront(e)
+			return
+		}
+	}
+
+	b.cache.PushFront(c)
+	if b.cache.Len() > b.size {
+		b.cache.Remove(b.cache.Back())
+	}
+}
+
+// uncache removes the contact from the replacement cache, it returns false if
+// the contact isn't cached. The bucket lock must be held.
+func (b *bucket) uncache(id node.ID) bool {
+	for e := b.cache.Front(); e != nil; e = e.Next() {
+		if id.Equal(e.Value.(Contact).NodeID) {
+			b.cache.Remove(e)
+			return true
+		}
+	}
+	return false
+}
+
+// promote moves the most recently seen replacement to the front of the bucket,
+// ok is false if the replacement cache is empty. The bucket lock must be held.
+func (b *bucket) promote() (replacement Contact, ok bool) {
+	e := b.cache.Front()
+	if e == nil {
+		return
+	}
+
+	replacement = b.cache.Remove(e).(Contact)
+	b.PushFront(replacement)
+	return replacement, true
+}
+
+// restore adds a contact from a snapshot to the front of the bucket, keeping
+// the time it was last seen. It'll return false if the bucket is full.
+func (b *bucket) restore(c Contact) (ok bool) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+
+	for e := b.Front(); e != nil; e = e.Next() {
+		if c.NodeID.Equal(e.Value.(Contact).NodeID) {
+			return true // Already added.
+		}
+	}
+
+	if b.Len() < b.size {
+		b.PushFront(c)
+		return true
+	}
+
+	return false
+}
+
 // head retrieves the oldest contact in a bucket. The bucket must have at least
 // one contact, or else it'll panic.
 func (b *bucket) head() Contact {
@@ -106,22 +200,55 @@ func (b *bucket) head() Contact {
 	return e.Value.(Contact)
 }
 
-// remove a contact from a bucket. If the contact doesn't exist the bucket is
-// left unchanged.
+// remove a contact from a bucket, or from its replacement cache. The most
+// recently seen replacement takes the place of a contact removed from the
+// bucket. If the contact doesn't exist the bucket is left unchanged.
 func (b *bucket) remove(id node.ID) {
 	b.touch()
 
 	b.rw.Lock()
 	defer b.rw.Unlock()
 
+	if b.uncache(id) {
+		return
+	}
+
 	// Small optimization: As the old contacts are usually those that are
 	// evicted, iterate through the list backwards to search the oldest contacts
 	// first.
 	for e := b.Back(); e != nil; e = e.Prev() {
 		if id.Equal(e.Value.(Contact).NodeID) {
 			b.Remove(e)
+			b.promote()
+			return
+		}
+	}
+}
+
+// fail counts a failed request to the contact. The contact is evicted once
+// it has failed maxFails times in a row, and the most recently seen replacement
+// takes its place. It returns true if the contact was evicted.
+func (b *bucket) fail(id node.ID) (evicted bool) {
+	b.rw.Lock()
+	defer b.rw.Unlock()
+
+	for e := b.Back(); e != nil; e = e.Prev() {
+		c := e.Value.(Contact)
+		if !id.Equal(c.NodeID) {
+			continue
 		}
+
+		c.Failures++
+		if c.Failures < b.maxFails {
+			e.Value = c
+			return false
+		}
+
+		b.Remove(e)
+		b.promote()
+		return true
 	}
+	return false
 }
 
 // contacts returns all the contacts in a bucket including the distance to a
@@ -163,6 +290,17 @@ func (rt *Table) Add(c Contact) (ok bool) {
 	return b.add(c)
 }
 
+// restore adds a contact from a snapshot to its bucket, see bucket.restore.
+func (rt *Table) restore(c Contact) (ok bool) {
+	if rt.me.NodeID.Equal(c.NodeID) {
+		return true
+	}
+
+	d := distance(rt.me.NodeID, c.NodeID)
+	b := rt.buckets[d.BucketIndex()]
+	return b.restore(c)
+}
+
 // Head retrieves the oldest contact in a bucket for a specified id.
 // The bucket must have at least one contact, or else it'll panic.
 func (rt *Table) Head(id node.ID) Contact {
@@ -171,14 +309,37 @@ func (rt *Table) Head(id node.ID) Contact {
 	return b.head()
 }
 
-// Remove a contact from a bucket. If the contact doesn't exist the bucket is
-// left unchanged.
+// Remove a contact from a bucket, see bucket.remove. If the contact doesn't
+// exist the bucket is left unchanged.
 func (rt *Table) Remove(id node.ID) {
 	d := distance(rt.me.NodeID, id)
 	b := rt.buckets[d.BucketIndex()]
 	b.remove(id)
 }
 
+// Fail counts a failed request to a contact (e.g. a timeout during a lookup).
+// After maxFailures failures in a row the contact is evicted, and replaced by
+// the most recently seen contact of the replacement cache of its bucket. It
+// returns true if the contact was evicted.
+func (rt *Table) Fail(id node.ID) (evicted bool) {
+	d := distance(rt.me.NodeID, id)
+	b := rt.buckets[d.BucketIndex()]
+	return b.fail(id)
+}
+
+// Contacts returns all the contacts in the routing table. Unlike lookups, it
+// doesn't count as an access of the buckets.
+func (rt *Table) Contacts() (c Contacts) {
+	for _, b := range rt.buckets {
+		b.rw.RLock()
+		for e := b.Front(); e != nil; e = e.Next() {
+			c = append(c, e.Value.(Contact))
+		}
+		b.rw.RUnlock()
+	}
+	return
+}
+
 // Centrality returns the centrality metric according to the formula:
 //	Let:
 //		Ca = Number of contacts in the bucket corresponding to the target.
@@ -201,34 +362,54 @@ func (rt *Table) Centrality(target node.ID) int {
 	return ca + cb
 }
 
-// NClosest finds the N closest nodes for a provided node ID.
+// NClosest finds the N closest nodes for a provided node ID. Flaky contacts,
+// whose last requests failed, are only included if there aren't N other
+// contacts, and then those with the fewest failures first.
 func (rt *Table) NClosest(target node.ID, n int) (sl *Candidates) {
 	me := rt.me
 	d := distance(me.NodeID, target)
 	index := d.BucketIndex()
 
-	b := rt.buckets[index]
-	sl = NewCandidates(target, b.contacts(me.NodeID)...)
+	contacts := rt.buckets[index].contacts(me.NodeID)
+	sl = NewCandidates(target, contacts...)
+	healthy := countHealthy(contacts)
 
-	for i := 1; sl.Len() < n && (index-i >= 0 || index+i < cap(rt.buckets)); i++ {
+	for i := 1; healthy < n && (index-i >= 0 || index+i < cap(rt.buckets)); i++ {
 		if index-i >= 0 {
-			b = rt.buckets[index-i]
-			sl.Add(b.contacts(me.NodeID)...)
+			contacts = rt.buckets[index-i].contacts(me.NodeID)
+			sl.Add(contacts...)
+			healthy += countHealthy(contacts)
 		}
 		if index+i < cap(rt.buckets) {
-			b = rt.buckets[index+i]
-			sl.Add(b.contacts(me.NodeID)...)
+			contacts = rt.buckets[index+i].contacts(me.NodeID)
+			sl.Add(contacts...)
+			healthy += countHealthy(contacts)
 		}
 	}
 
-	if sl.Len() >= n {
-		// Create new truncated shortlist with only the N closest nodes.
-		sl = NewCandidates(target, sl.SortedContacts()[:n]...)
+	if sl.Len() > n {
+		// Create new truncated shortlist with only the N closest nodes, the
+		// sort is stable so that they're still ordered by distance.
+		contacts = sl.SortedContacts()
+		sort.SliceStable(contacts, func(i, j int) bool {
+			return contacts[i].Failures < contacts[j].Failures
+		})
+		sl = NewCandidates(target, contacts[:n]...)
 	}
 
 	return
 }
 
+// countHealthy returns the number of contacts without failures.
+func countHealthy(contacts Contacts) (n int) {
+	for _, c := range contacts {
+		if c.Failures == 0 {
+			n++
+		}
+	}
+	return
+}
+
 // RefreshCh returns a channel that will be published to when the routing table
 // requests a bucket refresh.
 func (rt *Table) RefreshCh() chan int {
@@ -237,30 +418,61 @@ func (rt *Table) RefreshCh() chan int {
 
 // refreshHandler checks for buckets that haven't been touched in tRefresh time
 // and sends a refresh request with the bucket index to the refresh channel.
-func (rt *Table) refreshHandler(ticker *time.Ticker) {
-	go func() {
-		for now := range ticker.C {
-			for i, b := range rt.buckets {
-				b.rw.RLock()
-				refresh := now.After(b.lastAccess.Add(rt.tRefresh))
-				b.rw.RUnlock()
-
-				if refresh {
-					rt.refreshCh <- i
+// It returns when the table is closed.
+func (rt *Table) refreshHandler(ticker *clock.Ticker) {
+	defer rt.wg.Done()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-rt.done:
+			return
+		}
+
+		for i, b := range rt.buckets {
+			b.rw.RLock()
+			refresh := now.After(b.lastAccess.Add(rt.tRefresh))
+			b.rw.RUnlock()
+
+			if refresh {
+				select {
+				case rt.refreshCh <- i:
+				case <-rt.done:
+					return
 				}
 			}
 		}
-	}()
+	}
+}
+
+// Close stops the refresh ticker and waits for the refresh handler to return.
+// No refresh requests are sent after Close has returned.
+func (rt *Table) Close() {
+	rt.closeOnce.Do(func() {
+		rt.ticker.Stop()
+		close(rt.done)
+	})
+	rt.wg.Wait()
 }
 
 // NewTable creates a new routing table with all the buckets initialized and the
-// local node added to the last bucket. At least one bootstrapping node must be
-// provided.
-func NewTable(me Contact, others []Contact,
-	tRefresh time.Duration, refreshTicker *time.Ticker) (rt *Table, err error) {
+// local node added to the last bucket. Every bucket holds at most k contacts,
+// and a contact is evicted after maxFailures failed requests in a row. The
+// bootstrapping contacts may be empty, the table is then filled as other nodes
+// contact the local node. The contacts of a snapshot (see LoadSnapshot) keep
+// the time they were last seen, and are ordered by it.
+// The clock is used to track when the buckets were last accessed.
+func NewTable(me Contact, others []Contact, k, maxFailures int,
+	tRefresh time.Duration, refreshTicker *clock.Ticker, clk clock.Clock) (rt *Table, err error) {
+
+	if k < 1 {
+		err = errors.New("bucket size must be at least 1")
+		return
+	}
 
-	if len(others) == 0 {
-		err = errors.New("at least one bootstrap contact must be provided")
+	if maxFailures < 1 {
+		err = errors.New("max failures must be at least 1")
 		return
 	}
 
@@ -268,17 +480,38 @@ func NewTable(me Contact, others []Contact,
 	rt.me = me
 	rt.refreshCh = make(chan int)
 	rt.tRefresh = tRefresh
+	rt.clock = clk
+	rt.ticker = refreshTicker
+	rt.done = make(chan struct{})
 
 	// Create all the buckets.
 	for i := range rt.buckets {
-		rt.buckets[i] = &bucket{List: list.New()}
+		rt.buckets[i] = &bucket{List: list.New(), cache: list.New(), size: k, maxFails: maxFailures, clock: clk}
+	}
+
+	// Add the contacts of a snapshot from the least recently seen, so that the
+	// most recently seen contacts end up first in their buckets.
+	var saved Contacts
+	for _, other := range others {
+		if !other.LastSeen.IsZero() {
+			saved = append(saved, other)
+		}
+	}
+	sort.SliceStable(saved, func(i, j int) bool {
+		return saved[i].LastSeen.Before(saved[j].LastSeen)
+	})
+	for _, other := range saved {
+		rt.restore(other)
 	}
 
 	// Add bootstrapping contacts.
 	for _, other := range others {
-		rt.Add(other)
+		if other.LastSeen.IsZero() {
+			rt.Add(other)
+		}
 	}
 
+	rt.wg.Add(1)
 	go rt.refreshHandler(refreshTicker)
 
 	return
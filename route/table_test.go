@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
@@ -83,8 +84,8 @@ func TestMe(t *testing.T) {
 	me := Contact{NodeID: randomID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 	rtMe := rt.me
 
 	if !me.NodeID.Equal(rtMe.NodeID) {
@@ -96,16 +97,137 @@ func TestNewTable(t *testing.T) {
 	me := Contact{NodeID: zeroID()}
 	boots := []Contact{Contact{NodeID: randomID()}, Contact{NodeID: randomID()}}
 
-	_, err := NewTable(me, boots,
-		time.Second, time.NewTicker(time.Second))
+	_, err := NewTable(me, boots, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 	if err != nil {
-		t.Errorf("cannot create table: %w", err)
+		t.Errorf("cannot create table: %v", err)
 	}
 
-	_, err = NewTable(me, []Contact{},
-		time.Second, time.NewTicker(time.Second))
+	rt, err := NewTable(me, []Contact{}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
+	if err != nil {
+		t.Errorf("cannot create table without bootstrap contacts: %v", err)
+	} else if n := len(rt.Contacts()); n != 0 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 0)
+	}
+	_, err = NewTable(me, boots, 0, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 	if err == nil {
-		t.Error("expected error on empty bootstrap slice")
+		t.Error("expected error on empty buckets")
+	}
+}
+
+func TestAdd_bucketSize(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0xff})}
+
+	rt, _ := NewTable(me, []Contact{boot}, 2, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
+
+	// Same bucket as the bootstrap contact.
+	if !rt.Add(Contact{NodeID: makeID([]byte{0xfe})}) {
+		t.Error("expected contact to be added to bucket with room")
+	}
+	if rt.Add(Contact{NodeID: makeID([]byte{0xfd})}) {
+		t.Error("expected contact to not be added to full bucket")
+	}
+}
+
+func TestReplacementCache(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0xff})}
+
+	rt, _ := NewTable(me, []Contact{boot}, 2, 1,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
+
+	has := func(b byte) bool {
+		for _, c := range rt.Contacts() {
+			if c.NodeID.Equal(makeID([]byte{b})) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The bucket is full after the first contact, the rest are cached and the
+	// least recently seen of them is dropped.
+	for _, b := range []byte{0xfe, 0xfd, 0xfc, 0xfb} {
+		rt.Add(Contact{NodeID: makeID([]byte{b})})
+	}
+	if has(0xfd) || has(0xfc) || has(0xfb) {
+		t.Fatal("expected contacts of full bucket to be cached")
+	}
+
+	// The most recently seen replacement takes the place of a failed contact.
+	if !rt.Fail(boot.NodeID) || has(0xff) || !has(0xfb) {
+		t.Error("expected failed contact to be replaced by: fb")
+	}
+	if !rt.Fail(makeID([]byte{0xfe})) || has(0xfe) || !has(0xfc) {
+		t.Error("expected failed contact to be replaced by: fc")
+	}
+
+	// The replacement cache is empty, and the dropped contact was never
+	// promoted.
+	if !rt.Fail(makeID([]byte{0xfb})) || has(0xfb) || has(0xfd) {
+		t.Error("expected failed contact to be evicted without replacements")
+	}
+
+	// A removed contact is replaced as well, but a removed replacement is
+	// never promoted.
+	for _, b := range []byte{0xfb, 0xfa, 0xf9} {
+		rt.Add(Contact{NodeID: makeID([]byte{b})})
+	}
+	rt.Remove(makeID([]byte{0xf9}))
+	rt.Remove(makeID([]byte{0xfb}))
+	if !has(0xfa) || has(0xf9) || has(0xfb) {
+		t.Error("expected removed contact to be replaced")
+	}
+	rt.Remove(makeID([]byte{0xfa}))
+	if n := len(rt.Contacts()); n != 1 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 1)
+	}
+}
+
+func TestFail(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	flaky := Contact{NodeID: makeID([]byte{0x01})}
+	far := Contact{NodeID: makeID([]byte{0x80})}
+
+	rt, _ := NewTable(me, []Contact{flaky, far}, BucketSize, 3,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
+
+	closest := func() node.ID {
+		return rt.NClosest(flaky.NodeID, 1).SortedContacts()[0].NodeID
+	}
+
+	// A response resets the failures, and updates the round-trip time.
+	rt.Fail(flaky.NodeID)
+	rt.Fail(flaky.NodeID)
+	rt.Add(Contact{NodeID: flaky.NodeID, RTT: 80 * time.Millisecond})
+	rt.Add(Contact{NodeID: flaky.NodeID, RTT: 160 * time.Millisecond})
+	c := rt.NClosest(flaky.NodeID, 1).SortedContacts()[0]
+	if c.Failures != 0 || c.RTT != 90*time.Millisecond {
+		t.Errorf("unexpected contact, got: %d failures, RTT %v, exp: %d failures, RTT %v",
+			c.Failures, c.RTT, 0, 90*time.Millisecond)
+	}
+
+	// The flaky contact is only returned if there are no other contacts.
+	if rt.Fail(flaky.NodeID) {
+		t.Error("unexpected eviction after 1 failure")
+	}
+	if !closest().Equal(far.NodeID) {
+		t.Errorf("expected flaky contact to be de-prioritized, got: %v", closest())
+	}
+	if n := rt.NClosest(flaky.NodeID, 2).Len(); n != 2 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 2)
+	}
+
+	rt.Fail(flaky.NodeID)
+	if !rt.Fail(flaky.NodeID) {
+		t.Error("expected eviction after 3 failures")
+	}
+	if n := len(rt.Contacts()); n != 1 {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", n, 1)
 	}
 }
 
@@ -125,8 +247,8 @@ func TestAdd(t *testing.T) {
 	for i < 7 {
 		c1 := Contact{NodeID: makeID([]byte{1 << i})}
 
-		rt, _ := NewTable(me, []Contact{boot},
-			time.Second, time.NewTicker(time.Second))
+		rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+			time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 		rt.Add(c1)
 
@@ -145,8 +267,8 @@ func TestHead_incremental(t *testing.T) {
 	me := Contact{NodeID: zeroID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	for i := 2; i < 50; i++ {
 		rt.Add(Contact{NodeID: randomID()})
@@ -164,8 +286,8 @@ func TestHead_panic(t *testing.T) {
 	me := Contact{NodeID: zeroID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	i := distance(me.NodeID, boot.NodeID).BucketIndex()
 
@@ -189,8 +311,8 @@ func TestRemove_incremental(t *testing.T) {
 		others = append(others, Contact{NodeID: randomID()})
 	}
 
-	rt, _ := NewTable(me, others,
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, others, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	// Shuffle the contacts so that they are removed in a random order.
 	rand.Shuffle(len(others),
@@ -215,8 +337,8 @@ func TestDuplicateContact(t *testing.T) {
 	boot := Contact{NodeID: zeroID()}
 	c1 := Contact{NodeID: makeID([]byte{2})}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	rt.Add(c1)
 	rt.Add(c1)
@@ -235,8 +357,8 @@ func TestAddLocalNode(t *testing.T) {
 	me := Contact{NodeID: makeID([]byte{1})}
 	boot := Contact{NodeID: zeroID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	rt.Add(me)
 
@@ -255,8 +377,8 @@ func TestNClosest(t *testing.T) {
 	me := Contact{NodeID: randomID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	var contacts []Contact
 	var contact Contact
@@ -303,8 +425,8 @@ func TestNClosest(t *testing.T) {
 func BenchmarkAdd(b *testing.B) {
 	rt, _ := NewTable(
 		Contact{NodeID: randomID()},
-		[]Contact{Contact{NodeID: randomID()}},
-		time.Second, time.NewTicker(time.Second))
+		[]Contact{Contact{NodeID: randomID()}}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 	b.ResetTimer()
 
 	for n := 0; n < b.N; n++ {
@@ -326,8 +448,8 @@ func BenchmarkNClosest(b *testing.B) {
 	me := Contact{NodeID: randomID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	var contacts []Contact
 	var contact Contact
@@ -350,8 +472,8 @@ func TestNClosest_concurrent(t *testing.T) {
 	me := Contact{NodeID: randomID()}
 	boot := Contact{NodeID: randomID()}
 
-	rt, _ := NewTable(me, []Contact{boot},
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	var contacts []Contact
 	var wg sync.WaitGroup
@@ -395,7 +517,7 @@ func TestRefreshCh(t *testing.T) {
 	tExpire := time.Second
 
 	tch := make(chan time.Time)
-	ticker := &time.Ticker{
+	ticker := &clock.Ticker{
 		C: tch,
 	}
 
@@ -405,7 +527,7 @@ func TestRefreshCh(t *testing.T) {
 		tch <- time.Now().Add(time.Hour)
 	}(tch)
 
-	rt, _ := NewTable(me, []Contact{boot}, tExpire, ticker)
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures, tExpire, ticker, clock.New())
 
 	// Every bucket should be untouched on initialization, producing a refresh
 	// event for all of them (in order).
@@ -432,8 +554,8 @@ func TestCentrality(t *testing.T) {
 		others = append(others, Contact{NodeID: makeID([]byte{byte(i)})})
 	}
 
-	rt, _ := NewTable(me, others,
-		time.Second, time.NewTicker(time.Second))
+	rt, _ := NewTable(me, others, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
 
 	c := rt.Centrality(zeroID())
 	exp := 127
@@ -447,3 +569,95 @@ func TestCentrality(t *testing.T) {
 		t.Errorf("unexpected centrality, got: %d, exp: %d", c, exp)
 	}
 }
+
+func TestRefreshCh_fakeClock(t *testing.T) {
+	me := Contact{NodeID: makeID([]byte{0xff})}
+	boot := Contact{NodeID: makeID([]byte{0x7f})}
+	tRefresh := time.Hour
+
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures, tRefresh, c.NewTicker(time.Minute), c)
+
+	// Touch the bucket of the bootstrap contact half way through.
+	c.Advance(30 * time.Minute)
+	rt.Add(boot)
+
+	go func() {
+		for i := 0; i < 60; i++ {
+			c.Advance(time.Minute)
+		}
+	}()
+
+	// Every bucket except the touched one should request a refresh.
+	index := distance(me.NodeID, boot.NodeID).BucketIndex()
+	for exp := 0; exp < 256; exp++ {
+		if exp == index {
+			continue
+		}
+
+		i := <-rt.RefreshCh()
+		if i != exp {
+			t.Errorf("unexpected bucket index from refresh channel, got: %d, exp: %d", i, exp)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	me := Contact{NodeID: makeID([]byte{0xff})}
+	boot := Contact{NodeID: makeID([]byte{0x7f})}
+
+	tch := make(chan time.Time, 1)
+	ticker := &clock.Ticker{
+		C: tch,
+	}
+
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures, time.Second, ticker, clock.New())
+
+	// The handler blocks on the refresh channel, as nobody is reading it.
+	tch <- time.Now().Add(time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		rt.Close()
+		rt.Close() // Closing twice is a no-op.
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close timed out")
+	}
+
+	select {
+	case i := <-rt.RefreshCh():
+		t.Errorf("unexpected refresh request after close for bucket: %d", i)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestContacts(t *testing.T) {
+	me := Contact{NodeID: zeroID()}
+	boot := Contact{NodeID: makeID([]byte{0xff})}
+
+	rt, _ := NewTable(me, []Contact{boot}, BucketSize, MaxFailures,
+		time.Second, clock.New().NewTicker(time.Second), clock.New())
+
+	exp := map[node.ID]bool{boot.NodeID: true}
+	for i := uint(0); i < 7; i++ {
+		c := Contact{NodeID: makeID([]byte{1 << i})}
+		rt.Add(c)
+		exp[c.NodeID] = true
+	}
+
+	contacts := rt.Contacts()
+	if len(contacts) != len(exp) {
+		t.Errorf("unexpected number of contacts, got: %d, exp: %d", len(contacts), len(exp))
+	}
+
+	for _, c := range contacts {
+		if !exp[c.NodeID] {
+			t.Errorf("unexpected contact: %v", c.NodeID)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Table selects the entries of a backend, the items that other nodes have
+// stored on this node are kept apart from the items that this node publishes.
+type Table uint8
+
+const (
+	// RemoteTable holds the items that other nodes have stored on this node.
+	RemoteTable Table = iota
+	// LocalTable holds the items that this node has stored on the network.
+	LocalTable
+	// TombstoneTable holds the tombstones of deleted keys, encoded in the
+	// values of the entries.
+	TombstoneTable
+	// ProviderTable holds the providers of every key, encoded in the values of
+	// the entries.
+	ProviderTable
+	// LocalProviderTable holds the keys that this node provides, they're
+	// announced again at the republish time.
+	LocalProviderTable
+)
+
+// Entry is an item stored in a backend, along with its expiry metadata. Remote
+// items expire at the expiration time, while local items are republished at
+// the republish time.
+type Entry struct {
+	Value     []byte
+	Publisher ed25519.PublicKey
+	Published time.Time
+	Signature []byte
+	Record    *Record
+	Expire    time.Time
+	Republish time.Time
+	Deadline  time.Time // Upper bound set by the TTL, zero if none.
+}
+
+// Meta is the expiry metadata of an entry, it's kept apart from the value so
+// that the entries can be expired without reading their values.
+type Meta struct {
+	Expire    time.Time
+	Republish time.Time
+	Deadline  time.Time
+}
+
+// Meta returns the expiry metadata of the entry.
+func (e Entry) Meta() Meta {
+	return Meta{Expire: e.Expire, Republish: e.Republish, Deadline: e.Deadline}
+}
+
+// withMeta returns the entry with the expiry metadata.
+func (e Entry) withMeta(meta Meta) Entry {
+	e.Expire, e.Republish, e.Deadline = meta.Expire, meta.Republish, meta.Deadline
+	return e
+}
+
+// Backend stores the entries of a database. A backend must be safe for
+// concurrent use, and the entries must not be modified once they're passed to
+// or returned from the backend.
+type Backend interface {
+	// Get returns the entry with the key, ok is false if there is none.
+	Get(table Table, key Key) (entry Entry, ok bool, err error)
+
+	// Put adds or replaces the entry with the key.
+	Put(table Table, key Key, entry Entry) error
+
+	// Delete removes the entry with the key, if any.
+	Delete(table Table, key Key) error
+
+	// ForEach calls fn for every entry of the table until fn returns false.
+	// The entries are iterated in no particular order, and fn may modify the
+	// backend.
+	ForEach(table Table, fn func(key Key, entry Entry) bool) error
+
+	// ForEachMeta is like ForEach, but only the metadata of the entries is
+	// passed to fn, so the values aren't read.
+	ForEachMeta(table Table, fn func(key Key, meta Meta) bool) error
+
+	// SetMeta replaces the metadata of the entry with the key, if any, without
+	// rewriting its value.
+	SetMeta(table Table, key Key, meta Meta) error
+
+	// Close releases the resources of the backend.
+	Close() error
+}
+
+// MemoryBackend keeps the entries in memory, they're lost when the node is
+// restarted.
+type MemoryBackend struct {
+	mu     sync.RWMutex
+	tables map[Table]map[Key]Entry
+}
+
+// NewMemoryBackend returns an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{tables: make(map[Table]map[Key]Entry)}
+}
+
+// Get returns the entry with the key, ok is false if there is none.
+func (b *MemoryBackend) Get(table Table, key Key) (Entry, bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	entry, ok := b.tables[table][key]
+	return entry, ok, nil
+}
+
+// Put adds or replaces the entry with the key.
+func (b *MemoryBackend) Put(table Table, key Key, entry Entry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.tables[table]
+	if !ok {
+		m = make(map[Key]Entry)
+		b.tables[table] = m
+	}
+	m[key] = entry
+	return nil
+}
+
+// Delete removes the entry with the key, if any.
+func (b *MemoryBackend) Delete(table Table, key Key) error {
+	b.mu.Lock()
+	delete(b.tables[table], key)
+	b.mu.Unlock()
+	return nil
+}
+
+// ForEach calls fn for a snapshot of the entries of the table, until fn returns
+// false.
+func (b *MemoryBackend) ForEach(table Table, fn func(key Key, entry Entry) bool) error {
+	b.mu.RLock()
+	keys := make([]Key, 0, len(b.tables[table]))
+	entries := make([]Entry, 0, len(b.tables[table]))
+	for key, entry := range b.tables[table] {
+		keys = append(keys, key)
+		entries = append(entries, entry)
+	}
+	b.mu.RUnlock()
+
+	for i, key := range keys {
+		if !fn(key, entries[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// ForEachMeta calls fn for the metadata of a snapshot of the entries of the
+// table, until fn returns false.
+func (b *MemoryBackend) ForEachMeta(table Table, fn func(key Key, meta Meta) bool) error {
+	return b.ForEach(table, func(key Key, entry Entry) bool {
+		return fn(key, entry.Meta())
+	})
+}
+
+// SetMeta replaces the metadata of the entry with the key, if any.
+func (b *MemoryBackend) SetMeta(table Table, key Key, meta Meta) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if entry, ok := b.tables[table][key]; ok {
+		b.tables[table][key] = entry.withMeta(meta)
+	}
+	return nil
+}
+
+// Close does nothing, the entries are kept until the backend is garbage
+// collected.
+func (b *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,624 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ed25519"
+)
+
+// diskLogName is the name of the log file in the data directory.
+const diskLogName = "items.log"
+
+// The log is a sequence of frames. Every frame starts with a header of the
+// CRC-32 checksum of the body and the size of the body, followed by the body:
+// the operation, the table, the key and, for puts, the encoded entry or, for
+// metadata updates, the encoded metadata.
+const frameHeaderSize = 8
+const frameKeyOffset = frameHeaderSize + 2
+const frameEntryOffset = frameKeyOffset + len(Key{})
+
+// maxFrameSize limits the size of a frame that is read from the log, so that a
+// corrupt size can't exhaust the memory.
+const maxFrameSize = 16 << 20
+
+// defaultCompactSize is the number of bytes of replaced and deleted entries in
+// the log before it's compacted.
+const defaultCompactSize = 4 << 20
+
+const (
+	opPut byte = iota + 1
+	opDelete
+	opMeta
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frameRef is the position of a frame in the log, the size is zero if there is
+// no frame.
+type frameRef struct {
+	offset int64
+	size   int64
+}
+
+// indexEntry is the position of the latest put of a key in the log, along with
+// the current metadata of the entry and the position of the metadata frame it
+// was last written in, if it was updated after the put.
+type indexEntry struct {
+	put       frameRef
+	meta      Meta
+	metaFrame frameRef
+}
+
+// DiskBackend keeps the entries in an append-only log in a data directory, so
+// that they survive restarts of the node. Every change is appended to the log,
+// and the position of the latest entry of every key is indexed in memory along
+// with its metadata, so that the entries can be expired without reading the log.
+// A change of the metadata alone is appended as a small frame, without the
+// value. The index is rebuilt from the log when the backend is opened, and the
+// log is compacted once it's mostly made up of replaced and deleted entries.
+type DiskBackend struct {
+	mu          sync.RWMutex
+	path        string
+	f           *os.File
+	size        int64 // Size of the log.
+	garbage     int64 // Size of the frames that are no longer indexed.
+	compactSize int64
+	index       map[Table]map[Key]indexEntry
+}
+
+// OpenDiskBackend opens the log in the data directory, the directory and the
+// log are created if they don't exist. A log that ends with a partially written
+// or corrupt frame, e.g. after a crash, is truncated to the last valid frame.
+func OpenDiskBackend(dir string) (*DiskBackend, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create data directory: %w", err)
+	}
+
+	b := &DiskBackend{
+		path:        filepath.Join(dir, diskLogName),
+		compactSize: defaultCompactSize,
+	}
+
+	b.f, err = os.OpenFile(b.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log: %w", err)
+	}
+
+	err = b.load()
+	if err != nil {
+		b.f.Close()
+		return nil, fmt.Errorf("cannot load log %s: %w", b.path, err)
+	}
+	return b, nil
+}
+
+// load rebuilds the index from the log.
+func (b *DiskBackend) load() error {
+	b.index = make(map[Table]map[Key]indexEntry)
+	b.size = 0
+	b.garbage = 0
+
+	r := bufio.NewReader(io.NewSectionReader(b.f, 0, 1<<62))
+	for {
+		body, err := readFrame(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Truncating log %s at offset %d", b.path, b.size)
+			return b.f.Truncate(b.size)
+		}
+
+		op, table := body[0], Table(body[1])
+		var key Key
+		copy(key[:], body[2:])
+
+		size := int64(frameHeaderSize + len(body))
+		ref := frameRef{offset: b.size, size: size}
+		data := body[frameEntryOffset-frameHeaderSize:]
+		switch op {
+		case opPut:
+			entry, err := decodeEntry(data)
+			if err != nil {
+				return fmt.Errorf("cannot decode entry %v: %w", key, err)
+			}
+			b.set(table, key, indexEntry{put: ref, meta: entry.Meta()})
+		case opMeta:
+			meta, err := decodeMeta(data)
+			if err != nil {
+				return fmt.Errorf("cannot decode metadata %v: %w", key, err)
+			}
+			if !b.setMeta(table, key, meta, ref) {
+				b.garbage += size
+			}
+		case opDelete:
+			b.unset(table, key)
+			b.garbage += size
+		}
+		b.size += size
+	}
+}
+
+// readFrame reads the body of the next frame. io.EOF is returned at the end of
+// the log, and any other error if the frame is incomplete or corrupt.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sum := binary.BigEndian.Uint32(header[0:])
+	size := binary.BigEndian.Uint32(header[4:])
+	if size < uint32(frameEntryOffset-frameHeaderSize) || size > maxFrameSize {
+		return nil, fmt.Errorf("invalid frame size: %d", size)
+	}
+
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, errors.New("frame checksum mismatch")
+	}
+	if body[0] != opPut && body[0] != opDelete && body[0] != opMeta {
+		return nil, fmt.Errorf("unknown frame operation: %d", body[0])
+	}
+	return body, nil
+}
+
+// set indexes the put of the key, the previous frames become garbage.
+func (b *DiskBackend) set(table Table, key Key, e indexEntry) {
+	m, ok := b.index[table]
+	if !ok {
+		m = make(map[Key]indexEntry)
+		b.index[table] = m
+	}
+
+	if old, ok := m[key]; ok {
+		b.garbage += old.put.size + old.metaFrame.size
+	}
+	m[key] = e
+}
+
+// setMeta indexes the metadata frame of the key, the previous metadata frame
+// becomes garbage. It returns false if the key isn't indexed.
+func (b *DiskBackend) setMeta(table Table, key Key, meta Meta, ref frameRef) bool {
+	e, ok := b.index[table][key]
+	if !ok {
+		return false
+	}
+
+	b.garbage += e.metaFrame.size
+	e.meta = meta
+	e.metaFrame = ref
+	b.index[table][key] = e
+	return true
+}
+
+// unset removes the key from the index, its frames become garbage.
+func (b *DiskBackend) unset(table Table, key Key) {
+	if old, ok := b.index[table][key]; ok {
+		b.garbage += old.put.size + old.metaFrame.size
+		delete(b.index[table], key)
+	}
+}
+
+// Get returns the entry with the key, ok is false if there is none.
+func (b *DiskBackend) Get(table Table, key Key) (entry Entry, ok bool, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.index[table][key]
+	if !ok {
+		return
+	}
+
+	frame := make([]byte, e.put.size)
+	_, err = b.f.ReadAt(frame, e.put.offset)
+	if err != nil {
+		err = fmt.Errorf("cannot read entry %v: %w", key, err)
+		return
+	}
+
+	entry, err = decodeEntry(frame[frameEntryOffset:])
+	if err != nil {
+		err = fmt.Errorf("cannot decode entry %v: %w", key, err)
+		return
+	}
+	entry = entry.withMeta(e.meta)
+	return
+}
+
+// Put appends the entry with the key to the log.
+func (b *DiskBackend) Put(table Table, key Key, entry Entry) error {
+	frame := newFrame(opPut, table, key, encodeEntry(entry))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.append(frame)
+	if err != nil {
+		return err
+	}
+
+	ref := frameRef{offset: b.size - int64(len(frame)), size: int64(len(frame))}
+	b.set(table, key, indexEntry{put: ref, meta: entry.Meta()})
+	return b.maybeCompact()
+}
+
+// SetMeta appends the metadata of the key to the log, if the key has an entry.
+func (b *DiskBackend) SetMeta(table Table, key Key, meta Meta) error {
+	frame := newFrame(opMeta, table, key, encodeMeta(meta))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[table][key]; !ok {
+		return nil
+	}
+
+	err := b.append(frame)
+	if err != nil {
+		return err
+	}
+
+	b.setMeta(table, key, meta, frameRef{offset: b.size - int64(len(frame)), size: int64(len(frame))})
+	return b.maybeCompact()
+}
+
+// Delete appends the delete of the key to the log, if the key has an entry.
+func (b *DiskBackend) Delete(table Table, key Key) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[table][key]; !ok {
+		return nil
+	}
+
+	frame := newFrame(opDelete, table, key, nil)
+	err := b.append(frame)
+	if err != nil {
+		return err
+	}
+
+	b.unset(table, key)
+	b.garbage += int64(len(frame))
+	return b.maybeCompact()
+}
+
+// ForEach calls fn for the entries of the keys that were in the table when it
+// was called, until fn returns false. Entries that are deleted during the
+// iteration are skipped.
+func (b *DiskBackend) ForEach(table Table, fn func(key Key, entry Entry) bool) error {
+	b.mu.RLock()
+	keys := make([]Key, 0, len(b.index[table]))
+	for key := range b.index[table] {
+		keys = append(keys, key)
+	}
+	b.mu.RUnlock()
+
+	for _, key := range keys {
+		entry, ok, err := b.Get(table, key)
+		if err != nil {
+			return err
+		}
+		if ok && !fn(key, entry) {
+			break
+		}
+	}
+	return nil
+}
+
+// ForEachMeta calls fn for the metadata of the entries that were in the table
+// when it was called, until fn returns false. The metadata is read from the
+// index, so the log isn't read.
+func (b *DiskBackend) ForEachMeta(table Table, fn func(key Key, meta Meta) bool) error {
+	b.mu.RLock()
+	keys := make([]Key, 0, len(b.index[table]))
+	metas := make([]Meta, 0, len(b.index[table]))
+	for key, e := range b.index[table] {
+		keys = append(keys, key)
+		metas = append(metas, e.meta)
+	}
+	b.mu.RUnlock()
+
+	for i, key := range keys {
+		if !fn(key, metas[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close flushes the log to the disk and closes it.
+func (b *DiskBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	err := b.f.Sync()
+	if err != nil {
+		b.f.Close()
+		return err
+	}
+	return b.f.Close()
+}
+
+// append writes the frame at the end of the log. A partially written frame is
+// truncated, so that later frames aren't lost when the log is loaded.
+func (b *DiskBackend) append(frame []byte) error {
+	_, err := b.f.WriteAt(frame, b.size)
+	if err != nil {
+		b.f.Truncate(b.size)
+		return fmt.Errorf("cannot write to log: %w", err)
+	}
+
+	b.size += int64(len(frame))
+	return nil
+}
+
+// maybeCompact compacts the log if most of it is garbage.
+func (b *DiskBackend) maybeCompact() error {
+	if b.garbage < b.compactSize || b.garbage < b.size-b.garbage {
+		return nil
+	}
+	return b.compact()
+}
+
+// compact rewrites the log with only the indexed frames, and replaces the log
+// with the rewritten log.
+func (b *DiskBackend) compact() error {
+	tmp := b.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot compact log: %w", err)
+	}
+
+	index := make(map[Table]map[Key]indexEntry)
+	w := bufio.NewWriter(f)
+	var size int64
+
+	// copyFrame copies the frame to the rewritten log, and returns its position
+	// in the rewritten log.
+	copyFrame := func(ref frameRef) (frameRef, error) {
+		if ref.size == 0 {
+			return ref, nil
+		}
+		_, err := io.Copy(w, io.NewSectionReader(b.f, ref.offset, ref.size))
+		if err != nil {
+			return ref, err
+		}
+		ref.offset = size
+		size += ref.size
+		return ref, nil
+	}
+
+copy:
+	for table, m := range b.index {
+		index[table] = make(map[Key]indexEntry, len(m))
+		for key, e := range m {
+			e.put, err = copyFrame(e.put)
+			if err == nil {
+				e.metaFrame, err = copyFrame(e.metaFrame)
+			}
+			if err != nil {
+				break copy
+			}
+			index[table][key] = e
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, b.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("cannot compact log: %w", err)
+	}
+
+	// The rewritten log is now the log.
+	b.f.Close()
+	b.f = f
+	b.index = index
+	b.size = size
+	b.garbage = 0
+	return nil
+}
+
+// newFrame returns the frame of the operation on the key.
+func newFrame(op byte, table Table, key Key, entry []byte) []byte {
+	frame := make([]byte, frameEntryOffset, frameEntryOffset+len(entry))
+	frame[frameHeaderSize] = op
+	frame[frameHeaderSize+1] = byte(table)
+	copy(frame[frameKeyOffset:], key[:])
+	frame = append(frame, entry...)
+
+	body := frame[frameHeaderSize:]
+	binary.BigEndian.PutUint32(frame[0:], crc32.Checksum(body, crcTable))
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(body)))
+	return frame
+}
+
+// encodeEntry encodes the entry as length-prefixed byte strings and varints.
+func encodeEntry(e Entry) []byte {
+	var b []byte
+	b = appendBytes(b, e.Value)
+	b = appendBytes(b, e.Publisher)
+
+	if e.Record == nil {
+		b = append(b, 0)
+	} else {
+		b = append(b, 1)
+		b = appendBytes(b, e.Record.Salt)
+		b = appendUvarint(b, e.Record.Seq)
+		b = appendBytes(b, e.Record.Signature)
+	}
+
+	b = appendTime(b, e.Expire)
+	b = appendTime(b, e.Republish)
+	b = appendTime(b, e.Deadline)
+
+	b = appendTime(b, e.Published)
+	return appendBytes(b, e.Signature)
+}
+
+// encodeMeta encodes the metadata as varints.
+func encodeMeta(m Meta) []byte {
+	b := appendTime(nil, m.Expire)
+	b = appendTime(b, m.Republish)
+	return appendTime(b, m.Deadline)
+}
+
+// decodeMeta decodes metadata encoded by encodeMeta.
+func decodeMeta(b []byte) (m Meta, err error) {
+	d := decoder{b: b}
+	m.Expire = d.time()
+	m.Republish = d.time()
+	m.Deadline = d.time()
+
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	return m, d.err
+}
+
+// decodeEntry decodes an entry encoded by encodeEntry.
+func decodeEntry(b []byte) (e Entry, err error) {
+	d := decoder{b: b}
+	e.Value = d.bytes()
+	if publisher := d.bytes(); len(publisher) > 0 {
+		e.Publisher = ed25519.PublicKey(publisher)
+	}
+
+	if d.byte() == 1 {
+		e.Record = &Record{
+			Salt:      d.bytes(),
+			Seq:       d.uvarint(),
+			Signature: d.bytes(),
+		}
+	}
+
+	e.Expire = d.time()
+	e.Republish = d.time()
+	e.Deadline = d.time()
+
+	// Entries written before items were signed end here.
+	if d.err == nil && len(d.b) > 0 {
+		e.Published = d.time()
+		if signature := d.bytes(); len(signature) > 0 {
+			e.Signature = signature
+		}
+	}
+
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	return e, d.err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendBytes(b []byte, v []byte) []byte {
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendTime appends the time in nanoseconds since the Unix epoch, the zero
+// time is encoded as zero.
+func appendTime(b []byte, t time.Time) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	var v int64
+	if !t.IsZero() {
+		v = t.UnixNano()
+	}
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+// decoder reads the fields of an encoded entry, the first error is kept and
+// zero values are returned after it.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || uint64(len(d.b)) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) time() time.Time {
+	if d.err != nil {
+		return time.Time{}
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.fail()
+		return time.Time{}
+	}
+	d.b = d.b[n:]
+
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("truncated entry")
+	}
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/optmzr/d7024e-dht/clock"
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return dir
+}
+
+func openDiskBackend(t *testing.T, dir string) *DiskBackend {
+	b, err := OpenDiskBackend(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return b
+}
+
+func TestDiskBackend(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	_, private, _ := ed25519.GenerateKey(nil)
+	record := NewRecord(private, []byte("salt"), 3, []byte("ABC, du är mina tankar"))
+	now := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+
+	remote := Entry{
+		Value:     record.Value,
+		Publisher: record.Publisher,
+		Record:    record.Record,
+		Expire:    now.Add(time.Hour),
+		Deadline:  now.Add(time.Minute),
+	}
+	local := Entry{Value: []byte("q"), Republish: now.Add(24 * time.Hour)}
+	deleted := KeyFromValue([]byte("deleted"))
+
+	b := openDiskBackend(t, dir)
+	for _, err := range []error{
+		b.Put(RemoteTable, record.Key, remote),
+		b.Put(LocalTable, KeyFromValue(local.Value), Entry{Value: []byte("old")}),
+		b.Put(LocalTable, KeyFromValue(local.Value), local),
+		b.Put(RemoteTable, deleted, Entry{Value: []byte("deleted")}),
+		b.Delete(RemoteTable, deleted),
+		b.Close(),
+	} {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// The entries are loaded from the log.
+	b = openDiskBackend(t, dir)
+	defer b.Close()
+
+	got, ok, err := b.Get(RemoteTable, record.Key)
+	if err != nil || !ok {
+		t.Fatalf("expected remote entry, got: %v (%v)", ok, err)
+	}
+	if !bytes.Equal(got.Value, remote.Value) || !bytes.Equal(got.Publisher, remote.Publisher) ||
+		got.Record.Seq != 3 || !bytes.Equal(got.Record.Signature, remote.Record.Signature) ||
+		!got.Expire.Equal(remote.Expire) || !got.Deadline.Equal(remote.Deadline) || !got.Republish.IsZero() {
+		t.Errorf("unexpected remote entry, got: %+v, exp: %+v", got, remote)
+	}
+
+	got, ok, _ = b.Get(LocalTable, KeyFromValue(local.Value))
+	if !ok || !bytes.Equal(got.Value, local.Value) || !got.Republish.Equal(local.Republish) || got.Record != nil {
+		t.Errorf("unexpected local entry, got: %+v, exp: %+v", got, local)
+	}
+
+	if _, ok, _ := b.Get(RemoteTable, deleted); ok {
+		t.Error("expected deleted entry to remain deleted")
+	}
+	if _, ok, _ := b.Get(LocalTable, record.Key); ok {
+		t.Error("expected tables to be separate")
+	}
+
+	var n int
+	b.ForEach(RemoteTable, func(key Key, entry Entry) bool {
+		n++
+		return true
+	})
+	if n != 1 {
+		t.Errorf("unexpected number of remote entries, got: %d, exp: %d", n, 1)
+	}
+}
+
+func TestDiskBackend_truncated(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	key := KeyFromValue([]byte("q"))
+
+	b := openDiskBackend(t, dir)
+	b.Put(RemoteTable, key, Entry{Value: []byte("q")})
+	b.Close()
+
+	// A crash while a frame was written.
+	f, err := os.OpenFile(filepath.Join(dir, diskLogName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Write(newFrame(opPut, RemoteTable, key, encodeEntry(Entry{Value: []byte("partial")}))[:20])
+	f.Close()
+
+	b = openDiskBackend(t, dir)
+	got, ok, err := b.Get(RemoteTable, key)
+	if err != nil || !ok || string(got.Value) != "q" {
+		t.Errorf("unexpected entry, got: %s (%v, %v), exp: %s", got.Value, ok, err, "q")
+	}
+
+	// Frames written after the truncation are kept.
+	other := KeyFromValue([]byte("r"))
+	b.Put(RemoteTable, other, Entry{Value: []byte("r")})
+	b.Close()
+
+	b = openDiskBackend(t, dir)
+	defer b.Close()
+
+	if _, ok, err := b.Get(RemoteTable, other); !ok || err != nil {
+		t.Errorf("expected entry after truncation, got: %v (%v)", ok, err)
+	}
+}
+
+func TestDiskBackend_compact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	b := openDiskBackend(t, dir)
+	b.compactSize = 1000
+
+	key := KeyFromValue([]byte("q"))
+	for i := 0; i < 100; i++ {
+		err := b.Put(RemoteTable, key, Entry{Value: bytes.Repeat([]byte{byte(i)}, 100)})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	b.Close()
+
+	info, err := os.Stat(filepath.Join(dir, diskLogName))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Size() > 2000 {
+		t.Errorf("expected log to be compacted, got %d bytes", info.Size())
+	}
+
+	b = openDiskBackend(t, dir)
+	defer b.Close()
+
+	got, _, err := b.Get(RemoteTable, key)
+	if err != nil || !bytes.Equal(got.Value, bytes.Repeat([]byte{99}, 100)) {
+		t.Errorf("unexpected entry after compaction, got: %v (%v)", got.Value, err)
+	}
+}
+
+func TestDatabase_restart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	deleted := SignItem(Item{Key: KeyFromValue([]byte("deleted")), Value: []byte("deleted")}, privateKey, c.Now())
+	provider := route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Minute, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, openDiskBackend(t, dir))
+	db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, true)
+	db.AddLocalItem(testKey, testVal, 0)
+	db.AddItem(deleted, 1, 1, true)
+	db.AddTombstone(NewTombstone(deleted.Key, privateKey, c.Now()))
+	db.AddProvider(testKey, provider, 3)
+	db.Close()
+
+	db = NewDatabase(time.Second*86410, time.Second*3600, time.Minute, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, openDiskBackend(t, dir))
+	defer db.Close()
+
+	if _, err := db.GetItem(testKey); err != nil {
+		t.Errorf("expected remote item to survive the restart: %v", err)
+	}
+
+	// Deletes and providers survive the restart as well.
+	if err := db.AddItem(deleted, 1, 1, false); err != ErrTombstoned {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTombstoned)
+	}
+	if got := db.Providers(testKey, 3); len(got) != 1 || !got[0].NodeID.Equal(provider.NodeID) ||
+		!got[0].Address.IP.Equal(provider.Address.IP) || got[0].Address.Port != provider.Address.Port {
+		t.Errorf("unexpected providers, got: %v, exp: %v", got, provider)
+	}
+
+	// The local item is still republished.
+	go c.Advance(61 * time.Second)
+
+	select {
+	case item := <-db.RepublishCh():
+		if !bytes.Equal(item.Value, testVal) {
+			t.Errorf("unexpected value, got: %s, exp: %s", item.Value, testVal)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected local item to be republished after the restart")
+	}
+}
+
+func sameMeta(a, b Meta) bool {
+	return a.Expire.Equal(b.Expire) && a.Republish.Equal(b.Republish) && a.Deadline.Equal(b.Deadline)
+}
+
+func TestDiskBackend_meta(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	key := KeyFromValue([]byte("q"))
+	value := bytes.Repeat([]byte("q"), 1000)
+	meta := Meta{Expire: now.Add(time.Hour), Deadline: now.Add(2 * time.Hour)}
+
+	b := openDiskBackend(t, dir)
+	b.Put(RemoteTable, key, Entry{Value: value, Expire: now})
+	size := b.size
+
+	// The value isn't rewritten when only the metadata changes.
+	for _, err := range []error{
+		b.SetMeta(RemoteTable, key, Meta{Expire: now.Add(time.Minute)}),
+		b.SetMeta(RemoteTable, key, meta),
+		b.SetMeta(RemoteTable, KeyFromValue([]byte("missing")), meta),
+	} {
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if grown := b.size - size; grown >= int64(len(value)) {
+		t.Errorf("expected only the metadata to be appended, grew %d bytes", grown)
+	}
+
+	// The metadata is read from the index, even if the log can't be read.
+	f := b.f
+	b.f = nil
+	var n int
+	b.ForEachMeta(RemoteTable, func(k Key, m Meta) bool {
+		n++
+		if k != key || !sameMeta(m, meta) {
+			t.Errorf("unexpected metadata, got: %v %+v, exp: %v %+v", k, m, key, meta)
+		}
+		return true
+	})
+	if n != 1 {
+		t.Errorf("unexpected number of entries, got: %d, exp: %d", n, 1)
+	}
+	b.f = f
+
+	// The metadata is kept through compaction and restarts.
+	err := b.compact()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.Close()
+
+	b = openDiskBackend(t, dir)
+	defer b.Close()
+
+	got, ok, err := b.Get(RemoteTable, key)
+	if err != nil || !ok {
+		t.Fatalf("expected entry, got: %v (%v)", ok, err)
+	}
+	if !bytes.Equal(got.Value, value) || !sameMeta(got.Meta(), meta) {
+		t.Errorf("unexpected entry, got: %+v, exp: %+v", got.Meta(), meta)
+	}
+	if _, ok, _ := b.Get(RemoteTable, KeyFromValue([]byte("missing"))); ok {
+		t.Error("expected metadata of missing entry to be ignored")
+	}
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+// provider is a node that announced that it holds the content of a key.
+type provider struct {
+	contact route.Contact
+	expire  time.Time
+}
+
+// AddProvider adds a node that announced that it holds the content of the key.
+// The provider expires after the provider expiration time, unless it's
+// announced again. At most k providers are kept for the key, the one announced
+// longest ago is evicted to make room for a new provider.
+func (db *Database) AddProvider(key Key, contact route.Contact, k int) {
+	now := db.clock.Now()
+
+	db.providerLock.Lock()
+	defer db.providerLock.Unlock()
+
+	old, err := db.providers(key)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read providers of: %v", key)
+	}
+
+	// The expired providers, and the previous announce of the provider, are
+	// dropped.
+	var ps []provider
+	for _, p := range old {
+		if !now.After(p.expire) && !p.contact.NodeID.Equal(contact.NodeID) {
+			ps = append(ps, p)
+		}
+	}
+
+	if k > 0 && len(ps) >= k {
+		sort.Slice(ps, func(i, j int) bool {
+			return ps[i].expire.After(ps[j].expire)
+		})
+		ps = ps[:k-1]
+	}
+
+	expire := now.Add(db.tProvide)
+	ps = append(ps, provider{contact: contact, expire: expire})
+
+	err = db.backend.Put(ProviderTable, key, Entry{Value: encodeProviders(ps), Expire: expire})
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to store providers of: %v", key)
+	}
+}
+
+// Providers returns the k most recently announced providers of the key that
+// haven't expired, the most recent first.
+func (db *Database) Providers(key Key, k int) (contacts []route.Contact) {
+	now := db.clock.Now()
+
+	ps, err := db.providers(key)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to read providers of: %v", key)
+	}
+
+	var fresh []provider
+	for _, p := range ps {
+		if !now.After(p.expire) {
+			fresh = append(fresh, p)
+		}
+	}
+
+	sort.Slice(fresh, func(i, j int) bool {
+		return fresh[i].expire.After(fresh[j].expire)
+	})
+	if len(fresh) > k {
+		fresh = fresh[:k]
+	}
+
+	for _, p := range fresh {
+		contacts = append(contacts, p.contact)
+	}
+	return
+}
+
+// providers returns the stored providers of the key, expired or not.
+func (db *Database) providers(key Key) ([]provider, error) {
+	entry, ok, err := db.backend.Get(ProviderTable, key)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return decodeProviders(entry.Value)
+}
+
+// AddLocalProvider marks the key as provided by this node, the key is sent on
+// the reprovide channel whenever it must be announced again.
+func (db *Database) AddLocalProvider(key Key) {
+	err := db.backend.Put(LocalProviderTable, key, Entry{Republish: db.clock.Now().Add(db.tRepublish)})
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to store local provider: %v", key)
+	}
+}
+
+// ForgetProvider stops announcing that this node provides the key.
+func (db *Database) ForgetProvider(key Key) {
+	err := db.backend.Delete(LocalProviderTable, key)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to forget local provider: %v", key)
+	}
+}
+
+// ReprovideCh returns the channel of the keys that this node must announce
+// again.
+func (db *Database) ReprovideCh() chan Key {
+	return db.reprovideCh
+}
+
+// evictProviders removes the keys of which all providers have expired, the
+// expiration time of a key is that of its latest provider.
+func (db *Database) evictProviders(now time.Time) {
+	db.providerLock.Lock()
+	defer db.providerLock.Unlock()
+
+	err := db.backend.ForEachMeta(ProviderTable, func(key Key, meta Meta) bool {
+		if now.After(meta.Expire) {
+			err := db.backend.Delete(ProviderTable, key)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to evict providers of: %v", key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read providers")
+	}
+}
+
+// reprovide sends the keys that are due to be announced again on the reprovide
+// channel, it returns false if the database was closed.
+func (db *Database) reprovide(now time.Time) bool {
+	var due []Key
+
+	err := db.backend.ForEachMeta(LocalProviderTable, func(key Key, meta Meta) bool {
+		if now.After(meta.Republish) {
+			err := db.backend.SetMeta(LocalProviderTable, key, Meta{Republish: now.Add(db.tRepublish)})
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to update local provider: %v", key)
+			}
+			due = append(due, key)
+		}
+		return true
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read local providers")
+	}
+
+	// The keys are sent after the iteration, as the receiver announces them to
+	// the network before it reads the next key.
+	for _, key := range due {
+		select {
+		case db.reprovideCh <- key:
+		case <-db.done:
+			return false
+		}
+	}
+	return true
+}
+
+// encodeProviders encodes the providers as length-prefixed byte strings and
+// varints, see encodeEntry.
+func encodeProviders(ps []provider) []byte {
+	b := appendUvarint(nil, uint64(len(ps)))
+	for _, p := range ps {
+		b = appendBytes(b, p.contact.NodeID.Bytes())
+		b = appendBytes(b, p.contact.Address.IP)
+		b = appendUvarint(b, uint64(p.contact.Address.Port))
+		b = appendTime(b, p.expire)
+	}
+	return b
+}
+
+// decodeProviders decodes providers encoded by encodeProviders.
+func decodeProviders(b []byte) ([]provider, error) {
+	d := decoder{b: b}
+	n := d.uvarint()
+
+	var ps []provider
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		var p provider
+		p.contact.NodeID = node.IDFromBytes(d.bytes())
+		p.contact.Address.IP = net.IP(d.bytes())
+		p.contact.Address.Port = int(d.uvarint())
+		p.expire = d.time()
+		ps = append(ps, p)
+	}
+
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("cannot decode providers: %w", d.err)
+	}
+	return ps, nil
+}
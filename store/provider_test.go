@@ -0,0 +1,104 @@
+package store
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/optmzr/d7024e-dht/clock"
+	"github.com/optmzr/d7024e-dht/node"
+	"github.com/optmzr/d7024e-dht/route"
+)
+
+func TestProviders(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Hour, iHTicker, rHTicker, c, NewMemoryBackend())
+	defer db.Close()
+
+	key := KeyFromValue([]byte("q"))
+	a := route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}
+	b := route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}}
+
+	db.AddProvider(key, a, 3)
+	db.AddProvider(key, a, 3) // Announced again.
+	if got := db.Providers(key, 3); len(got) != 1 || !got[0].NodeID.Equal(a.NodeID) {
+		t.Errorf("unexpected providers, got: %v, exp: %v", got, a)
+	}
+
+	c.Advance(30 * time.Minute)
+	db.AddProvider(key, b, 3)
+	if got := db.Providers(key, 3); len(got) != 2 {
+		t.Errorf("unexpected number of providers, got: %d, exp: %d", len(got), 2)
+	}
+
+	// The first provider expires an hour after it was announced.
+	c.Advance(31 * time.Minute)
+	if got := db.Providers(key, 3); len(got) != 1 || !got[0].NodeID.Equal(b.NodeID) {
+		t.Errorf("unexpected providers, got: %v, exp: %v", got, b)
+	}
+
+	if got := db.Providers(KeyFromValue([]byte("other")), 3); len(got) != 0 {
+		t.Errorf("unexpected providers of other key: %v", got)
+	}
+}
+
+func TestProviders_max(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Hour, iHTicker, rHTicker, c, NewMemoryBackend())
+	defer db.Close()
+
+	key := KeyFromValue([]byte("q"))
+	var contacts []route.Contact
+	for i := 0; i < 4; i++ {
+		contact := route.Contact{NodeID: node.NewID(), Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: i}}
+		contacts = append(contacts, contact)
+
+		db.AddProvider(key, contact, 3)
+		c.Advance(time.Minute)
+	}
+
+	// The provider announced first is evicted to make room for the last.
+	got := db.Providers(key, 3)
+	if len(got) != 3 {
+		t.Fatalf("unexpected number of providers, got: %d, exp: %d", len(got), 3)
+	}
+	for i, exp := range []route.Contact{contacts[3], contacts[2], contacts[1]} {
+		if !got[i].NodeID.Equal(exp.NodeID) {
+			t.Errorf("unexpected provider at %d, got: %v, exp: %v", i, got[i].NodeID, exp.NodeID)
+		}
+	}
+
+	// Only the most recent providers are returned.
+	got = db.Providers(key, 1)
+	if len(got) != 1 || !got[0].NodeID.Equal(contacts[3].NodeID) {
+		t.Errorf("unexpected providers, got: %v, exp: %v", got, contacts[3])
+	}
+}
+
+func TestReprovideCh(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Hour, iHTicker, rHTicker, c, NewMemoryBackend())
+	defer db.Close()
+
+	key := KeyFromValue([]byte("q"))
+	db.AddLocalProvider(key)
+
+	go c.Advance(86401 * time.Second)
+
+	select {
+	case got := <-db.ReprovideCh():
+		if got != key {
+			t.Errorf("unexpected key, got: %v, exp: %v", got, key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected key to be provided again")
+	}
+
+	db.ForgetProvider(key)
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// SignItem returns the immutable item published by the publisher at the time.
+// The publisher signs the key along with the time, so that a node can only
+// claim to be the publisher of the values it published, and a publish from
+// before a delete can't bring the value back.
+func SignItem(item Item, privateKey ed25519.PrivateKey, now time.Time) Item {
+	item.Publisher = privateKey.Public().(ed25519.PublicKey)
+	item.Published = now
+	item.Signature = ed25519.Sign(privateKey, publishMessage(item.Key, now))
+	return item
+}
+
+// verifyPublisher checks that the immutable item is signed by its publisher,
+// an item without a publisher has no signature.
+func (item Item) verifyPublisher() error {
+	if item.Publisher == nil {
+		if len(item.Signature) > 0 {
+			return errors.New("signature without a publisher")
+		}
+		return nil
+	}
+
+	if len(item.Publisher) != ed25519.PublicKeySize {
+		return errors.New("invalid publisher key")
+	}
+	if !ed25519.Verify(item.Publisher, publishMessage(item.Key, item.Published), item.Signature) {
+		return errors.New("invalid publisher signature")
+	}
+	return nil
+}
+
+// publishMessage returns the message that is signed for a key and time,
+// prefixed so that the signature can't be used for anything but publishes.
+func publishMessage(key Key, t time.Time) []byte {
+	msg := append([]byte("publish:"), key[:]...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	return append(msg, b[:]...)
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
+)
+
+// MaxSaltSize is the maximum size of the salt of a record in bytes.
+const MaxSaltSize = 64
+
+// recordKeyDomain keys the hash of record keys, so that the key of a record can
+// never be the key of an immutable value.
+const recordKeyDomain = "camomile record"
+
+// ErrStaleRecord is returned when storing a record with a lower sequence number
+// than the stored record.
+var ErrStaleRecord = errors.New("record is older than the stored record")
+
+// ErrConflict is returned when a compare-and-swap of a record is rejected, as
+// the stored record is not the expected record.
+var ErrConflict = errors.New("record was changed by another writer")
+
+// Record makes an item mutable. The item is stored under the key of the public
+// key of its publisher and the salt, and can be replaced by the publisher by
+// signing a value with a higher sequence number.
+type Record struct {
+	Salt      []byte
+	Seq       uint64
+	Signature []byte
+}
+
+// RecordKey returns the key of the records signed by the publisher with the
+// salt.
+func RecordKey(publisher ed25519.PublicKey, salt []byte) Key {
+	// Cannot fail, the key is shorter than blake2b.Size.
+	h, _ := blake2b.New256([]byte(recordKeyDomain))
+	h.Write(publisher)
+	h.Write(salt)
+
+	var key Key
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// NewRecord creates a mutable item with the value, signed with the private key
+// of the publisher.
+func NewRecord(privateKey ed25519.PrivateKey, salt []byte, seq uint64, value []byte) Item {
+	publisher := privateKey.Public().(ed25519.PublicKey)
+
+	return Item{
+		Key:       RecordKey(publisher, salt),
+		Value:     value,
+		Publisher: publisher,
+		Record: &Record{
+			Salt:      salt,
+			Seq:       seq,
+			Signature: ed25519.Sign(privateKey, recordMessage(salt, seq, value)),
+		},
+	}
+}
+
+// Verify checks that the item is stored under the right key and signed by its
+// publisher. The key of an immutable item must be the hash of its value, and
+// its publisher (if any) must have signed the key, see SignItem. The key of a
+// record must be the key of its publisher and salt, and the record must be
+// signed by the publisher.
+func (item Item) Verify() error {
+	if item.Record == nil {
+		if key := KeyFromValue(item.Value); key != item.Key {
+			return fmt.Errorf("value with hash %v does not match the key: %v", key, item.Key)
+		}
+		return item.verifyPublisher()
+	}
+
+	if len(item.Publisher) != ed25519.PublicKeySize {
+		return errors.New("invalid record publisher key")
+	}
+	if len(item.Record.Salt) > MaxSaltSize {
+		return fmt.Errorf("record salt larger than %d bytes", MaxSaltSize)
+	}
+	if key := RecordKey(item.Publisher, item.Record.Salt); key != item.Key {
+		return fmt.Errorf("record with key %v does not match the key: %v", key, item.Key)
+	}
+	if !ed25519.Verify(item.Publisher, recordMessage(item.Record.Salt, item.Record.Seq, item.Value), item.Record.Signature) {
+		return errors.New("invalid record signature")
+	}
+	return nil
+}
+
+// recordMessage returns the message that is signed for a record, prefixed so
+// that the signature can't be used for anything but records.
+func recordMessage(salt []byte, seq uint64, value []byte) []byte {
+	m := []byte("record:")
+	m = append(m, byte(len(salt)))
+	m = append(m, salt...)
+
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	m = append(m, b[:]...)
+
+	return append(m, value...)
+}
@@ -0,0 +1,162 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/optmzr/d7024e-dht/clock"
+)
+
+func TestRecord(t *testing.T) {
+	publisher, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	record := NewRecord(privateKey, salt, 1, []byte("ABC, du är mina tankar"))
+	if record.Key != RecordKey(publisher, salt) {
+		t.Errorf("unexpected key, got: %v, exp: %v", record.Key, RecordKey(publisher, salt))
+	}
+
+	err := record.Verify()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The key of a record is never the key of an immutable value.
+	if record.Key == KeyFromValue(append(append([]byte{}, publisher...), salt...)) {
+		t.Error("expected record key to differ from the key of the value")
+	}
+
+	tampered := record
+	tampered.Value = []byte("Hej då")
+	if tampered.Verify() == nil {
+		t.Error("expected error for tampered value")
+	}
+
+	bumped := record
+	bumped.Record = &Record{Salt: salt, Seq: 2, Signature: record.Record.Signature}
+	if bumped.Verify() == nil {
+		t.Error("expected error for tampered sequence number")
+	}
+
+	moved := record
+	moved.Key = KeyFromValue(record.Value)
+	if moved.Verify() == nil {
+		t.Error("expected error for record under another key")
+	}
+
+	salty := NewRecord(privateKey, make([]byte, MaxSaltSize+1), 1, nil)
+	if salty.Verify() == nil {
+		t.Error("expected error for too large salt")
+	}
+}
+
+func TestAddRecord(t *testing.T) {
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	first := NewRecord(privateKey, salt, 1, []byte("first"))
+	second := NewRecord(privateKey, salt, 2, []byte("second"))
+
+	err := db.AddRecord(second, 1, 1, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = db.AddRecord(first, 1, 1, true)
+	if !errors.Is(err, ErrStaleRecord) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrStaleRecord)
+	}
+
+	item, err := db.GetItem(second.Key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(item.Value, second.Value) || item.Record == nil || item.Record.Seq != 2 {
+		t.Errorf("unexpected record, got: %v (%+v), exp: %s", item, item.Record, second.Value)
+	}
+
+	third := NewRecord(privateKey, salt, 3, []byte("third"))
+	err = db.AddRecord(third, 1, 1, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	item, _ = db.GetItem(third.Key)
+	if !bytes.Equal(item.Value, third.Value) {
+		t.Errorf("unexpected value, got: %s, exp: %s", item.Value, third.Value)
+	}
+
+	// Records can't be replaced by immutable values, and must be signed.
+	err = db.AddItem(Item{Key: third.Key, Value: []byte("immutable")}, 1, 1, true)
+	if err == nil {
+		t.Error("expected error for immutable value replacing a record")
+	}
+
+	forged := NewRecord(privateKey, salt, 4, []byte("fourth"))
+	forged.Value = []byte("forged")
+	err = db.AddRecord(forged, 1, 1, true)
+	if err == nil {
+		t.Error("expected error for forged record")
+	}
+
+	err = db.AddRecord(Item{Key: KeyFromValue([]byte("q")), Value: []byte("q")}, 1, 1, true)
+	if err == nil {
+		t.Error("expected error for immutable item")
+	}
+}
+
+func TestSwapRecord(t *testing.T) {
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	salt := []byte("config")
+
+	first := NewRecord(privateKey, salt, 1, []byte("first"))
+	second := NewRecord(privateKey, salt, 2, []byte("second"))
+	other := NewRecord(privateKey, salt, 2, []byte("other"))
+
+	// Nothing is stored, so any expected record is accepted.
+	_, err := db.SwapRecord(first, 0, 1, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = db.SwapRecord(second, 1, 1, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A retransmit of the same swap is accepted.
+	_, err = db.SwapRecord(second, 1, 1, 1)
+	if err != nil {
+		t.Errorf("unexpected error for retransmitted swap: %v", err)
+	}
+
+	// Another writer that expected the first record loses.
+	seq, err := db.SwapRecord(other, 1, 1, 1)
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrConflict)
+	}
+	if seq != 2 {
+		t.Errorf("unexpected sequence number, got: %d, exp: %d", seq, 2)
+	}
+
+	item, _ := db.GetItem(second.Key)
+	if !bytes.Equal(item.Value, second.Value) {
+		t.Errorf("unexpected value, got: %s, exp: %s", item.Value, second.Value)
+	}
+
+	_, err = db.SwapRecord(first, 1, 1, 1)
+	if err == nil {
+		t.Error("expected error for record that is not newer than the expected")
+	}
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
 	"sync"
@@ -9,41 +11,96 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ed25519"
 
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
 // Key should be a checksum made with blake2b256 hash algorithm, in binary and at a length of 32 bytes.
 type Key node.ID
 
+// ErrTombstoned is returned when storing a value that has been deleted by its
+// publisher.
+var ErrTombstoned = errors.New("value has been deleted by its publisher")
+
+// ErrStaleTombstone is returned when deleting a value with a tombstone that
+// was created more than TombstoneWindow from now, e.g. a replayed tombstone.
+var ErrStaleTombstone = errors.New("tombstone is stale")
+
+// TombstoneWindow is the largest difference between the time of a tombstone
+// and the time it's received at, which allows for skewed clocks.
+const TombstoneWindow = 10 * time.Minute
+
+// Item is a key/value pair, the publisher is the public key of the node that
+// last published the value on the network (if known). An immutable item is
+// signed by its publisher along with the time it was published, see SignItem.
+// The item is mutable if it's a record, see NewRecord. The TTL is the remaining
+// lifetime of the item, zero if it lives for as long as it's republished.
 type Item struct {
-	Key   Key
-	Value string
+	Key       Key
+	Value     []byte
+	Publisher ed25519.PublicKey
+	Published time.Time // Only set for immutable items with a publisher.
+	Signature []byte    // Only set for immutable items with a publisher.
+	Record    *Record
+	TTL       time.Duration
 }
 
-// item is an item stored by the kademlia network on this node.
-// This contains timers that decide the retention of the object along with the stored value and identifier of the node that made the store request to the network initially.
-type remoteItem struct {
-	value  string
-	expire time.Time
+// tombstone marks a deleted key, it's kept until it expires so that the key
+// isn't re-accepted during replication. The items of the publisher published
+// before the tombstone, and its records up to the sequence number, are
+// rejected.
+type tombstone struct {
+	publisher ed25519.PublicKey
+	time      time.Time
+	seq       uint64
+	expire    time.Time
 }
 
-// localItem contains a timer and the value that this node has stored on the kademlia network.
-type localItem struct {
-	value     string
-	republish time.Time
+// rejects returns true if the tombstone rejects the item. Published items of
+// other publishers are accepted, as they're not what was deleted, but items
+// without a publisher can't be told apart and are rejected.
+func (ts tombstone) rejects(item Item, touch bool) bool {
+	if item.Publisher == nil {
+		return true
+	}
+	if !bytes.Equal(ts.publisher, item.Publisher) {
+		return item.Record != nil // The publisher of a record is its owner.
+	}
+	if !touch {
+		return true // Replicated copies of the deleted item.
+	}
+	if item.Record != nil {
+		return item.Record.Seq <= ts.seq
+	}
+	return !item.Published.After(ts.time)
 }
 
-// remoteItems holds multiple items, and a Mutex lock for the datastructure.
-type remoteItems struct {
-	sync.RWMutex
-	m map[Key]remoteItem
+// entry returns the backend entry of the tombstone, see TombstoneTable.
+func (ts tombstone) entry() Entry {
+	var b []byte
+	b = appendBytes(b, ts.publisher)
+	b = appendTime(b, ts.time)
+	b = appendUvarint(b, ts.seq)
+	return Entry{Value: b, Expire: ts.expire}
 }
 
-// localItems holds multiple local items, and a Mutex lock for the datastructure.
-type localItems struct {
-	sync.RWMutex
-	m map[Key]localItem
+// tombstoneFromEntry decodes a tombstone from its backend entry.
+func tombstoneFromEntry(e Entry) (ts tombstone, err error) {
+	d := decoder{b: e.Value}
+	ts.publisher = ed25519.PublicKey(d.bytes())
+	ts.time = d.time()
+	ts.seq = d.uvarint()
+	ts.expire = e.Expire
+
+	if d.err == nil && len(d.b) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return ts, fmt.Errorf("cannot decode tombstone: %w", d.err)
+	}
+	return ts, nil
 }
 
 // replicate stores the time at which to run the database replication event, protected by a Mutex lock.
@@ -52,36 +109,54 @@ type replicate struct {
 	time time.Time
 }
 
-// Database object that contains the 2 datastructures holding remote and local items.
+// Database object that contains the remote and local items, kept in a backend.
 // Time constants dictate the behaviour of the database according to the kademlia algorithm.
 // The channel enables the database to signal DHT when to send republish events.
 type Database struct {
-	remoteItems remoteItems
-	localItems  localItems
-	replicateCh chan Item
-	republishCh chan Item
-	replicate   replicate
-	tExpire     time.Duration
-	tReplicate  time.Duration
-	tRepublish  time.Duration
+	backend       Backend
+	remoteLock    sync.RWMutex // Serializes the changes of the remote items.
+	localLock     sync.Mutex   // Serializes the changes of the local items.
+	tombstoneLock sync.Mutex   // Serializes the changes of the tombstones.
+	providerLock  sync.Mutex   // Serializes the changes of the providers.
+	replicateCh   chan Item
+	republishCh   chan Item
+	reprovideCh   chan Key
+	replicate     replicate
+	tExpire       time.Duration
+	tReplicate    time.Duration
+	tRepublish    time.Duration
+	tProvide      time.Duration
+	clock         clock.Clock
+	tickers       []*clock.Ticker
+	done          chan struct{}
+	closeOnce     sync.Once
+	wg            sync.WaitGroup
 }
 
 // NewDatabase instantiates a new database object with the given time constants, returns a Database pointer and a channel.
 // Spins up the two governing handlers as go routines, responsible for maintaining the database.
-func NewDatabase(tExpire, tReplicate, tRepublish time.Duration, iHTicker, rHTicker *time.Ticker) *Database {
+// The providers expire after tProvide, and the keys provided by this node are announced again after tRepublish.
+// The clock is used for all expiration and republish times.
+// The items, tombstones and providers are kept in the backend, which is closed along with the database.
+func NewDatabase(tExpire, tReplicate, tRepublish, tProvide time.Duration, iHTicker, rHTicker *clock.Ticker, clk clock.Clock, backend Backend) *Database {
 	db := new(Database)
 
+	db.backend = backend
+	db.clock = clk
 	db.tExpire = tExpire
 	db.tReplicate = tReplicate
 	db.tRepublish = tRepublish
+	db.tProvide = tProvide
 	db.setReplicate()
 
-	db.remoteItems = remoteItems{m: make(map[Key]remoteItem)}
-	db.localItems = localItems{m: make(map[Key]localItem)}
-
 	db.replicateCh = make(chan Item)
 	db.republishCh = make(chan Item)
+	db.reprovideCh = make(chan Key)
 
+	db.tickers = []*clock.Ticker{iHTicker, rHTicker}
+	db.done = make(chan struct{})
+
+	db.wg.Add(2)
 	go db.itemHandler(iHTicker)
 	go db.republishHandler(rHTicker)
 
@@ -91,7 +166,7 @@ func NewDatabase(tExpire, tReplicate, tRepublish time.Duration, iHTicker, rHTick
 // setReplicate, a set function for the replication interval time of the database.
 func (db *Database) setReplicate() {
 	db.replicate.Lock()
-	db.replicate.time = time.Now().Add(time.Duration(db.tReplicate))
+	db.replicate.time = db.clock.Now().Add(time.Duration(db.tReplicate))
 	db.replicate.Unlock()
 }
 
@@ -114,18 +189,201 @@ func (db *Database) RepublishCh() chan Item {
 	return db.republishCh
 }
 
-// AddItem adds an value to the remoteItems database that a node in the Kademlia network has sent to this node.
-func (db *Database) AddItem(key Key, value string, centrality int, k int, touch bool) {
-	db.remoteItems.RLock()
-	_, ok := db.remoteItems.m[key]
-	db.remoteItems.RUnlock()
+// AddItem adds an immutable item to the remoteItems database that a node in the Kademlia network has sent to this node.
+// The item must be signed by its publisher, if it has one.
+// A deleted key is only re-accepted if it's touched (published) again by the publisher after it was deleted, or published by another publisher, otherwise ErrTombstoned is returned.
+// The publisher of an existing item is replaced by the publisher of a later publish.
+// A non-zero TTL is an upper bound of the expiration time of the item.
+func (db *Database) AddItem(item Item, centrality int, k int, touch bool) error {
+	if item.Record != nil {
+		return errors.New("item is a record")
+	}
+
+	err := item.Verify()
+	if err != nil {
+		return err
+	}
+
+	db.remoteLock.Lock()
+	defer db.remoteLock.Unlock()
+
+	err = db.checkTombstone(item, touch)
+	if err != nil {
+		return err
+	}
+
+	old, ok, err := db.backend.Get(RemoteTable, item.Key)
+	if err != nil {
+		return err
+	}
+
+	if ok && old.Record != nil {
+		return fmt.Errorf("cannot replace record with key %v by an immutable value", item.Key)
+	}
 
 	if ok && !touch {
-		return
+		return nil
+	}
+
+	// The latest publish decides who may delete the item, so the first node
+	// to store a value doesn't get to delete it for everyone.
+	if ok && old.Publisher != nil && (item.Publisher == nil || !item.Published.After(old.Published)) {
+		item.Publisher, item.Published, item.Signature = old.Publisher, old.Published, old.Signature
 	}
 
-	value = truncate(value)
-	t := time.Now()
+	deadline := db.deadline(item.TTL)
+	return db.backend.Put(RemoteTable, item.Key, Entry{
+		Value:     item.Value,
+		Publisher: item.Publisher,
+		Published: item.Published,
+		Signature: item.Signature,
+		Expire:    capExpire(db.expiration(centrality, k), deadline),
+		Deadline:  deadline,
+	})
+}
+
+// checkTombstone returns ErrTombstoned if the key of the item is deleted and
+// the item is rejected by the tombstone. The tombstone is removed once its
+// publisher publishes the item again. The remote lock must be held, so that the
+// key isn't deleted before the item is stored.
+func (db *Database) checkTombstone(item Item, touch bool) error {
+	db.tombstoneLock.Lock()
+	defer db.tombstoneLock.Unlock()
+
+	entry, deleted, err := db.backend.Get(TombstoneTable, item.Key)
+	if err != nil || !deleted {
+		return err
+	}
+
+	ts, err := tombstoneFromEntry(entry)
+	if err != nil {
+		return err
+	}
+	if ts.rejects(item, touch) {
+		return ErrTombstoned
+	}
+	if bytes.Equal(ts.publisher, item.Publisher) {
+		return db.backend.Delete(TombstoneTable, item.Key) // Published again.
+	}
+	return nil
+}
+
+// AddRecord adds a record that a node in the Kademlia network has sent to this
+// node. The record must be signed by its publisher, and only the record with
+// the highest sequence number is kept, ErrStaleRecord is returned for older
+// records. A record with the same sequence number as the stored record only
+// touches the stored record.
+func (db *Database) AddRecord(record Item, centrality int, k int, touch bool) error {
+	_, err := db.addRecord(record, nil, centrality, k, touch)
+	return err
+}
+
+// SwapRecord adds a published record like AddRecord, but only if the stored
+// record has the expected sequence number. Otherwise ErrConflict is returned
+// along with the sequence number of the stored record. The record is added if
+// no record is stored, as this node may not have seen the previous record.
+func (db *Database) SwapRecord(record Item, expected uint64, centrality int, k int) (seq uint64, err error) {
+	return db.addRecord(record, &expected, centrality, k, true)
+}
+
+func (db *Database) addRecord(record Item, expected *uint64, centrality int, k int, touch bool) (uint64, error) {
+	if record.Record == nil {
+		return 0, errors.New("item is not a record")
+	}
+	if expected != nil && record.Record.Seq <= *expected {
+		return 0, errors.New("record must have a higher sequence number than the expected")
+	}
+
+	err := record.Verify()
+	if err != nil {
+		return 0, err
+	}
+
+	db.remoteLock.Lock()
+	defer db.remoteLock.Unlock()
+
+	err = db.checkTombstone(record, touch)
+	if err != nil {
+		return 0, err
+	}
+
+	old, ok, err := db.backend.Get(RemoteTable, record.Key)
+	if err != nil {
+		return 0, err
+	}
+
+	if ok && old.Record != nil {
+		// A retransmitted swap is already applied.
+		swapped := record.Record.Seq == old.Record.Seq &&
+			bytes.Equal(record.Record.Signature, old.Record.Signature)
+
+		if expected != nil && !swapped && old.Record.Seq != *expected {
+			return old.Record.Seq, ErrConflict
+		}
+
+		if record.Record.Seq < old.Record.Seq {
+			return old.Record.Seq, ErrStaleRecord
+		}
+
+		if record.Record.Seq == old.Record.Seq {
+			if touch {
+				old.Deadline = db.deadline(record.TTL)
+				old.Expire = capExpire(db.expiration(centrality, k), old.Deadline)
+				err = db.backend.Put(RemoteTable, record.Key, old)
+			}
+			return old.Record.Seq, err
+		}
+	}
+
+	deadline := db.deadline(record.TTL)
+	err = db.backend.Put(RemoteTable, record.Key, Entry{
+		Value:     record.Value,
+		Publisher: record.Publisher,
+		Record:    record.Record,
+		Expire:    capExpire(db.expiration(centrality, k), deadline),
+		Deadline:  deadline,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return record.Record.Seq, nil
+}
+
+// deadline returns the time at which an item with the TTL stored now must
+// expire, zero if the TTL is zero.
+func (db *Database) deadline(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return db.clock.Now().Add(ttl)
+}
+
+// capExpire returns the expiration time limited by the deadline, if any.
+func capExpire(expire, deadline time.Time) time.Time {
+	if !deadline.IsZero() && deadline.Before(expire) {
+		return deadline
+	}
+	return expire
+}
+
+// ttl returns the remaining lifetime until the deadline, zero if there is no
+// deadline.
+func ttl(deadline, now time.Time) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	return deadline.Sub(now)
+}
+
+// passed returns true if there is a deadline and it has passed.
+func passed(deadline, now time.Time) bool {
+	return !deadline.IsZero() && !now.Before(deadline)
+}
+
+// expiration returns the expiration time of an item stored now.
+func (db *Database) expiration(centrality int, k int) time.Time {
+	t := db.clock.Now()
 
 	// The expiration time should be "exponentially inversely proportional to
 	// the number between the current node and the node whose ID closest to the
@@ -139,128 +397,350 @@ func (db *Database) AddItem(key Key, value string, centrality int, k int, touch
 	//			24 hours; if C > k,
 	//			24*exp(k/C) hours; otherwise.
 	//		}
-	var expire time.Time
 	if centrality > k {
-		expire = t.Add(db.tExpire)
-	} else {
-		n := float64(db.tExpire.Seconds())
-		p := math.Exp(float64(k) / float64(centrality))
-		r := int64(n * p)
-		d := time.Duration(r) * time.Second
+		return t.Add(db.tExpire)
+	}
+
+	n := float64(db.tExpire.Seconds())
+	p := math.Exp(float64(k) / float64(centrality))
+	r := int64(n * p)
+	d := time.Duration(r) * time.Second
+
+	return t.Add(d)
+}
+
+// AddTombstone deletes the item with the key of the tombstone and stops the key
+// from being re-accepted until the tombstone expires, see AddItem. A stored
+// item is only deleted by a tombstone signed by its publisher, so items without
+// a known publisher are left to expire. The tombstone is kept even if the key
+// isn't stored, so that the item isn't accepted later during replication.
+// ErrStaleTombstone is returned if the tombstone wasn't created within
+// TombstoneWindow from now.
+func (db *Database) AddTombstone(t Tombstone) error {
+	err := t.Verify()
+	if err != nil {
+		return err
+	}
 
-		expire = t.Add(d)
+	if age := db.clock.Now().Sub(t.Time); age > TombstoneWindow || age < -TombstoneWindow {
+		return ErrStaleTombstone
 	}
 
-	item := remoteItem{
-		value:  value,
-		expire: expire,
+	db.remoteLock.Lock()
+	defer db.remoteLock.Unlock()
+
+	entry, ok, err := db.backend.Get(RemoteTable, t.Key)
+	if err != nil {
+		return err
+	}
+
+	ts := tombstone{
+		publisher: t.Publisher,
+		time:      t.Time,
+		seq:       math.MaxUint64, // Unknown, no record is re-accepted.
+		expire:    db.clock.Now().Add(db.tExpire),
+	}
+
+	if ok {
+		if !bytes.Equal(entry.Publisher, t.Publisher) {
+			return fmt.Errorf("tombstone for key %v not signed by the publisher of the item", t.Key)
+		}
+		if entry.Record != nil {
+			ts.seq = entry.Record.Seq
+		}
+
+		err = db.backend.Delete(RemoteTable, t.Key)
+		if err != nil {
+			return err
+		}
 	}
 
-	db.remoteItems.Lock()
-	db.remoteItems.m[key] = item
-	db.remoteItems.Unlock()
+	db.tombstoneLock.Lock()
+	defer db.tombstoneLock.Unlock()
+
+	entry, ok, err = db.backend.Get(TombstoneTable, t.Key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		old, err := tombstoneFromEntry(entry)
+		if err == nil && !t.Time.After(old.time) {
+			return nil // Already deleted by a newer tombstone.
+		}
+	}
+	return db.backend.Put(TombstoneTable, t.Key, ts.entry())
 }
 
 // AddLocalItem adds an value to the local item database that this node has requested to be stored on the kademlia network.
-func (db *Database) AddLocalItem(key Key, value string) {
-	value = truncate(value)
+// An item with a non-zero TTL is not republished after the TTL has passed.
+func (db *Database) AddLocalItem(key Key, value []byte, ttl time.Duration) error {
+	// The publisher is not set, other items are republished with the key of
+	// this node.
+	entry := Entry{
+		Value:     value,
+		Republish: db.clock.Now().Add(db.tRepublish),
+		Deadline:  db.deadline(ttl),
+	}
 
-	t := time.Now()
+	db.localLock.Lock()
+	defer db.localLock.Unlock()
+	return db.backend.Put(LocalTable, key, entry)
+}
 
-	item := localItem{
-		value:     value,
-		republish: t.Add(db.tRepublish),
+// AddLocalRecord adds a record to the local item database that this node has
+// requested to be stored on the kademlia network. The record is republished as
+// is, with the signature of its publisher.
+func (db *Database) AddLocalRecord(record Item) error {
+	entry := Entry{
+		Value:     record.Value,
+		Publisher: record.Publisher,
+		Record:    record.Record,
+		Republish: db.clock.Now().Add(db.tRepublish),
+		Deadline:  db.deadline(record.TTL),
 	}
 
-	db.localItems.Lock()
-	db.localItems.m[key] = item
-	db.localItems.Unlock()
+	db.localLock.Lock()
+	defer db.localLock.Unlock()
+	return db.backend.Put(LocalTable, record.Key, entry)
 }
 
 // GetItem returns an item stored on this node that originated from the kademlia network.
-// Also updates the expiration time of the item.
+// Also updates the expiration time of the item, within its TTL, the value isn't rewritten.
 func (db *Database) GetItem(key Key) (item Item, err error) {
-	newExpirationTime := time.Now().Add(db.tExpire)
+	now := db.clock.Now()
 
-	db.remoteItems.Lock()
-	defer db.remoteItems.Unlock()
+	db.remoteLock.Lock()
+	defer db.remoteLock.Unlock()
 
-	remoteItem, found := db.remoteItems.m[key]
-	if !found {
+	entry, found, err := db.backend.Get(RemoteTable, key)
+	if err != nil {
+		return
+	}
+	if !found || passed(entry.Deadline, now) {
 		err = fmt.Errorf("no item matching key: %v", key)
 		return
 	}
 
-	remoteItem.expire = newExpirationTime
-	db.remoteItems.m[key] = remoteItem
+	entry.Expire = capExpire(now.Add(db.tExpire), entry.Deadline)
+	err = db.backend.SetMeta(RemoteTable, key, entry.Meta())
+	if err != nil {
+		return
+	}
+
+	item = entry.item(key, now)
+	return
+}
+
+// item returns the item of the entry with the remaining TTL at the time.
+func (e Entry) item(key Key, now time.Time) Item {
+	return Item{
+		Key:       key,
+		Value:     e.Value,
+		Publisher: e.Publisher,
+		Published: e.Published,
+		Signature: e.Signature,
+		Record:    e.Record,
+		TTL:       ttl(e.Deadline, now),
+	}
+}
+
+// RemoteItems returns a copy of all the items that other nodes have stored on
+// this node.
+func (db *Database) RemoteItems() (items []Item) {
+	now := db.clock.Now()
+
+	db.remoteLock.RLock()
+	defer db.remoteLock.RUnlock()
 
-	item = Item{Key: key, Value: remoteItem.value}
+	err := db.backend.ForEach(RemoteTable, func(key Key, entry Entry) bool {
+		if !passed(entry.Deadline, now) {
+			items = append(items, entry.item(key, now))
+		}
+		return true
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read remote items")
+	}
 	return
 }
 
 // evictRemoteItem evicts an item that other nodes has stored on this node.
-// The internal map delete mechanism is encapsulated within mutex and should therefore be thread safe.
 func (db *Database) evictRemoteItem(key Key) {
 	log.Debug().Msgf("Evicting: %v", key)
-	db.remoteItems.Lock()
-	delete(db.remoteItems.m, key)
-	db.remoteItems.Unlock()
+	db.remoteLock.Lock()
+	err := db.backend.Delete(RemoteTable, key)
+	db.remoteLock.Unlock()
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to evict: %v", key)
+	}
 }
 
 // ForgetItem removes an item from the local items to stop it from being
 // republished on the Kademlia network and eventually cease to exist.
-func (db *Database) ForgetItem(key Key) {
-	db.localItems.Lock()
-	delete(db.localItems.m, key)
-	db.localItems.Unlock()
+func (db *Database) ForgetItem(key Key) error {
+	db.localLock.Lock()
+	defer db.localLock.Unlock()
+	return db.backend.Delete(LocalTable, key)
+}
+
+// Close stops the tickers of the database, waits for the handlers to return and
+// closes the backend. No replicate or republish events are sent after Close has
+// returned.
+func (db *Database) Close() {
+	db.closeOnce.Do(func() {
+		for _, ticker := range db.tickers {
+			ticker.Stop()
+		}
+		close(db.done)
+		db.wg.Wait()
+
+		err := db.backend.Close()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to close the storage backend")
+		}
+	})
+	db.wg.Wait()
 }
 
 // itemHandler checks for expired items every second and remove them if they're outdated.
-// This function should be run as a goroutine.
-func (db *Database) itemHandler(ticker *time.Ticker) {
-	for now := range ticker.C {
+// This function should be run as a goroutine, it returns when the database is closed.
+func (db *Database) itemHandler(ticker *clock.Ticker) {
+	defer db.wg.Done()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-db.done:
+			return
+		}
+
 		var evictees []Key
 
-		db.remoteItems.RLock()
-		for key, item := range db.remoteItems.m {
-			if now.After(item.expire) {
+		db.remoteLock.RLock()
+		err := db.backend.ForEachMeta(RemoteTable, func(key Key, meta Meta) bool {
+			if now.After(meta.Expire) {
 				evictees = append(evictees, key)
 			}
+			return true
+		})
+		db.remoteLock.RUnlock()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read remote items")
 		}
-		db.remoteItems.RUnlock()
 
 		for _, key := range evictees {
 			db.evictRemoteItem(key)
 		}
+
+		db.evictTombstones(now)
+		db.evictProviders(now)
+	}
+}
+
+// evictTombstones removes the expired tombstones.
+func (db *Database) evictTombstones(now time.Time) {
+	db.tombstoneLock.Lock()
+	defer db.tombstoneLock.Unlock()
+
+	err := db.backend.ForEachMeta(TombstoneTable, func(key Key, meta Meta) bool {
+		if now.After(meta.Expire) {
+			err := db.backend.Delete(TombstoneTable, key)
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to evict tombstone: %v", key)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read tombstones")
 	}
 }
 
 // republishHandler checks stored localItems that's due for renewal at remote nodes.
-// This function should be run as a goroutine.
-func (db *Database) republishHandler(ticker *time.Ticker) {
-	for now := range ticker.C {
+// This function should be run as a goroutine, it returns when the database is closed.
+func (db *Database) republishHandler(ticker *clock.Ticker) {
+	defer db.wg.Done()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-db.done:
+			return
+		}
+
 		replicate := now.After(db.getReplicate())
 
-		db.localItems.Lock()
-		for key, localItem := range db.localItems.m {
-			if now.After(localItem.republish) {
+		// The due items are collected while the lock is held, and sent once
+		// it's released, as the receivers wait for the items to be stored.
+		var due []Item
+
+		db.localLock.Lock()
+		err := db.backend.ForEachMeta(LocalTable, func(key Key, meta Meta) bool {
+			if passed(meta.Deadline, now) {
+				// The TTL has passed, stop republishing the item.
+				err := db.backend.Delete(LocalTable, key)
+				if err != nil {
+					log.Error().Err(err).Msgf("Failed to delete expired local item: %v", key)
+				}
+				return true
+			}
+
+			if now.After(meta.Republish) {
+				entry, ok, err := db.backend.Get(LocalTable, key)
+				if err != nil || !ok {
+					log.Error().Err(err).Msgf("Failed to read local item: %v", key)
+					return true
+				}
 
 				// Update republish timestamp.
-				localItem.republish = now.Add(db.tRepublish)
-				db.localItems.m[key] = localItem
+				entry.Republish = now.Add(db.tRepublish)
+				err = db.backend.SetMeta(LocalTable, key, entry.Meta())
+				if err != nil {
+					log.Error().Err(err).Msgf("Failed to update local item: %v", key)
+				}
 
-				db.republishCh <- Item{Key: key, Value: localItem.value}
+				due = append(due, entry.item(key, now))
 			}
+			return true
+		})
+		db.localLock.Unlock()
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to read local items")
+		}
+
+		for _, item := range due {
+			if !db.send(db.republishCh, item) {
+				return
+			}
+		}
+
+		if !db.reprovide(now) {
+			return
 		}
-		db.localItems.Unlock()
 
 		// Replication event, replicate all stored values to k nodes.
 		if replicate {
-			db.remoteItems.RLock()
-			for key, remoteItem := range db.remoteItems.m {
-				db.replicateCh <- Item{Key: key, Value: remoteItem.value}
+			due = due[:0]
+
+			db.remoteLock.RLock()
+			err := db.backend.ForEach(RemoteTable, func(key Key, entry Entry) bool {
+				if !passed(entry.Deadline, now) { // Else evicted by the item handler.
+					due = append(due, entry.item(key, now))
+				}
+				return true
+			})
+			db.remoteLock.RUnlock()
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to read remote items")
+			}
+
+			for _, item := range due {
+				if !db.send(db.replicateCh, item) {
+					return
+				}
 			}
-			db.remoteItems.RUnlock()
 		}
 
 		// If a replication event just happened, reset the replication timer.
@@ -270,6 +750,17 @@ func (db *Database) republishHandler(ticker *time.Ticker) {
 	}
 }
 
+// send sends the item on the channel, it returns false if the database was
+// closed before the item could be sent.
+func (db *Database) send(ch chan Item, item Item) bool {
+	select {
+	case ch <- item:
+		return true
+	case <-db.done:
+		return false
+	}
+}
+
 // KeyFromString parses a hexadecimal representation of the key into a Key.
 func KeyFromString(str string) (key Key, err error) {
 	h, err := hex.DecodeString(str)
@@ -287,18 +778,12 @@ func (k Key) String() string {
 	return hex.EncodeToString(k[:])
 }
 
-func KeyFromValue(value string) Key {
-	return blake2b.Sum256([]byte(truncate(value)))
-}
-
-// truncate truncates supplied string to a maximum of a 1000 characters. Returns a string.
-func truncate(s string) string {
-	if len(s) > 1000 {
-		return s[:1000]
-	}
-	return s
+// KeyFromValue returns the key of a value, i.e. the blake2b256 checksum of the
+// whole value.
+func KeyFromValue(value []byte) Key {
+	return blake2b.Sum256(value)
 }
 
 func (item Item) String() string {
-	return fmt.Sprintf("%v: %s", item.Key, item.Value)
+	return fmt.Sprintf("%v: %d bytes", item.Key, len(item.Value))
 }
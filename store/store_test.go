@@ -2,21 +2,26 @@ package store
 
 import (
 	"bytes"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/optmzr/d7024e-dht/clock"
 	"github.com/optmzr/d7024e-dht/node"
 )
 
 func TestItemsAdd(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
-	testVal := "q"
+	testVal := []byte("q")
 	testKey := KeyFromValue(testVal)
 
-	db.AddItem(testKey, testVal, 1, 1, true)
+	db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, true)
 
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 
@@ -26,24 +31,24 @@ func TestItemsAdd(t *testing.T) {
 		t.Errorf("did not find entry in hash table for: %x", trueHash)
 	}
 
-	if !(testVal == storedTestItem.Value) {
+	if !bytes.Equal(testVal, storedTestItem.Value) {
 		t.Errorf("value of item does not match original value.\nExpected: %x\nGot: %x", testVal, storedTestItem.Value)
 	}
 
 	// No touchy.
 	testItemCopy := storedTestItem
-	db.AddItem(testKey, "something else", 1, 1, false)
+	db.AddItem(Item{Key: testKey, Value: []byte("something else")}, 1, 1, false)
 	storedTestItem, _ = db.GetItem(trueHash)
 
-	if testItemCopy.Value != storedTestItem.Value {
+	if !bytes.Equal(testItemCopy.Value, storedTestItem.Value) {
 		t.Errorf("unexpected value, should be the same")
 	}
 }
 
 func BenchmarkAddItem(b *testing.B) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	testVal := []string{
 		"fearlessness",
@@ -72,64 +77,60 @@ func BenchmarkAddItem(b *testing.B) {
 
 	var testKey []Key
 	for _, val := range testVal {
-		testKey = append(testKey, KeyFromValue(val))
+		testKey = append(testKey, KeyFromValue([]byte(val)))
 	}
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		db.AddItem(testKey[i%len(testKey)], testVal[i%len(testVal)], 1, 1, false)
+		db.AddItem(Item{Key: testKey[i%len(testKey)], Value: []byte(testVal[i%len(testVal)])}, 1, 1, false)
 	}
 }
 
-func TestTruncate(t *testing.T) {
-	tooLongString := "9Tf2YFM1NLOxCVWg3e5lclDBPqEV0yzQGHhc41ZUoWTy9maE5hzPyWBgmwMWhg1yM1hb572ZXdXEGjoQvyNT8exx6fikCiFmJQcPBdCcw9rzlR4BseKtyixbeRhh9NF0AWoltgMVPJdYPSgWHYEUlPAdYFCAvlRs5Vumziu2niuPWzhTfzy9RDAfB1Tqt6mHPu9Cxsq1oSZUxltamshva8N2qoc4Rt5qoOoVxMyRxq21WcJ7xXVTHmd1EzpyJ31bnvoiN8zdtc0zPKQ3ddNkuCnRoJzQ78FqPSsXM6DgpNeMcaGFpPwj65hLa2gga4L8N7POF7rZdJJY8vyKIc8b6fLVlrMBlAHuIrrVzjhYw1tuGr26p1TIiV6jfYHPZkZiF5vQCeuN95uCDuP7uJOQUlo4J19pUw2sNB18mMCA7XFYnH4Ys1esF4ordeWkaJ6jLlS3ZThFsfVAVhRzke70ZQUWsWJD6LPJQjILZoffj3hpxlw7FlOeTqpPeHvAyZXX6MTNv95hbU0dWDa6vaUrO3ICVyTHsAr46CpvQMA8kbnfU6szKe1kTgJHvSmL8N9sqcPzd4eMaBtfGUoMBZgHpx18NeaAmx3sZ8RM1gMLDMCO5R0CeW8EsiLkoal4W1bG2nOECi4sGzX22LWcEU1QeuQbn5uFj8oVA8qmCN1cBQreo5cx0AXT0oSMnnuvelJBavHMU8CUjsawq7mUDuzm0M9dBYnXb2INbctkduN5jzAmo1F4ZqAZBOUH2FIr9A8U7bBShtlynWiV8PXepDMXN22kCZ2MRZ7CDkbV4OdFey6MZvbXx9LHZQ8Q4EjQ4FGjV1S0vbrThMVHRNzrjcwWvvZMCDSjE5Ct5d08nJKQ7vZVSdAihVNCyXFVxQIXr8AeFMk6cJDS4E3fbOo9YKJrRWawxJ2h4Q87dLqszVyAo1yJSQawTtinRdq1pogY578J8iMbegqqgLYABrxxnEVU0J2prsx4kGkpMaQRtgggusjA1I46CUmVSsPU3vGB"
+func TestKeyFromValue_long(t *testing.T) {
+	long := bytes.Repeat([]byte{'a'}, 5000)
+	other := append(bytes.Repeat([]byte{'a'}, 4999), 'b')
 
-	maxThousandCharString := truncate(tooLongString)
-	if len(maxThousandCharString) > 1000 {
-		t.Errorf("Truncate produces a too long string, more than 1000 chars")
+	if KeyFromValue(long) == KeyFromValue(other) {
+		t.Error("expected the whole value to be hashed")
 	}
-
-	tenCharString := "0123456789"
-
-	sameString := truncate(tenCharString)
-	if len(sameString) != len(tenCharString) {
-		t.Errorf("Truncate truncates before 1000 chars")
+	if KeyFromValue(long) == KeyFromValue(long[:1000]) {
+		t.Error("expected the value not to be truncated")
 	}
 }
 
 func TestStoredKeysAdd(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
-	testVal := "q"
+	testVal := []byte("q")
 
-	db.AddLocalItem(trueHash, testVal)
+	db.AddLocalItem(trueHash, testVal, 0)
 
 	storedLocalItem, ok := getLocalItem(db, trueHash)
 	if !ok {
 		t.Errorf("Did not find item entry in key DB for: %x", trueHash)
 	}
 
-	if storedLocalItem.republish.IsZero() {
+	if storedLocalItem.Republish.IsZero() {
 		t.Errorf("Key in DB has no time associated.")
 	}
 }
 
 func TestEvictItem(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 
-	testVal := "q"
+	testVal := []byte("q")
 
 	var testNodeID node.ID
 	copy(testNodeID[:], "w")
 
-	db.AddItem(KeyFromValue(testVal), testVal, 2, 1, false)
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 2, 1, false)
 
 	// GetItem returns error if item is not found, this assures that something is inserted before we remove it.
 	_, err := db.GetItem(trueHash)
@@ -147,19 +148,19 @@ func TestEvictItem(t *testing.T) {
 }
 
 func TestGetItem(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	fakeHash := [32]byte{17, 69, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 
-	testVal := "q"
+	testVal := []byte("q")
 
 	var testNodeID node.ID
 	copy(testNodeID[:], "w")
 
-	db.AddItem(KeyFromValue(testVal), testVal, 1, 1, false)
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 1, 1, false)
 
 	_, err := db.GetItem(fakeHash)
 	if err == nil {
@@ -172,30 +173,28 @@ func TestGetItem(t *testing.T) {
 	}
 }
 
-func getLocalItem(db *Database, key Key) (localItem, bool) {
-	db.localItems.RLock()
-	defer db.localItems.RUnlock()
-	item, ok := db.localItems.m[key]
-	return item, ok
+func getLocalItem(db *Database, key Key) (Entry, bool) {
+	entry, ok, _ := db.backend.Get(LocalTable, key)
+	return entry, ok
 }
 
 func TestGetRepubTime(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	fakeHash := [32]byte{17, 69, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
-	testVal := "q"
+	testVal := []byte("q")
 
-	db.AddLocalItem(trueHash, testVal)
+	db.AddLocalItem(trueHash, testVal, 0)
 
 	storedLocalItem, ok := getLocalItem(db, trueHash)
 	if !ok {
 		t.Error("key doesn't exist in db")
 	}
 
-	if storedLocalItem.republish.IsZero() {
+	if storedLocalItem.Republish.IsZero() {
 		t.Error("key in DB has no time associated.")
 	}
 
@@ -206,10 +205,10 @@ func TestGetRepubTime(t *testing.T) {
 }
 
 func TestItemHandler(t *testing.T) {
-	rHTicker := time.NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
 
 	tch := make(chan time.Time)
-	iHTicker := &time.Ticker{
+	iHTicker := &clock.Ticker{
 		C: tch,
 	}
 
@@ -221,12 +220,12 @@ func TestItemHandler(t *testing.T) {
 		tch <- time.Now().Add(1000 * time.Hour)
 	}(tch, tick)
 
-	testVal := "q"
+	testVal := []byte("q")
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 
-	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
-	db.AddItem(KeyFromValue(testVal), testVal, 1, 1, false)
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 1, 1, false)
 	_, err := db.GetItem(trueHash)
 	if err != nil {
 		t.Error("no item was added to db")
@@ -245,10 +244,10 @@ func TestItemHandler(t *testing.T) {
 }
 
 func TestRepublisher(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
+	iHTicker := clock.New().NewTicker(time.Second)
 
 	tch := make(chan time.Time)
-	rHTicker := &time.Ticker{
+	rHTicker := &clock.Ticker{
 		C: tch,
 	}
 
@@ -260,25 +259,25 @@ func TestRepublisher(t *testing.T) {
 		tch <- time.Now().Add(1000 * time.Hour)
 	}(tch, tick)
 
-	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
-	testVal := "q"
+	testVal := []byte("q")
 
-	db.AddLocalItem(trueHash, testVal)
+	db.AddLocalItem(trueHash, testVal, 0)
 	tick <- struct{}{} // Item should have been added, make the ticker tick.
 
 	republished := <-db.republishCh
-	if republished.Value != testVal {
+	if !bytes.Equal(republished.Value, testVal) {
 		t.Errorf("LocalItem did not get republished.")
 	}
 }
 
 func TestReplication(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
+	iHTicker := clock.New().NewTicker(time.Second)
 
 	tch := make(chan time.Time)
-	rHTicker := &time.Ticker{
+	rHTicker := &clock.Ticker{
 		C: tch,
 	}
 
@@ -290,15 +289,15 @@ func TestReplication(t *testing.T) {
 		tch <- time.Now().Add(1000 * time.Hour)
 	}(tch, tick)
 
-	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, iHTicker, rHTicker)
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
-	testVal := "q"
+	testVal := []byte("q")
 
-	db.AddItem(KeyFromValue(testVal), testVal, 1, 1, false)
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 1, 1, false)
 	tick <- struct{}{} // Item should have been added, make the ticker tick.
 
 	replicated := <-db.replicateCh
-	if replicated.Value != testVal {
+	if !bytes.Equal(replicated.Value, testVal) {
 		t.Errorf("Key did not get replicated")
 	}
 }
@@ -325,9 +324,9 @@ func TestKeyFromString(t *testing.T) {
 }
 
 func TestRepublishCh(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	returnedChan := db.RepublishCh()
 	go func() { returnedChan <- Item{} }()
@@ -335,9 +334,9 @@ func TestRepublishCh(t *testing.T) {
 }
 
 func TestReplicateCh(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	returnedChan := db.ReplicateCh()
 	go func() { returnedChan <- Item{} }()
@@ -345,15 +344,15 @@ func TestReplicateCh(t *testing.T) {
 }
 
 func TestForgetItem(t *testing.T) {
-	iHTicker := time.NewTicker(time.Second)
-	rHTicker := time.NewTicker(time.Second)
-	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, iHTicker, rHTicker)
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
 
 	trueHash := [32]byte{174, 79, 167, 92, 82, 249, 190, 142, 129, 67, 178, 149, 52, 212, 158, 150, 67, 136, 83, 10, 170, 233, 83, 34, 158, 194, 62, 241, 14, 168, 19, 103}
 
-	testVal := "q"
+	testVal := []byte("q")
 
-	db.AddLocalItem(trueHash, testVal)
+	db.AddLocalItem(trueHash, testVal, 0)
 
 	_, ok := getLocalItem(db, trueHash)
 	if !ok {
@@ -369,9 +368,459 @@ func TestForgetItem(t *testing.T) {
 }
 
 func TestItemString(t *testing.T) {
-	item := Item{Key: [32]byte{}, Value: "q"}
+	item := Item{Key: [32]byte{}, Value: []byte("abc")}
 	str := item.String()
-	if str != "0000000000000000000000000000000000000000000000000000000000000000: q" {
+	if str != "0000000000000000000000000000000000000000000000000000000000000000: 3 bytes" {
 		t.Errorf("unexpected string: %s", str)
 	}
 }
+
+// advance advances the fake clock n times by d, and waits for the tickers to
+// be received after each step so that every step is observed.
+func advance(c *clock.Fake, d time.Duration, n int, tickers ...*clock.Ticker) {
+	for i := 0; i < n; i++ {
+		c.Advance(d)
+		for _, ticker := range tickers {
+			for len(ticker.C) > 0 {
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+func TestFakeClock_day(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400,
+		iHTicker, rHTicker, c, NewMemoryBackend())
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	db.AddLocalItem(testKey, testVal, 0)
+	db.AddItem(Item{Key: testKey, Value: testVal}, 2, 1, false) // Expires after 86410 seconds.
+
+	var republished, replicated uint32
+	go func() {
+		for {
+			select {
+			case <-db.RepublishCh():
+				atomic.AddUint32(&republished, 1)
+			case <-db.ReplicateCh():
+				atomic.AddUint32(&replicated, 1)
+			}
+		}
+	}()
+
+	// Run a day worth of events, an hour at a time.
+	advance(c, time.Hour, 25, iHTicker, rHTicker)
+
+	for start := time.Now(); time.Since(start) < time.Second; {
+		_, err := db.GetItem(testKey)
+		if err != nil &&
+			atomic.LoadUint32(&republished) > 0 &&
+			atomic.LoadUint32(&replicated) > 0 {
+			return // Done, item was removed, republished and replicated.
+		}
+	}
+
+	t.Errorf("expected item to be removed (republished %d times, replicated %d times)",
+		atomic.LoadUint32(&republished), atomic.LoadUint32(&replicated))
+}
+
+func TestAddTombstone(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, c, NewMemoryBackend())
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+	published := SignItem(Item{Key: testKey, Value: testVal}, privateKey, c.Now())
+
+	db.AddItem(published, 1, 1, true)
+
+	// Only the publisher is allowed to delete the item.
+	err := db.AddTombstone(NewTombstone(testKey, otherKey, c.Now()))
+	if err == nil {
+		t.Error("expected error for tombstone not signed by the publisher")
+	}
+	if _, err := db.GetItem(testKey); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Tombstones from too long ago, or too far ahead, are rejected.
+	for _, d := range []time.Duration{-TombstoneWindow - time.Second, TombstoneWindow + time.Second} {
+		err = db.AddTombstone(NewTombstone(testKey, privateKey, c.Now().Add(d)))
+		if err != ErrStaleTombstone {
+			t.Errorf("unexpected error, got: %v, exp: %v", err, ErrStaleTombstone)
+		}
+	}
+
+	err = db.AddTombstone(NewTombstone(testKey, privateKey, c.Now()))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := db.GetItem(testKey); err == nil {
+		t.Error("expected error since the item should be deleted")
+	}
+
+	// The key must not be re-accepted during replication, or by a publish from
+	// before the delete.
+	for _, touch := range []bool{false, true} {
+		err = db.AddItem(published, 1, 1, touch)
+		if err != ErrTombstoned {
+			t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTombstoned)
+		}
+	}
+	err = db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, false)
+	if err != ErrTombstoned {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTombstoned)
+	}
+
+	// The tombstone expires like an item.
+	advance(c, time.Hour, 25, iHTicker, rHTicker)
+
+	for start := time.Now(); time.Since(start) < time.Second; {
+		if db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, false) == nil {
+			return // Done, the tombstone expired.
+		}
+	}
+
+	t.Error("expected tombstone to expire")
+}
+
+func TestAddTombstone_notHeld(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, NewMemoryBackend())
+	defer db.Close()
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	// The tombstone of a key that isn't held is kept, so that the item isn't
+	// accepted when it's replicated later.
+	err := db.AddTombstone(NewTombstone(testKey, privateKey, c.Now()))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	published := SignItem(Item{Key: testKey, Value: testVal}, privateKey, c.Now().Add(-time.Second))
+	err = db.AddItem(published, 1, 1, false)
+	if err != ErrTombstoned {
+		t.Errorf("unexpected error, got: %v, exp: %v", err, ErrTombstoned)
+	}
+	if _, err := db.GetItem(testKey); err == nil {
+		t.Error("expected error since the item should be deleted")
+	}
+}
+
+func TestAddTombstone_withoutPublisher(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, NewMemoryBackend())
+	defer db.Close()
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	// Items held without a publisher can't be deleted.
+	db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, true)
+	err := db.AddTombstone(NewTombstone(testKey, privateKey, c.Now()))
+	if err == nil {
+		t.Error("expected error for tombstone of item without publisher")
+	}
+	if _, err := db.GetItem(testKey); err != nil {
+		t.Errorf("expected item to be kept, got: %v", err)
+	}
+	if err := db.AddItem(Item{Key: testKey, Value: testVal}, 1, 1, false); err != nil {
+		t.Errorf("expected key to not be blocked, got: %v", err)
+	}
+}
+
+func TestAddItem_publisher(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, NewMemoryBackend())
+	defer db.Close()
+
+	publisher, privateKey, _ := ed25519.GenerateKey(nil)
+	other, otherKey, _ := ed25519.GenerateKey(nil)
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	// A publisher without a valid signature is rejected, so no node can
+	// claim the right to delete the values of others.
+	unsigned := Item{Key: testKey, Value: testVal, Publisher: publisher, Published: c.Now()}
+	forged := SignItem(Item{Key: testKey, Value: testVal}, otherKey, c.Now())
+	forged.Publisher = publisher
+	for _, item := range []Item{unsigned, forged} {
+		if err := db.AddItem(item, 1, 1, true); err == nil {
+			t.Error("expected error for item not signed by the publisher")
+		}
+	}
+
+	// The latest publish decides the publisher of the item.
+	db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, otherKey, c.Now()), 1, 1, true)
+	db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, privateKey, c.Now().Add(time.Second)), 1, 1, true)
+	db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, otherKey, c.Now().Add(-time.Second)), 1, 1, true)
+
+	item, err := db.GetItem(testKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(item.Publisher, publisher) {
+		t.Errorf("unexpected publisher, got: %x, exp: %x", item.Publisher, publisher)
+	}
+
+	// Only the latest publisher may delete the item.
+	err = db.AddTombstone(NewTombstone(testKey, otherKey, c.Now()))
+	if err == nil {
+		t.Error("expected error for tombstone not signed by the publisher")
+	}
+	if _, err := db.GetItem(testKey); err != nil {
+		t.Errorf("expected item to be kept, got: %v", err)
+	}
+
+	// A tombstone only blocks the items of its publisher.
+	err = db.AddTombstone(NewTombstone(testKey, privateKey, c.Now().Add(2*time.Second)))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, otherKey, c.Now()), 1, 1, true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	item, err = db.GetItem(testKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(item.Publisher, other) {
+		t.Errorf("unexpected publisher, got: %x, exp: %x", item.Publisher, other)
+	}
+}
+
+func TestAddItem_republishTombstoned(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, NewMemoryBackend())
+	defer db.Close()
+
+	publisher, privateKey, _ := ed25519.GenerateKey(nil)
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, privateKey, c.Now()), 1, 1, true)
+	err := db.AddTombstone(NewTombstone(testKey, privateKey, c.Now()))
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The publisher is allowed to publish the value again.
+	err = db.AddItem(SignItem(Item{Key: testKey, Value: testVal}, privateKey, c.Now().Add(time.Second)), 1, 1, true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	item, err := db.GetItem(testKey)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(item.Publisher, publisher) {
+		t.Errorf("unexpected publisher, got: %x, exp: %x", item.Publisher, publisher)
+	}
+}
+
+func TestAddItem_ttl(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Second*86400, time.Second*86400,
+		c.NewTicker(time.Second), c.NewTicker(time.Second), c, NewMemoryBackend())
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+
+	err := db.AddItem(Item{Key: testKey, Value: testVal, TTL: 10 * time.Minute}, 1, 1, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c.Advance(4 * time.Minute)
+
+	// Reading the item doesn't extend it past its TTL.
+	item, err := db.GetItem(testKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if item.TTL != 6*time.Minute {
+		t.Errorf("unexpected TTL, got: %v, exp: %v", item.TTL, 6*time.Minute)
+	}
+
+	c.Advance(6 * time.Minute)
+
+	_, err = db.GetItem(testKey)
+	if err == nil {
+		t.Error("expected item to have expired")
+	}
+	if len(db.RemoteItems()) != 0 {
+		t.Errorf("unexpected remote items: %v", db.RemoteItems())
+	}
+}
+
+func TestRepublish_ttl(t *testing.T) {
+	c := clock.NewFake(time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC))
+	iHTicker := c.NewTicker(time.Second)
+	rHTicker := c.NewTicker(time.Second)
+	db := NewDatabase(time.Second*86410, time.Second*3600, time.Minute, time.Second*86400,
+		iHTicker, rHTicker, c, NewMemoryBackend())
+
+	testVal := []byte("q")
+	testKey := KeyFromValue(testVal)
+	db.AddLocalItem(testKey, testVal, 150*time.Second)
+
+	// Republished every minute until the TTL has passed.
+	advanced := make(chan struct{})
+	go func() {
+		advance(c, 10*time.Second, 30, iHTicker, rHTicker)
+		close(advanced)
+	}()
+
+	var republished []Item
+	for done := false; !done; {
+		select {
+		case item := <-db.RepublishCh():
+			republished = append(republished, item)
+		case <-advanced:
+			done = true
+		}
+	}
+
+	if len(republished) != 2 {
+		t.Fatalf("unexpected number of republishes, got: %d, exp: %d", len(republished), 2)
+	}
+	if ttl := republished[1].TTL; ttl != 10*time.Second {
+		t.Errorf("unexpected TTL of last republish, got: %v, exp: %v", ttl, 10*time.Second)
+	}
+	if _, ok := getLocalItem(db, testKey); ok {
+		t.Error("expected local item to be removed after its TTL")
+	}
+}
+
+func TestClose(t *testing.T) {
+	iHTicker := clock.New().NewTicker(time.Second)
+
+	tch := make(chan time.Time, 1)
+	rHTicker := &clock.Ticker{
+		C: tch,
+	}
+
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
+
+	testVal := []byte("q")
+
+	// The handler blocks on the replicate channel, as nobody is reading it.
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 1, 1, false)
+	tch <- time.Now().Add(1000 * time.Hour)
+
+	done := make(chan struct{})
+	go func() {
+		db.Close()
+		db.Close() // Closing twice is a no-op.
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close timed out")
+	}
+
+	select {
+	case item := <-db.ReplicateCh():
+		t.Errorf("unexpected replicate event after close: %v", item)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestAddItem_pendingReplication(t *testing.T) {
+	iHTicker := clock.New().NewTicker(time.Second)
+
+	tch := make(chan time.Time, 1)
+	rHTicker := &clock.Ticker{
+		C: tch,
+	}
+
+	db := NewDatabase(time.Second*86400, time.Second*0, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
+	defer db.Close()
+
+	testVal := []byte("q")
+
+	// The handler waits on the replicate channel, as nobody is reading it yet.
+	db.AddItem(Item{Key: KeyFromValue(testVal), Value: testVal}, 1, 1, false)
+	tch <- time.Now().Add(time.Hour)
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		otherVal := []byte("w")
+		db.AddItem(Item{Key: KeyFromValue(otherVal), Value: otherVal}, 1, 1, false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("add item blocked by pending replication")
+	}
+
+	select {
+	case item := <-db.ReplicateCh():
+		if !bytes.Equal(item.Value, testVal) {
+			t.Errorf("unexpected replicated value, got: %s, exp: %s", item.Value, testVal)
+		}
+	case <-time.After(time.Second):
+		t.Error("replication timed out")
+	}
+}
+
+func TestRemoteItems(t *testing.T) {
+	iHTicker := clock.New().NewTicker(time.Second)
+	rHTicker := clock.New().NewTicker(time.Second)
+	db := NewDatabase(time.Second*86400, time.Second*3600, time.Second*86400, time.Second*86400, iHTicker, rHTicker, clock.New(), NewMemoryBackend())
+
+	publisher, privateKey, _ := ed25519.GenerateKey(nil)
+
+	values := map[Key][]byte{}
+	for _, value := range [][]byte{[]byte("q"), []byte("w"), []byte("e")} {
+		key := KeyFromValue(value)
+		values[key] = value
+		db.AddItem(SignItem(Item{Key: key, Value: value}, privateKey, time.Now()), 1, 1, false)
+	}
+
+	// Local items are not stored on behalf of other nodes.
+	db.AddLocalItem(KeyFromValue([]byte("r")), []byte("r"), 0)
+
+	items := db.RemoteItems()
+	if len(items) != len(values) {
+		t.Errorf("unexpected number of items, got: %d, exp: %d", len(items), len(values))
+	}
+
+	for _, item := range items {
+		if !bytes.Equal(values[item.Key], item.Value) {
+			t.Errorf("unexpected value for key %v, got: %s, exp: %s", item.Key, item.Value, values[item.Key])
+		}
+		if !bytes.Equal(item.Publisher, publisher) {
+			t.Errorf("unexpected publisher, got: %x, exp: %x", item.Publisher, publisher)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Tombstone is a signed request from the publisher of a value to delete it
+// from the network. The time at which it was created is signed along with the
+// key, so that it can't be replayed once it's stale.
+type Tombstone struct {
+	Key       Key
+	Publisher ed25519.PublicKey
+	Time      time.Time
+	Signature []byte
+}
+
+// NewTombstone creates a tombstone for the key at the time, signed with the
+// private key of the publisher.
+func NewTombstone(key Key, privateKey ed25519.PrivateKey, now time.Time) Tombstone {
+	return Tombstone{
+		Key:       key,
+		Publisher: privateKey.Public().(ed25519.PublicKey),
+		Time:      now,
+		Signature: ed25519.Sign(privateKey, tombstoneMessage(key, now)),
+	}
+}
+
+// Verify checks that the tombstone is signed by its publisher.
+func (t Tombstone) Verify() error {
+	if len(t.Publisher) != ed25519.PublicKeySize {
+		return errors.New("invalid tombstone publisher key")
+	}
+	if !ed25519.Verify(t.Publisher, tombstoneMessage(t.Key, t.Time), t.Signature) {
+		return errors.New("invalid tombstone signature")
+	}
+	return nil
+}
+
+// tombstoneMessage returns the message that is signed for a key and time,
+// prefixed so that the signature can't be used for anything but tombstones.
+func tombstoneMessage(key Key, t time.Time) []byte {
+	msg := append([]byte("tombstone:"), key[:]...)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	return append(msg, b[:]...)
+}
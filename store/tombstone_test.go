@@ -0,0 +1,47 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestTombstone_verify(t *testing.T) {
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	key := KeyFromValue([]byte("q"))
+	now := time.Date(2019, 10, 7, 13, 42, 0, 0, time.UTC)
+	ts := NewTombstone(key, privateKey, now)
+
+	err := ts.Verify()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Signed by someone else than the publisher.
+	forged := ts
+	forged.Signature = NewTombstone(key, otherKey, now).Signature
+	if err := forged.Verify(); err == nil {
+		t.Error("expected error for forged signature")
+	}
+
+	// Signature for another key.
+	other := ts
+	other.Key = KeyFromValue([]byte("w"))
+	if err := other.Verify(); err == nil {
+		t.Error("expected error for signature of another key")
+	}
+
+	// Signature for another time, e.g. a replayed tombstone with a new time.
+	replayed := ts
+	replayed.Time = now.Add(time.Hour)
+	if err := replayed.Verify(); err == nil {
+		t.Error("expected error for signature of another time")
+	}
+
+	if err := (Tombstone{Key: key}).Verify(); err == nil {
+		t.Error("expected error for missing publisher")
+	}
+}